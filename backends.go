@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/NectGmbH/health"
+	"github.com/golang/glog"
+)
+
+// backendSet tracks all backends of a single loadbalancer, the configured ones as well as the ones resolved via dns
+// and the ones of its pools, together with their health. It starts and stops the health checks of backends as they
+// appear and disappear.
+type backendSet struct {
+	sync.Mutex
+
+	input          *Loadbalancer
+	healthProvider health.HealthCheckProvider
+	tickRate       int
+	healthFeed     chan LBHealthCheckStatus
+
+	static   []Backend
+	pools    []Pool
+	resolved map[string][]Backend
+	healthy  map[string]bool
+	stopChs  map[string]chan struct{}
+	stopped  bool
+}
+
+// newBackendSet creates a backend set for the passed definition and starts the health checks of its configured
+// backends, their updates get sent to healthFeed.
+func newBackendSet(definition loadbalancerDefinition, tickRate int) *backendSet {
+	lb := definition.Loadbalancer
+
+	s := &backendSet{
+		input:          newLoadbalancerForInput(lb),
+		healthProvider: definition.HealthProvider,
+		tickRate:       tickRate,
+		healthFeed:     make(chan LBHealthCheckStatus),
+		static:         make([]Backend, 0, len(lb.Outputs)),
+		pools:          lb.Pools,
+		resolved:       make(map[string][]Backend),
+		healthy:        make(map[string]bool),
+		stopChs:        make(map[string]chan struct{}),
+	}
+
+	for _, output := range lb.Outputs {
+		s.static = append(s.static, Backend{Endpoint: output, Weight: lb.Weight(output)})
+	}
+
+	s.updateHealthChecks()
+
+	return s
+}
+
+// Key returns the key of the loadbalancer the backends belong to.
+func (s *backendSet) Key() string {
+	return s.input.Key()
+}
+
+// healthEndpoint returns the endpoint the health of the backend gets checked on, which is the one the first input
+// port gets mapped to for lbs with multiple ports.
+func (s *backendSet) healthEndpoint(backend Backend) Endpoint {
+	if backend.Endpoint.Port == 0 {
+		return NewEndpoint(backend.Endpoint.IP, s.input.Input.Port)
+	}
+
+	return backend.Endpoint
+}
+
+// backends returns all backends, the same endpoint is only returned once. Configured backends take precedence over
+// resolved ones, resolved ones are ordered by their dns output.
+func (s *backendSet) backends() []Backend {
+	backends := make([]Backend, 0, len(s.static))
+	seen := make(map[string]struct{})
+
+	add := func(backend Backend) {
+		if _, found := seen[backend.Endpoint.String()]; found {
+			return
+		}
+
+		seen[backend.Endpoint.String()] = struct{}{}
+		backends = append(backends, backend)
+	}
+
+	for _, backend := range s.static {
+		add(backend)
+	}
+
+	outputs := make([]string, 0, len(s.resolved))
+	for output := range s.resolved {
+		outputs = append(outputs, output)
+	}
+
+	sort.Strings(outputs)
+
+	for _, output := range outputs {
+		for _, backend := range s.resolved[output] {
+			add(backend)
+		}
+	}
+
+	return backends
+}
+
+// allBackends returns the backends together with the ones of the pools, the same endpoint is only returned once.
+func (s *backendSet) allBackends() []Backend {
+	backends := s.backends()
+
+	for _, pool := range s.pools {
+		for _, output := range pool.Outputs {
+			if !backendsContain(backends, output) {
+				backends = append(backends, Backend{Endpoint: output, Weight: 1})
+			}
+		}
+	}
+
+	return backends
+}
+
+// updateHealthChecks starts the health checks for new backends and stops the ones of removed backends.
+func (s *backendSet) updateHealthChecks() {
+	if s.stopped {
+		return
+	}
+
+	wanted := make(map[string]struct{})
+
+	for _, backend := range s.allBackends() {
+		key := backend.Endpoint.String()
+		wanted[key] = struct{}{}
+
+		if _, found := s.stopChs[key]; found {
+			continue
+		}
+
+		glog.V(2).Infof("starting health check for backend `%s` of lb `%s`", key, s.Key())
+
+		// New backends are considered healthy till the health check says otherwise, same as configured ones
+		s.healthy[key] = true
+		s.stopChs[key] = startHealthCheck(s.Key(), s.healthEndpoint(backend), s.healthProvider, s.tickRate, s.healthFeed)
+	}
+
+	for key, stopCh := range s.stopChs {
+		if _, found := wanted[key]; found {
+			continue
+		}
+
+		glog.V(2).Infof("stopping health check for removed backend `%s` of lb `%s`", key, s.Key())
+
+		close(stopCh)
+		delete(s.stopChs, key)
+		delete(s.healthy, key)
+	}
+}
+
+// SetResolved replaces the backends resolved for the passed dns output.
+func (s *backendSet) SetResolved(output DNSOutput, backends []Backend) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.resolved[output.String()] = backends
+	s.updateHealthChecks()
+}
+
+// SetHealth updates the health of the backend checked on the passed endpoint, it returns false if the endpoint isn't
+// checked (anymore).
+func (s *backendSet) SetHealth(endpoint Endpoint, healthy bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, backend := range s.allBackends() {
+		key := backend.Endpoint.String()
+		if _, found := s.stopChs[key]; found && s.healthEndpoint(backend).Equals(endpoint) {
+			s.healthy[key] = healthy
+			return true
+		}
+	}
+
+	return false
+}
+
+// Loadbalancer returns the loadbalancer with the healthy backends, pools only contain their healthy outputs.
+func (s *backendSet) Loadbalancer() *Loadbalancer {
+	s.Lock()
+	defer s.Unlock()
+
+	healthy := make([]Backend, 0)
+	for _, backend := range s.backends() {
+		if s.healthy[backend.Endpoint.String()] {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	lb := newLoadbalancerForBackends(s.input, healthy)
+
+	for _, pool := range s.pools {
+		healthyPool := Pool{Sources: pool.Sources, Outputs: make([]Endpoint, 0, len(pool.Outputs))}
+		for _, output := range pool.Outputs {
+			if s.healthy[output.String()] {
+				healthyPool.Outputs = append(healthyPool.Outputs, output)
+			}
+		}
+
+		lb.Pools = append(lb.Pools, healthyPool)
+	}
+
+	return lb
+}
+
+// newLoadbalancerForBackends creates a loadbalancer with the input of the passed one and the backends of the lowest
+// priority, so backends with a higher priority act as backups.
+func newLoadbalancerForBackends(input *Loadbalancer, backends []Backend) *Loadbalancer {
+	lb := newLoadbalancerForInput(input)
+	lb.Weights = make(map[string]int)
+
+	priority := 0
+	for _, backend := range backends {
+		if len(lb.Outputs) > 0 && backend.Priority > priority {
+			continue
+		}
+
+		if len(lb.Outputs) == 0 || backend.Priority < priority {
+			priority = backend.Priority
+			lb.Outputs = make([]Endpoint, 0)
+			lb.Weights = make(map[string]int)
+		}
+
+		lb.Outputs = append(lb.Outputs, backend.Endpoint)
+		if backend.Weight > 1 {
+			lb.Weights[backend.Endpoint.String()] = backend.Weight
+		}
+	}
+
+	return lb
+}
+
+// resolveLoadbalancer resolves the dns outputs of the passed definition once and returns the loadbalancer with all
+// backends, for commands which don't run health checks.
+func resolveLoadbalancer(resolver *Resolver, definition loadbalancerDefinition) (*Loadbalancer, error) {
+	lb := definition.Loadbalancer
+	if len(definition.DNSOutputs) == 0 {
+		return lb, nil
+	}
+
+	backends := make([]Backend, 0, len(lb.Outputs))
+	for _, output := range lb.Outputs {
+		backends = append(backends, Backend{Endpoint: output, Weight: lb.Weight(output)})
+	}
+
+	for _, output := range definition.DNSOutputs {
+		resolved, _, err := resolver.Resolve(output)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resolve output `%s` of lb `%s`, see: %v", output.String(), lb.Key(), err)
+		}
+
+		for _, backend := range resolved {
+			if !backendsContain(backends, backend.Endpoint) {
+				backends = append(backends, backend)
+			}
+		}
+	}
+
+	resolved := newLoadbalancerForBackends(lb, backends)
+	resolved.Pools = lb.Pools
+
+	return resolved, nil
+}
+
+func backendsContain(backends []Backend, endpoint Endpoint) bool {
+	for _, backend := range backends {
+		if backend.Endpoint.Equals(endpoint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stop stops all health checks, no new ones get started afterwards.
+func (s *backendSet) Stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stopped = true
+
+	for key, stopCh := range s.stopChs {
+		close(stopCh)
+		delete(s.stopChs, key)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWeightedOutputs(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:80")
+	outputs, err := TryParseEndpoints("10.0.0.1-3:80")
+	assert.NilError(t, err)
+
+	lb := NewLoadbalancer(ProtocolTCP, input, outputs...)
+	assert.DeepEqual(t, lb.weightedOutputs(), outputs)
+
+	// reduced by the gcd
+	lb.Weights = map[string]int{"10.0.0.1:80": 40, "10.0.0.2:80": 20, "10.0.0.3:80": 20}
+	assert.DeepEqual(t, lb.weightedOutputs(), []Endpoint{outputs[0], outputs[0], outputs[1], outputs[2]})
+
+	// scaled down to the max weight, tiny weights keep a single rule
+	lb.Weights = map[string]int{"10.0.0.1:80": 1000, "10.0.0.2:80": 500, "10.0.0.3:80": 1}
+	weighted := lb.weightedOutputs()
+	assert.Equal(t, len(weighted), maxOutputWeight+maxOutputWeight/2+1)
+	assert.Equal(t, endpointsCount(weighted, outputs[2]), 1)
+}
+
+func TestWeightedLoadbalancerIsAdopted(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:80")
+	outputs, err := TryParseEndpoints("10.0.0.1-2:80")
+	assert.NilError(t, err)
+
+	lb := NewLoadbalancer(ProtocolTCP, input, outputs...)
+	lb.Weights = map[string]int{"10.0.0.1:80": 3}
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{RuleComments: true}, nil)
+	assert.NilError(t, err)
+
+	ctrl.UpsertLoadbalancer(lb)
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	chains, err := ipt.ListChains(NATTable)
+	assert.NilError(t, err)
+
+	dnatRules := 0
+	for _, chain := range chains {
+		if _, err := TryParseChainID(chain); err != nil {
+			continue
+		}
+
+		rules, err := ipt.List(NATTable, chain)
+		assert.NilError(t, err)
+		dnatRules += len(rules) - 1
+	}
+
+	assert.Equal(t, dnatRules, 4)
+
+	// a restarted controller adopts the chain instead of creating a new one
+	changesBefore := len(ipt.Changes())
+
+	restarted, err := NewControllerWithIPTables(ipt, ControllerConfig{RuleComments: true}, nil)
+	assert.NilError(t, err)
+
+	restarted.UpsertLoadbalancer(lb)
+	restarted.sync()
+	assert.Equal(t, restarted.syncErrors, 0)
+	assert.Equal(t, len(ipt.Changes()), changesBefore)
+
+	// changing the weights creates a new chain
+	lb.Weights = map[string]int{"10.0.0.2:80": 3}
+	restarted.UpsertLoadbalancer(lb)
+	restarted.sync()
+	assert.Assert(t, len(ipt.Changes()) > changesBefore)
+}
+
+func TestNewLoadbalancerForBackends(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:80")
+	backends := getTestBackends(t)
+
+	lb := newLoadbalancerForBackends(NewLoadbalancer(ProtocolTCP, input), backends)
+	assert.DeepEqual(t, lb.Outputs, []Endpoint{backends[0].Endpoint, backends[1].Endpoint})
+	assert.DeepEqual(t, lb.Weights, map[string]int{backends[0].Endpoint.String(): 3})
+
+	// backups take over once all primary backends are gone
+	lb = newLoadbalancerForBackends(NewLoadbalancer(ProtocolTCP, input), backends[2:])
+	assert.DeepEqual(t, lb.Outputs, []Endpoint{backends[2].Endpoint})
+
+	lb = newLoadbalancerForBackends(NewLoadbalancer(ProtocolTCP, input), nil)
+	assert.Equal(t, len(lb.Outputs), 0)
+}
+
+func TestBackendSet(t *testing.T) {
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:80", "10.0.0.1:80,_http._tcp.api.internal", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+
+	set := newBackendSet(definition, 1)
+	defer set.Stop()
+
+	go (func() {
+		for range set.healthFeed {
+		}
+	})()
+
+	static := definition.Loadbalancer.Outputs[0]
+	assert.DeepEqual(t, set.Loadbalancer().Outputs, []Endpoint{static})
+
+	backends := getTestBackends(t)
+	set.SetResolved(definition.DNSOutputs[0], backends)
+	assert.DeepEqual(t, set.Loadbalancer().Outputs, []Endpoint{static, backends[0].Endpoint, backends[1].Endpoint})
+
+	assert.Assert(t, set.SetHealth(static, false))
+	assert.Assert(t, set.SetHealth(backends[0].Endpoint, false))
+	assert.Assert(t, set.SetHealth(backends[1].Endpoint, false))
+	assert.DeepEqual(t, set.Loadbalancer().Outputs, []Endpoint{backends[2].Endpoint})
+
+	// removed backends stop being monitored
+	set.SetResolved(definition.DNSOutputs[0], backends[:1])
+	assert.Assert(t, !set.SetHealth(backends[2].Endpoint, true))
+	assert.Equal(t, len(set.Loadbalancer().Outputs), 0)
+
+	// addresses appearing again start healthy
+	set.SetResolved(definition.DNSOutputs[0], backends)
+	assert.DeepEqual(t, set.Loadbalancer().Outputs, []Endpoint{backends[1].Endpoint})
+}
+
+func getTestBackends(t *testing.T) []Backend {
+	endpoints, err := TryParseEndpoints("10.0.1.1-3:8080")
+	assert.NilError(t, err)
+
+	return []Backend{
+		{Endpoint: endpoints[0], Weight: 3},
+		{Endpoint: endpoints[1], Weight: 1},
+		{Endpoint: endpoints[2], Weight: 1, Priority: 10},
+	}
+}
+
+func TestBackendSetPools(t *testing.T) {
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:80", "10.0.0.0/8=10.0.2.1-2:80;10.0.0.1:80,10.0.2.1:80", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+
+	set := newBackendSet(definition, 1)
+	defer set.Stop()
+
+	go (func() {
+		for range set.healthFeed {
+		}
+	})()
+
+	pool := definition.Loadbalancer.Pools[0]
+	lb := set.Loadbalancer()
+	assert.Equal(t, len(lb.Pools), 1)
+	assert.DeepEqual(t, lb.Pools[0].Outputs, pool.Outputs)
+
+	// backends shared by a pool and the remaining outputs have a single health check
+	assert.Assert(t, set.SetHealth(pool.Outputs[0], false))
+	assert.Assert(t, set.SetHealth(pool.Outputs[1], false))
+
+	lb = set.Loadbalancer()
+	assert.Equal(t, len(lb.Pools[0].Outputs), 0)
+	assert.DeepEqual(t, lb.Outputs, definition.Loadbalancer.Outputs[:1])
+	assert.DeepEqual(t, lb.Pools[0].Sources, pool.Sources)
+}
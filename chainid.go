@@ -5,6 +5,8 @@ import (
     "encoding/binary"
     "fmt"
     "net"
+
+    "github.com/pierrec/xxHash/xxHash32"
 )
 
 // ChainState represent the state of the current chain
@@ -31,28 +33,175 @@ func (c ChainState) String() string {
 
 const chainIDPrefix = "LB$-"
 
+const (
+    // ChainIDVersion1 is the legacy format containing the IPv4 input of the lb in clear text.
+    ChainIDVersion1 uint8 = 1
+
+    // ChainIDVersion2 is the current format identifying the lb by a hash, see LoadbalancerIDFor.
+    ChainIDVersion2 uint8 = 2
+)
+
+// ChainIDSeed is the seed used for the hashes in ChainIDs.
+const ChainIDSeed = 0xC4A1
+
+// Version 1:
+//
+//   00 01 02 03 04 05 06 07 08 09 10 11 12 13 14 15 16 17 18
+//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//  +CR|PR|     IP    | Port|Generation |St|ContentHash|IN|
+//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//      \__________________/                          |
+//             =CR  <----------------------------------+
+//
+// The instance tag (IN) is only present for chains of named instances, chains of the default instance stay 17 bytes
+// long. Both fit into 28 chars. The generation is a per lb counter assigned by the controller which may wrap around,
+// see GenerationNewer.
+//
+// Version 2:
+//
 //   00 01 02 03 04 05 06 07 08 09 10 11 12 13 14 15 16 17
-//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
-//  +CR|PR|     IP    | Port|Last Update|St|ContentHash|
-//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
-//      \__________________/
-//             =CR
+//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//  +VS|IN|   LB ID   |Generation |ContentHash| Checksum  |
+//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//   \_______________________________________/
+//                  =Checksum
+//
+// VS contains the version in the upper and the state in the lower nibble. Instead of the protocol, IP and port the
+// lb gets identified by a hash of them (see LoadbalancerIDFor), so IPv6 inputs, inputs with multiple ports (see
+// LoadbalancerIDForPorts), wildcard, cidr or interface-bound inputs (see LoadbalancerIDForInput) and lbs with aliases
+// (see LoadbalancerIDForAliases) fit as well. The checksum is a xxHash32 of all other bytes. Since version 1 chains of
+// named instances got 18 bytes as well, names only get parsed as version 2 if version and checksum match.
 
 // ChainID represents the name of a chain which contains the most important data of it
 type ChainID struct {
-    CRC         uint8
-    Protocol    Protocol
-    IP          net.IP
-    Port        uint16
-    LastUpdate  uint32
-    State       ChainState
-    ContentHash uint32
+    Version        uint8
+    LoadbalancerID uint32
+    Generation     uint32
+    State          ChainState
+    ContentHash    uint32
+    InstanceTag    uint8
+
+    // CRC, Protocol, IP and Port are only part of version 1 chains, LoadbalancerID gets derived from them.
+    CRC      uint8
+    Protocol Protocol
+    IP       net.IP
+    Port     uint16
+}
+
+// InstanceTagForName returns the tag identifying chains of the passed instance, 0 for the default (unnamed) instance.
+func InstanceTagForName(instance string) uint8 {
+    if instance == "" {
+        return 0
+    }
+
+    tag := PearsonHash([]byte(instance))
+    if tag == 0 {
+        // 0 is reserved for the default instance
+        tag = 1
+    }
+
+    return tag
+}
+
+// LoadbalancerIDFor returns the hash identifying the chains of the lb with the passed input in the instance.
+func LoadbalancerIDFor(instanceTag uint8, protocol Protocol, ip net.IP, port uint16) uint32 {
+    buf := make([]byte, 20)
+    buf[0] = instanceTag
+    buf[1] = byte(protocol)
+    copy(buf[2:18], ip.To16())
+    binary.BigEndian.PutUint16(buf[18:], port)
+
+    return xxHash32.Checksum(buf, ChainIDSeed)
+}
+
+// LoadbalancerIDForPorts returns the hash identifying the chains of the lb with the passed input covering multiple
+// ports in the instance. Inputs with a single port get the same ID as from LoadbalancerIDFor.
+func LoadbalancerIDForPorts(instanceTag uint8, protocol Protocol, ip net.IP, ports PortSet) uint32 {
+    if ports.Count() <= 1 {
+        return LoadbalancerIDFor(instanceTag, protocol, ip, ports.First())
+    }
+
+    // Every range adds 4 bytes, so the input can't collide with the one of a single port
+    buf := make([]byte, 18, 18+4*len(ports))
+    buf[0] = instanceTag
+    buf[1] = byte(protocol)
+    copy(buf[2:18], ip.To16())
+
+    for _, r := range ports {
+        buf = append(buf, byte(r.First>>8), byte(r.First), byte(r.Last>>8), byte(r.Last))
+    }
+
+    return xxHash32.Checksum(buf, ChainIDSeed)
 }
 
-// NewChainID creates a new chain identification
-func NewChainID(protocol Protocol, ip net.IP, port uint16, lastUpdate uint32, state ChainState, contentHash uint32) ChainID {
+// LoadbalancerIDForInput returns the hash identifying the chains of the lb with the passed input in the instance. The
+// input matches the destination network, all local addresses if it's nil, and is optionally bound to an interface.
+// Inputs of a single ip without interface get the same ID as from LoadbalancerIDForPorts.
+func LoadbalancerIDForInput(instanceTag uint8, protocol Protocol, destination *net.IPNet, ports PortSet, iface string) uint32 {
+    if destination != nil && iface == "" {
+        if ones, bits := destination.Mask.Size(); ones == bits {
+            return LoadbalancerIDForPorts(instanceTag, protocol, destination.IP, ports)
+        }
+    }
+
+    // The prefix length (0xFF for all local addresses) and the interface follow the ports
+    buf := make([]byte, 18, 19+4*len(ports)+len(iface))
+    buf[0] = instanceTag
+    buf[1] = byte(protocol)
+
+    prefix := byte(0xFF)
+    if destination != nil {
+        copy(buf[2:18], destination.IP.To16())
+        ones, _ := destination.Mask.Size()
+        prefix = byte(ones)
+    }
+
+    for _, r := range ports {
+        buf = append(buf, byte(r.First>>8), byte(r.First), byte(r.Last>>8), byte(r.Last))
+    }
+
+    buf = append(buf, prefix)
+    buf = append(buf, iface...)
+
+    return xxHash32.Checksum(buf, ChainIDSeed)
+}
+
+// LoadbalancerIDForAliases returns the hash identifying the chain shared by the inputs with the passed IDs, the first
+// one is the ID of the lb itself, the others the ones of its aliases.
+func LoadbalancerIDForAliases(ids ...uint32) uint32 {
+    buf := make([]byte, 4*len(ids))
+    for i, id := range ids {
+        binary.BigEndian.PutUint32(buf[4*i:], id)
+    }
+
+    return xxHash32.Checksum(buf, ChainIDSeed)
+}
+
+// NewChainID creates a new chain identification for the default instance
+func NewChainID(protocol Protocol, ip net.IP, port uint16, generation uint32, state ChainState, contentHash uint32) ChainID {
+    return NewChainIDForInstance(0, protocol, ip, port, generation, state, contentHash)
+}
+
+// NewChainIDForInstance creates a new (version 2) chain identification for the instance with the passed tag
+func NewChainIDForInstance(instanceTag uint8, protocol Protocol, ip net.IP, port uint16, generation uint32, state ChainState, contentHash uint32) ChainID {
+    return NewChainIDForLoadbalancerID(instanceTag, LoadbalancerIDFor(instanceTag, protocol, ip, port), generation, state, contentHash)
+}
+
+// NewChainIDForLoadbalancerID creates a new (version 2) chain identification for the lb with the passed ID
+func NewChainIDForLoadbalancerID(instanceTag uint8, loadbalancerID uint32, generation uint32, state ChainState, contentHash uint32) ChainID {
     id := ChainID{}
 
+    id.Version = ChainIDVersion2
+    id.LoadbalancerID = loadbalancerID
+    id.Generation = generation
+    id.State = state
+    id.ContentHash = contentHash
+    id.InstanceTag = instanceTag
+
+    return id
+}
+
+func calculateChainIDCRC(protocol Protocol, ip net.IP, port uint16, instanceTag uint8) uint8 {
     crcBuf := make([]byte, 7)
     crcBuf[0] = byte(protocol)
 
@@ -64,21 +213,15 @@ func NewChainID(protocol Protocol, ip net.IP, port uint16, lastUpdate uint32, st
 
     binary.BigEndian.PutUint16(crcBuf[5:], port)
 
-    id.CRC = PearsonHash(crcBuf)
-    id.Protocol = protocol
-    id.IP = ip
-    id.Port = port
-    id.LastUpdate = lastUpdate
-    id.State = state
-    id.ContentHash = contentHash
+    if instanceTag != 0 {
+        crcBuf = append(crcBuf, instanceTag)
+    }
 
-    return id
+    return PearsonHash(crcBuf)
 }
 
-// TryParseChainID tries to parse the passed chainname as ChainID
+// TryParseChainID tries to parse the passed chainname as ChainID of any version
 func TryParseChainID(chain string) (ChainID, error) {
-    id := ChainID{}
-
     nameLength := len(chain)
     if len(chain) != 28 {
         return ChainID{}, fmt.Errorf("chain `%s` has invalid length, got %d expected 28", chain, nameLength)
@@ -93,30 +236,87 @@ func TryParseChainID(chain string) (ChainID, error) {
         return ChainID{}, fmt.Errorf("chain `%s` isn't valid base64", chain)
     }
 
+    if id, ok := tryParseChainIDV2(data); ok {
+        return id, nil
+    }
+
+    return parseChainIDV1(chain, data)
+}
+
+func tryParseChainIDV2(data []byte) (ChainID, bool) {
+    if len(data) != 18 || data[0]>>4 != ChainIDVersion2 {
+        return ChainID{}, false
+    }
+
+    if xxHash32.Checksum(data[:14], ChainIDSeed) != binary.BigEndian.Uint32(data[14:18]) {
+        return ChainID{}, false
+    }
+
+    id := ChainID{}
+    id.Version = ChainIDVersion2
+    id.State = ChainState(data[0] & 0x0F)
+    id.InstanceTag = data[1]
+    id.LoadbalancerID = binary.BigEndian.Uint32(data[2:6])
+    id.Generation = binary.BigEndian.Uint32(data[6:10])
+    id.ContentHash = binary.BigEndian.Uint32(data[10:14])
+
+    return id, true
+}
+
+func parseChainIDV1(chain string, data []byte) (ChainID, error) {
+    id := ChainID{}
+
+    if len(data) != 17 && len(data) != 18 {
+        return ChainID{}, fmt.Errorf("chain `%s` has invalid data length, got %d expected 17 or 18", chain, len(data))
+    }
+
+    id.Version = ChainIDVersion1
     id.CRC = data[0]
     id.Protocol = Protocol(data[1])
     id.IP = net.IPv4(data[2], data[3], data[4], data[5])
     id.Port = binary.BigEndian.Uint16(data[6:8])
-    id.LastUpdate = binary.BigEndian.Uint32(data[8:12])
+    id.Generation = binary.BigEndian.Uint32(data[8:12])
     id.State = ChainState(data[12])
     id.ContentHash = binary.BigEndian.Uint32(data[13:17])
 
-    checksum := PearsonHash(data[1:8])
+    if len(data) == 18 {
+        id.InstanceTag = data[17]
+
+        if id.InstanceTag == 0 {
+            return ChainID{}, fmt.Errorf("chain `%s` has an instance tag of 0 which is reserved for the default instance", chain)
+        }
+    }
+
+    checksum := calculateChainIDCRC(id.Protocol, id.IP, id.Port, id.InstanceTag)
     if checksum != id.CRC {
         return ChainID{}, fmt.Errorf("chain `%s` has invalid CRC, got %d expected %d", chain, id.CRC, checksum)
     }
 
-    return id, nil
-}
+    id.LoadbalancerID = LoadbalancerIDFor(id.InstanceTag, id.Protocol, id.IP, id.Port)
 
-// AsLoadbalancerKey creates a token which can be used to match ChainID to loadbalancers
-func (c ChainID) AsLoadbalancerKey() string {
-    return fmt.Sprintf("%s://%s:%d", c.Protocol.String(), c.IP.String(), c.Port)
+    return id, nil
 }
 
 // String serializes the id to a iptables compatible chain name
 func (c ChainID) String() string {
-    buf := make([]byte, 17)
+    if c.Version == ChainIDVersion1 {
+        return c.stringV1()
+    }
+
+    buf := make([]byte, 18)
+
+    buf[0] = ChainIDVersion2<<4 | byte(c.State)&0x0F
+    buf[1] = c.InstanceTag
+    binary.BigEndian.PutUint32(buf[2:], c.LoadbalancerID)
+    binary.BigEndian.PutUint32(buf[6:], c.Generation)
+    binary.BigEndian.PutUint32(buf[10:], c.ContentHash)
+    binary.BigEndian.PutUint32(buf[14:], xxHash32.Checksum(buf[:14], ChainIDSeed))
+
+    return chainIDPrefix + base64.StdEncoding.EncodeToString(buf)
+}
+
+func (c ChainID) stringV1() string {
+    buf := make([]byte, 17, 18)
 
     buf[0] = c.CRC
     buf[1] = byte(c.Protocol)
@@ -128,10 +328,14 @@ func (c ChainID) String() string {
     buf[5] = ipv4[3]
 
     binary.BigEndian.PutUint16(buf[6:], c.Port)
-    binary.BigEndian.PutUint32(buf[8:], c.LastUpdate)
+    binary.BigEndian.PutUint32(buf[8:], c.Generation)
     buf[12] = byte(c.State)
     binary.BigEndian.PutUint32(buf[13:], c.ContentHash)
 
+    if c.InstanceTag != 0 {
+        buf = append(buf, c.InstanceTag)
+    }
+
     b64 := base64.StdEncoding.EncodeToString(buf)
     chainName := chainIDPrefix + b64
 
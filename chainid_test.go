@@ -12,12 +12,12 @@ func TestChainIDSerializeDeserialize(t *testing.T) {
 	protocol := ProtocolUDP
 	ip := net.IPv4(0xC0, 0xA8, 0x2A, 0x45)
 	port := uint16(1337)
-	lastUpdate := uint32(4294967295)
+	generation := uint32(4294967295)
 	state := ChainCreated
 	contentHash := uint32(42133742)
 
-	inChain := NewChainID(protocol, ip, port, lastUpdate, state, contentHash)
-	expectedName := "LB$-7wLAqCpFBTn/////AQKC6O4="
+	inChain := NewChainID(protocol, ip, port, generation, state, contentHash)
+	expectedName := "LB$-IQBRgUX6/////wKC6O4T22V0"
 	gotName := inChain.String()
 
 	if gotName != expectedName {
@@ -29,6 +29,53 @@ func TestChainIDSerializeDeserialize(t *testing.T) {
 		t.Fatalf("couldn't deserialize chain name, see: %v", err)
 	}
 
+	if c.Version != ChainIDVersion2 {
+		t.Fatalf("version mismatch after serializing, got %d expected %d", c.Version, ChainIDVersion2)
+	}
+
+	if c.LoadbalancerID != LoadbalancerIDFor(0, protocol, ip, port) {
+		t.Fatalf("lb id mismatch after serializing, got %d expected %d", c.LoadbalancerID, LoadbalancerIDFor(0, protocol, ip, port))
+	}
+
+	if c.Generation != generation {
+		t.Fatalf("generation mismatch after serializing, got %d expected %d", c.Generation, generation)
+	}
+
+	if c.State != state {
+		t.Fatalf("state mismatch after serializing, got %s expected %s", c.State.String(), state.String())
+	}
+
+	if c.ContentHash != contentHash {
+		t.Fatalf("content hash mismatch after serializing, got %d expected %d", c.ContentHash, contentHash)
+	}
+}
+
+// TestParseChainIDV1 tests whether chains created by older versions are still understood.
+func TestParseChainIDV1(t *testing.T) {
+	protocol := ProtocolUDP
+	ip := net.IPv4(0xC0, 0xA8, 0x2A, 0x45)
+	port := uint16(1337)
+	generation := uint32(4294967295)
+	state := ChainCreated
+	name := "LB$-7wLAqCpFBTn/////AQKC6O4="
+
+	c, err := TryParseChainID(name)
+	if err != nil {
+		t.Fatalf("couldn't deserialize chain name, see: %v", err)
+	}
+
+	if c.Version != ChainIDVersion1 {
+		t.Fatalf("version mismatch after serializing, got %d expected %d", c.Version, ChainIDVersion1)
+	}
+
+	if c.String() != name {
+		t.Fatalf("chain name mismatch after serializing, got %s expected %s", c.String(), name)
+	}
+
+	if c.LoadbalancerID != NewChainID(protocol, ip, port, generation, state, 0).LoadbalancerID {
+		t.Fatalf("expected v1 chain to belong to the same lb as v2 chains")
+	}
+
 	if c.Protocol != protocol {
 		t.Fatalf("protocol mismatch after serializing, got %s expected %s", c.Protocol.String(), protocol.String())
 	}
@@ -41,8 +88,8 @@ func TestChainIDSerializeDeserialize(t *testing.T) {
 		t.Fatalf("port mismatch after serializing, got %d expected %d", c.Port, port)
 	}
 
-	if c.LastUpdate != lastUpdate {
-		t.Fatalf("lastUpdate mismatch after serializing, got %d expected %d", c.LastUpdate, lastUpdate)
+	if c.Generation != generation {
+		t.Fatalf("generation mismatch after serializing, got %d expected %d", c.Generation, generation)
 	}
 
 	if c.State != state {
@@ -55,26 +102,25 @@ func TestChainIDChecksumMismatch(t *testing.T) {
 	protocol := ProtocolUDP
 	ip := net.IPv4(0xC0, 0xA8, 0x2A, 0x45)
 	port := uint16(1337)
-	lastUpdate := uint32(4294967295)
+	generation := uint32(4294967295)
 	state := ChainCreated
 	contentHash := uint32(42133742)
 
-	c := NewChainID(protocol, ip, port, lastUpdate, state, contentHash)
 	buf := make([]byte, 17)
 
-	ipv4 := c.IP.To4()
+	ipv4 := ip.To4()
 	buf[2] = ipv4[0]
 	buf[3] = ipv4[1]
 	buf[4] = ipv4[2]
 	buf[5] = ipv4[3]
 
-	binary.BigEndian.PutUint16(buf[6:], c.Port)
-	binary.BigEndian.PutUint32(buf[8:], c.LastUpdate)
-	buf[12] = byte(c.State)
-	binary.BigEndian.PutUint32(buf[13:], c.ContentHash)
+	binary.BigEndian.PutUint16(buf[6:], port)
+	binary.BigEndian.PutUint32(buf[8:], generation)
+	buf[12] = byte(state)
+	binary.BigEndian.PutUint32(buf[13:], contentHash)
 
 	buf[0] = 0x42
-	buf[1] = byte(c.Protocol)
+	buf[1] = byte(protocol)
 
 	str := chainIDPrefix + base64.StdEncoding.EncodeToString(buf)
 
@@ -83,3 +129,128 @@ func TestChainIDChecksumMismatch(t *testing.T) {
 		t.Fatalf("Expected checksum mismatch, but got `%s`", err)
 	}
 }
+
+// TestChainIDWithInstanceTag tests whether chains of named instances keep their tag and fit into the name limit.
+func TestChainIDWithInstanceTag(t *testing.T) {
+	tag := InstanceTagForName("blue")
+	ip := net.IPv4(0xC0, 0xA8, 0x2A, 0x45)
+
+	inChain := NewChainIDForInstance(tag, ProtocolTCP, ip, 1337, 4711, ChainCreated, 42133742)
+	name := inChain.String()
+
+	if len(name) != 28 {
+		t.Fatalf("chain name `%s` has invalid length %d", name, len(name))
+	}
+
+	c, err := TryParseChainID(name)
+	if err != nil {
+		t.Fatalf("couldn't deserialize chain name, see: %v", err)
+	}
+
+	if c.InstanceTag != tag {
+		t.Fatalf("instance tag mismatch after serializing, got %d expected %d", c.InstanceTag, tag)
+	}
+
+	if c.String() != name {
+		t.Fatalf("chain name mismatch after serializing, got %s expected %s", c.String(), name)
+	}
+
+	defaultChain := NewChainID(ProtocolTCP, ip, 1337, 4711, ChainCreated, 42133742)
+	if defaultChain.String() == name {
+		t.Fatalf("chains of different instances got the same name `%s`", name)
+	}
+}
+
+// TestChainIDV2ChecksumMismatch checks whether manipulated v2 chain names get rejected
+func TestChainIDV2ChecksumMismatch(t *testing.T) {
+	name := NewChainID(ProtocolTCP, net.IPv4(10, 0, 0, 1), 80, 42, ChainCreated, 4711).String()
+
+	data, _ := base64.StdEncoding.DecodeString(name[len(chainIDPrefix):])
+	data[7]++
+
+	_, err := TryParseChainID(chainIDPrefix + base64.StdEncoding.EncodeToString(data))
+	if err == nil {
+		t.Fatalf("expected manipulated chain name to be invalid")
+	}
+}
+
+// TestChainIDIPv6 tests whether chains for IPv6 inputs fit into the name limit.
+func TestChainIDIPv6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+
+	inChain := NewChainIDForInstance(InstanceTagForName("blue"), ProtocolTCP, ip, 443, 1, ChainCreated, 42133742)
+	name := inChain.String()
+
+	if len(name) != 28 {
+		t.Fatalf("chain name `%s` has invalid length %d", name, len(name))
+	}
+
+	c, err := TryParseChainID(name)
+	if err != nil {
+		t.Fatalf("couldn't deserialize chain name, see: %v", err)
+	}
+
+	if c.String() != name || c.LoadbalancerID != inChain.LoadbalancerID {
+		t.Fatalf("chain mismatch after serializing, got %#v expected %#v", c, inChain)
+	}
+
+	if c.LoadbalancerID == NewChainID(ProtocolTCP, net.ParseIP("2001:db8::2"), 443, 1, ChainCreated, 42133742).LoadbalancerID {
+		t.Fatalf("expected different lbs to get different ids")
+	}
+}
+
+// TestLoadbalancerIDForPorts tests whether inputs with multiple ports get their own ids, while single ports stay
+// compatible.
+func TestLoadbalancerIDForPorts(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 1)
+
+	single := LoadbalancerIDForPorts(0, ProtocolUDP, ip, PortSet{{First: 10000, Last: 10000}})
+	if single != LoadbalancerIDFor(0, ProtocolUDP, ip, 10000) {
+		t.Fatalf("expected single port to get the id of LoadbalancerIDFor")
+	}
+
+	ids := map[uint32]string{single: "10000"}
+	for _, str := range []string{"10000-10100", "10000-10101", "10000,10100", "10000-10001,10100"} {
+		ports, err := TryParsePortSet(str)
+		if err != nil {
+			t.Fatalf("couldn't parse ports `%s`, see: %v", str, err)
+		}
+
+		id := LoadbalancerIDForPorts(0, ProtocolUDP, ip, ports)
+		if other, found := ids[id]; found {
+			t.Fatalf("ports `%s` and `%s` got the same id", str, other)
+		}
+
+		ids[id] = str
+	}
+}
+
+func TestLoadbalancerIDForInput(t *testing.T) {
+	ports := PortSet{{First: 443, Last: 443}}
+
+	plain := LoadbalancerIDForInput(0, ProtocolTCP, hostIPNet(net.IPv4(10, 0, 0, 1)), ports, "")
+	if plain != LoadbalancerIDFor(0, ProtocolTCP, net.IPv4(10, 0, 0, 1), 443) {
+		t.Fatalf("expected plain input to get the id of LoadbalancerIDFor")
+	}
+
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/24")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+
+	ids := map[uint32]string{plain: "10.0.0.1"}
+	inputs := map[string]uint32{
+		"*":                LoadbalancerIDForInput(0, ProtocolTCP, nil, ports, ""),
+		"*%eth1":           LoadbalancerIDForInput(0, ProtocolTCP, nil, ports, "eth1"),
+		"0.0.0.0/0":        LoadbalancerIDForInput(0, ProtocolTCP, all, ports, ""),
+		"10.0.0.0/24":      LoadbalancerIDForInput(0, ProtocolTCP, cidr, ports, ""),
+		"10.0.0.0/24%eth1": LoadbalancerIDForInput(0, ProtocolTCP, cidr, ports, "eth1"),
+		"10.0.0.1%eth1":    LoadbalancerIDForInput(0, ProtocolTCP, hostIPNet(net.IPv4(10, 0, 0, 1)), ports, "eth1"),
+	}
+
+	for str, id := range inputs {
+		if other, found := ids[id]; found {
+			t.Fatalf("inputs `%s` and `%s` got the same id", str, other)
+		}
+
+		ids[id] = str
+	}
+}
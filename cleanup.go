@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/golang/glog"
+)
+
+// Cleanup removes all jumps from the built-in chains to the managed chains, the main, output, forward, input and
+// hairpinning chain as well as all loadbalancer chains of the instance.
+func (c *Controller) Cleanup() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.applyPlanners(c.planCleanup)
+
+	if c.syncErrors > 0 {
+		return fmt.Errorf("%d errors happened while cleaning up, see logs for details", c.syncErrors)
+	}
+
+	return nil
+}
+
+// planCleanup plans the removal of all managed iptables state. Every chain gets unreferenced before it's deleted:
+// first the jumps from the built-in chains, then the main and output chain referencing the loadbalancer chains,
+// afterwards everything else.
+func (c *Controller) planCleanup(actual *actualState, desired *desiredState) []Change {
+	changes := make([]Change, 0)
+
+	for _, jump := range c.getBuiltinJumps() {
+		for _, rule := range actual.rules[jump.Table][jump.Chain] {
+			if rule.Jump != jump.Target {
+				continue
+			}
+
+			changes = append(changes, Change{
+				Type:   ChangeDeleteRule,
+				Table:  jump.Table,
+				Chain:  jump.Chain,
+				Rule:   rule,
+				Reason: "cleanup",
+			})
+		}
+	}
+
+	for _, chain := range []string{c.mainChainName, c.outputChainName} {
+		if actual.hasChain(NATTable, chain) {
+			changes = append(changes, Change{Type: ChangeDeleteChain, Table: NATTable, Chain: chain, Reason: "cleanup"})
+		}
+	}
+
+	for _, chainID := range actual.chainIDs {
+		changes = append(changes, Change{Type: ChangeDeleteChain, Table: NATTable, Chain: chainID.String(), Reason: "cleanup"})
+	}
+
+	if actual.hasChain(NATTable, c.hairpinningChainName) {
+		changes = append(changes, Change{Type: ChangeDeleteChain, Table: NATTable, Chain: c.hairpinningChainName, Reason: "cleanup"})
+	}
+
+	for _, chain := range []string{c.forwardChainName, c.inputChainName} {
+		if actual.hasChain(FilterTable, chain) {
+			changes = append(changes, Change{Type: ChangeDeleteChain, Table: FilterTable, Chain: chain, Reason: "cleanup"})
+		}
+	}
+
+	return changes
+}
+
+// PlanCleanup runs a cleanup on a simulation of the current iptables state and returns all changes it would do.
+func PlanCleanup(ipt IPTables, config ControllerConfig) ([]string, error) {
+	dryRunIPT := NewDryRunIPTables(ipt)
+
+	ctrl, err := NewControllerWithIPTables(dryRunIPT, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctrl.Cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	return dryRunIPT.Changes(), nil
+}
+
+func cleanup(config ControllerConfig, dryRun bool) int {
+	ipt, err := iptables.New()
+	if err != nil {
+		glog.Errorf("couldn't init iptables, see: %v", err)
+		return PlanExitFailed
+	}
+
+	if dryRun {
+		changes, err := PlanCleanup(ipt, config)
+		if err != nil {
+			glog.Errorf("couldn't plan cleanup, see: %v", err)
+			return PlanExitFailed
+		}
+
+		return printChanges(changes)
+	}
+
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	if err != nil {
+		glog.Errorf("couldn't init controller, see: %v", err)
+		return PlanExitFailed
+	}
+
+	err = ctrl.Cleanup()
+	if err != nil {
+		glog.Errorf("%v", err)
+		return PlanExitFailed
+	}
+
+	return PlanExitUpToDate
+}
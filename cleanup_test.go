@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCleanupRemovesAllManagedState(t *testing.T) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+
+	ipt := NewDryRunIPTables(nil)
+	for _, builtin := range []struct{ table, chain string }{
+		{FilterTable, "FORWARD"},
+		{NATTable, "PREROUTING"},
+		{NATTable, "OUTPUT"},
+		{NATTable, "POSTROUTING"},
+	} {
+		assert.NilError(t, ipt.NewChain(builtin.table, builtin.chain))
+		assert.NilError(t, ipt.Append(builtin.table, builtin.chain, "-j", "ACCEPT"))
+	}
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{
+		HairpinningCIDR: "42.42.42.0/24",
+		LocalTraffic:    true,
+		InstallJumps:    true,
+	}, nil)
+	assert.NilError(t, err)
+
+	other, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "other"}, nil)
+	assert.NilError(t, err)
+
+	lb1 := NewLoadbalancer(ProtocolTCP, input1, output1)
+	ctrl.loadbalancers[lb1.Key()] = *lb1
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	lb2 := NewLoadbalancer(ProtocolTCP, input2, output1)
+	other.loadbalancers[lb2.Key()] = *lb2
+	other.sync()
+	assert.Equal(t, other.syncErrors, 0)
+
+	natChainsBefore, _ := ipt.ListChains(NATTable)
+	assert.Equal(t, len(ctrl.findChainIDs(natChainsBefore)), 1)
+
+	assert.NilError(t, ctrl.Cleanup())
+
+	natChains, err := ipt.ListChains(NATTable)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, natChains, []string{"PREROUTING", "OUTPUT", "POSTROUTING", other.mainChainName, natChainsBefore[len(natChainsBefore)-1]})
+
+	filterChains, err := ipt.ListChains(FilterTable)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, filterChains, []string{"FORWARD", other.forwardChainName})
+
+	for _, builtin := range []struct{ table, chain string }{
+		{FilterTable, "FORWARD"},
+		{NATTable, "PREROUTING"},
+		{NATTable, "OUTPUT"},
+		{NATTable, "POSTROUTING"},
+	} {
+		rules, err := ipt.List(builtin.table, builtin.chain)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, rules, []string{"-N " + builtin.chain, "-A " + builtin.chain + " -j ACCEPT"})
+	}
+
+	// Nothing left to do
+	assert.NilError(t, ctrl.Cleanup())
+}
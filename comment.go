@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pierrec/xxHash/xxHash32"
+)
+
+// ruleCommentPrefix starts the comments of all rules created by the controller.
+const ruleCommentPrefix = "iptableslb"
+
+// maxRuleCommentLength is the maximum length of a comment accepted by the iptables comment match.
+const maxRuleCommentLength = 255
+
+// RuleComment contains the metadata attached to rules via `-m comment --comment`, so they can be identified when
+// inspecting iptables, e.g. "iptableslb lb=tcp://10.0.0.1:80 backend=10.1.0.1:8080 gen=3 instance=blue". Loadbalancers
+// which would exceed the length limit of comments, e.g. with lots of ports, get identified by a hash like "lb=#1a2b3c4d".
+type RuleComment struct {
+	Loadbalancer string
+	Backend      string
+	Generation   uint32
+	Instance     string
+}
+
+func (c RuleComment) String() string {
+	str := c.format()
+	if len(str) <= maxRuleCommentLength {
+		return str
+	}
+
+	c.Loadbalancer = fmt.Sprintf("#%08x", xxHash32.Checksum([]byte(c.Loadbalancer), ChainIDSeed))
+
+	return c.format()
+}
+
+func (c RuleComment) format() string {
+	parts := []string{ruleCommentPrefix}
+
+	if c.Loadbalancer != "" {
+		parts = append(parts, "lb="+c.Loadbalancer)
+	}
+
+	if c.Backend != "" {
+		parts = append(parts, "backend="+c.Backend)
+	}
+
+	if c.Generation != 0 {
+		parts = append(parts, "gen="+strconv.FormatUint(uint64(c.Generation), 10))
+	}
+
+	if c.Instance != "" {
+		parts = append(parts, "instance="+c.Instance)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// TryParseRuleComment tries to parse the comment of a rule created by the controller.
+func TryParseRuleComment(str string) (RuleComment, error) {
+	parts := strings.Split(str, " ")
+	if parts[0] != ruleCommentPrefix {
+		return RuleComment{}, fmt.Errorf("comment `%s` doesn't start with `%s`", str, ruleCommentPrefix)
+	}
+
+	c := RuleComment{}
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return RuleComment{}, fmt.Errorf("invalid part `%s` in comment `%s`, expected key=value", part, str)
+		}
+
+		switch kv[0] {
+		case "lb":
+			c.Loadbalancer = kv[1]
+		case "backend":
+			c.Backend = kv[1]
+		case "gen":
+			generation, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return RuleComment{}, fmt.Errorf("invalid generation `%s` in comment `%s`, see: %v", kv[1], str, err)
+			}
+
+			c.Generation = uint32(generation)
+		case "instance":
+			c.Instance = kv[1]
+		default:
+			return RuleComment{}, fmt.Errorf("unknown key `%s` in comment `%s`", kv[0], str)
+		}
+	}
+
+	return c, nil
+}
+
+// ruleComment returns the comment for rules with the passed metadata or an empty string if comments are disabled.
+func (c *Controller) ruleComment(comment RuleComment) string {
+	if !c.ruleComments {
+		return ""
+	}
+
+	comment.Instance = c.instance
+
+	return comment.String()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRuleCommentRoundTrip(t *testing.T) {
+	for str, expected := range map[string]RuleComment{
+		"iptableslb": RuleComment{},
+		"iptableslb lb=tcp://10.50.1.1:1234 backend=10.100.0.1:1001 gen=3 instance=blue": RuleComment{
+			Loadbalancer: "tcp://10.50.1.1:1234",
+			Backend:      "10.100.0.1:1001",
+			Generation:   3,
+			Instance:     "blue",
+		},
+		"iptableslb backend=10.100.0.1:1001": RuleComment{Backend: "10.100.0.1:1001"},
+	} {
+		comment, err := TryParseRuleComment(str)
+		assert.NilError(t, err)
+		assert.Equal(t, comment, expected)
+		assert.Equal(t, comment.String(), str)
+	}
+
+	for _, str := range []string{"", "drop all", "iptableslb gen=x", "iptableslb foo=bar", "iptableslb lb="} {
+		_, err := TryParseRuleComment(str)
+		assert.Assert(t, err != nil, "expected error for `%s`", str)
+	}
+}
+
+func TestLongRuleCommentsGetShortened(t *testing.T) {
+	ports := make([]string, 0)
+	for port := 10000; port < 10014; port += 2 {
+		ports = append(ports, fmt.Sprintf("%d-%d", port, port+1))
+	}
+
+	inputs := make([]string, 0)
+	for i := 1; i <= 8; i++ {
+		inputs = append(inputs, fmt.Sprintf("tcp://10.50.%d.1%%eth%d:%s", i, i, strings.Join(ports, ",")))
+	}
+
+	definition, err := parseLoadbalancerDefinition(strings.Join(inputs, ","), "10.100.0.1", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Assert(t, len(definition.Loadbalancer.Key()) > maxRuleCommentLength)
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{RuleComments: true, Instance: "blue"}, nil)
+	assert.NilError(t, err)
+
+	lb := definition.Loadbalancer
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	// only the primary input identifies the lb
+	rules, err := ipt.List(NATTable, ctrl.mainChainName)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rules), 9)
+
+	for _, rawRule := range rules[1:] {
+		rule, err := TryParseRule(rawRule)
+		assert.NilError(t, err)
+
+		comment, err := TryParseRuleComment(rule.Comment)
+		assert.NilError(t, err)
+		assert.Equal(t, comment.Loadbalancer, lb.inputKey())
+	}
+
+	// lbs exceeding the limit anyway get a hash
+	long := RuleComment{Loadbalancer: lb.Key(), Backend: "10.100.0.1:80", Generation: 3, Instance: "blue"}
+	str := long.String()
+	assert.Assert(t, len(str) <= maxRuleCommentLength, "comment `%s` is too long", str)
+
+	comment, err := TryParseRuleComment(str)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(comment.Loadbalancer, "#"))
+	assert.Equal(t, comment.Backend, "10.100.0.1:80")
+	assert.Equal(t, str, long.String())
+}
+
+func TestAllManagedRulesGetComments(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{RuleComments: true, Instance: "blue", HairpinningCIDR: "42.42.42.0/24"})
+
+	chains := map[string][]string{
+		NATTable:    {ctrl.mainChainName, ctrl.hairpinningChainName},
+		FilterTable: {ctrl.forwardChainName},
+	}
+
+	actual, err := ctrl.readActualState()
+	assert.NilError(t, err)
+
+	for _, chainID := range actual.chainIDs {
+		chains[NATTable] = append(chains[NATTable], chainID.String())
+	}
+
+	for table, names := range chains {
+		for _, chain := range names {
+			rules, err := ipt.List(table, chain)
+			assert.NilError(t, err)
+			assert.Assert(t, len(rules) > 1, "chain `%s` is empty", chain)
+
+			for _, rawRule := range rules[1:] {
+				rule, err := TryParseRule(rawRule)
+				assert.NilError(t, err)
+
+				comment, err := TryParseRuleComment(rule.Comment)
+				assert.NilError(t, err, "rule `%s` in chain `%s`", rawRule, chain)
+				assert.Equal(t, comment.Instance, "blue")
+
+				if rule.ToDestination != nil {
+					assert.Equal(t, comment.Backend, rule.ToDestination.String())
+					assert.Assert(t, strings.HasPrefix(comment.Loadbalancer, "tcp://10.50."))
+					assert.Assert(t, comment.Generation != 0)
+				}
+			}
+		}
+	}
+
+	// nothing changes on the next sync
+	changesBefore := len(ipt.Changes())
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+	assert.Equal(t, len(ipt.Changes()), changesBefore)
+}
+
+func TestRulesWithoutCommentsGetReplaced(t *testing.T) {
+	ipt, legacy := setupDriftTest(t, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"})
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{RuleComments: true, HairpinningCIDR: "42.42.42.0/24"}, nil)
+	assert.NilError(t, err)
+	ctrl.loadbalancers = legacy.loadbalancers
+	for key, lb := range ctrl.loadbalancers {
+		lb.MarkUpdated()
+		ctrl.loadbalancers[key] = lb
+	}
+
+	ctrl.sync()
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	for table, chain := range map[string]string{NATTable: ctrl.mainChainName, FilterTable: ctrl.forwardChainName} {
+		rules, err := ipt.List(table, chain)
+		assert.NilError(t, err)
+		assert.Equal(t, len(rules), map[string]int{NATTable: 3, FilterTable: 5}[table])
+
+		for _, rawRule := range rules[1:] {
+			assert.Assert(t, strings.Contains(rawRule, "iptableslb"), "rule `%s` in chain `%s` has no comment", rawRule, chain)
+		}
+	}
+
+	// the uncommented lb chains got replaced as well
+	actual, err := ctrl.readActualState()
+	assert.NilError(t, err)
+	assert.Equal(t, len(actual.chainIDs), 2)
+
+	changesBefore := len(ipt.Changes())
+	ctrl.sync()
+	assert.Equal(t, len(ipt.Changes()), changesBefore)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Config files contain one loadbalancer per line in the notation of the `-in`, `-out` and `-h` flags, e.g.
+//
+//	tcp://192.168.0.1:80 192.168.1.1:80,192.168.1.2:80 http
+//
+// Empty lines and lines starting with # are ignored.
+
+// readConfigFile appends the loadbalancers defined in the passed file to the flags.
+func readConfigFile(path string, inFlags *sliceFlags, outFlags *sliceFlags, healthFlags *sliceFlags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't open config `%s`, see: %v", path, err)
+	}
+	defer f.Close()
+
+	err = readConfig(f, inFlags, outFlags, healthFlags)
+	if err != nil {
+		return fmt.Errorf("couldn't read config `%s`, see: %v", path, err)
+	}
+
+	return nil
+}
+
+func readConfig(r io.Reader, inFlags *sliceFlags, outFlags *sliceFlags, healthFlags *sliceFlags) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("expected `<in> <outs> <health>` in line %d but got `%s`", lineNumber, line)
+		}
+
+		*inFlags = append(*inFlags, fields[0])
+		*outFlags = append(*outFlags, fields[1])
+		*healthFlags = append(*healthFlags, fields[2])
+	}
+
+	return scanner.Err()
+}
+
+// formatConfigLine returns the config line for the passed loadbalancer.
+func formatConfigLine(lb *Loadbalancer, health string) string {
+	outputs := make([]string, 0, len(lb.Outputs))
+	for _, output := range lb.Outputs {
+		outputs = append(outputs, lb.OutputString(output))
+	}
+
+	pools := make([]string, 0, len(lb.Pools)+1)
+	for _, pool := range lb.Pools {
+		pools = append(pools, pool.String(lb))
+	}
+
+	pools = append(pools, strings.Join(outputs, ","))
+
+	return fmt.Sprintf("%s %s %s", lb.InputString(), strings.Join(pools, ";"), health)
+}
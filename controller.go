@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,67 +24,279 @@ const NATTable = "nat"
 // FilterTable represents the filter-table in iptables
 const FilterTable = "filter"
 
+// DefaultResyncInterval is the default interval in which the controller reconciles iptables without any changes.
+const DefaultResyncInterval = 30 * time.Second
+
+// DefaultSyncDebounce is the default time the controller waits after a change before syncing.
+const DefaultSyncDebounce = 100 * time.Millisecond
+
+// DefaultRejectMark is the default packet mark bit used for traffic rejected by the source filters of the lbs.
+const DefaultRejectMark = 0x20000
+
+// MaxChainNameLength is the maximum length of a chain name accepted by iptables.
+const MaxChainNameLength = 28
+
+var instanceNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// instanceChainRegexp matches the managed chains of named instances, see ControllerConfig.chainName.
+var instanceChainRegexp = regexp.MustCompile("^iptableslb-([a-zA-Z0-9_.-]+)-(prerouting|forward|hairpinning|output|input)$")
+
+// ControllerConfig contains the configuration of a Controller.
+type ControllerConfig struct {
+	// ResyncInterval is the interval in which iptables gets reconciled even if no loadbalancer changed, so manual
+	// modifications get repaired. Defaults to DefaultResyncInterval.
+	ResyncInterval time.Duration
+
+	// SyncDebounce is the time waited after a loadbalancer changed before syncing, so bursts of changes get applied
+	// at once. Defaults to DefaultSyncDebounce.
+	SyncDebounce time.Duration
+
+	// HairpinningCIDR is the nat internal CIDR, if empty no hairpinning will be set up.
+	HairpinningCIDR string
+
+	// Instance namespaces all chains managed by the controller, so multiple controllers can run on the same host
+	// without touching each others chains. Empty means default instance.
+	Instance string
+
+	// MainChainName, ForwardChainName, HairpinningChainName, OutputChainName and InputChainName override the chain
+	// names derived from the instance.
+	MainChainName        string
+	ForwardChainName     string
+	HairpinningChainName string
+	OutputChainName      string
+	InputChainName       string
+
+	// LocalTraffic enables the nat output chain, so processes on the loadbalancer host itself can reach the VIPs.
+	LocalTraffic bool
+
+	// InstallJumps enables the installation of the jumps from the built-in FORWARD, PREROUTING, OUTPUT, POSTROUTING
+	// and INPUT chains to the managed ones. Missing jumps get added again on every sync.
+	InstallJumps bool
+
+	// JumpPosition is the position the jumps get inserted at, defaults to appending.
+	JumpPosition JumpPosition
+
+	// RuleComments enables `-m comment` metadata (lb, backend, generation and instance) on all rules in the managed
+	// chains.
+	RuleComments bool
+
+	// RejectMark is the packet mark bit set on traffic rejected by the source filters of the lbs, which gets dropped
+	// in the forward and input chain. Defaults to DefaultRejectMark.
+	RejectMark uint32
+
+	// RemoveUnknownRules enables the removal of rules in the managed chains which weren't created by the controller.
+	// They get reported in any case.
+	RemoveUnknownRules bool
+
+	// CleanupOnExit removes all managed chains and jumps to them when the controller gets stopped.
+	CleanupOnExit bool
+}
+
+// chainName returns the override if set, otherwise the name for the chain with the passed suffix in the instance.
+func (c ControllerConfig) chainName(override string, suffix string) string {
+	if override != "" {
+		return override
+	}
+
+	if c.Instance == "" {
+		return "iptableslb-" + suffix
+	}
+
+	return "iptableslb-" + c.Instance + "-" + suffix
+}
+
+func (c ControllerConfig) validate() error {
+	if c.Instance != "" && !instanceNameRegexp.MatchString(c.Instance) {
+		return fmt.Errorf("invalid instance name `%s`, only letters, digits, `_`, `.` and `-` are allowed", c.Instance)
+	}
+
+	if c.HairpinningCIDR != "" {
+		cidr, err := parseIPNet(c.HairpinningCIDR)
+		if err != nil || cidr.IP.To4() == nil {
+			return fmt.Errorf("invalid hairpinning cidr `%s`, expected an ipv4 cidr like `10.0.0.0/24`", c.HairpinningCIDR)
+		}
+	}
+
+	chains := []string{
+		c.chainName(c.MainChainName, "prerouting"),
+		c.chainName(c.ForwardChainName, "forward"),
+		c.chainName(c.HairpinningChainName, "hairpinning"),
+		c.chainName(c.OutputChainName, "output"),
+		c.chainName(c.InputChainName, "input"),
+	}
+
+	for _, chain := range chains {
+		if len(chain) > MaxChainNameLength {
+			return fmt.Errorf("chain name `%s` is too long, got %d chars but iptables only allows %d, use a shorter instance name", chain, len(chain), MaxChainNameLength)
+		}
+
+		if strings.HasPrefix(chain, chainIDPrefix) {
+			return fmt.Errorf("chain name `%s` mustn't start with `%s` since it's reserved for loadbalancer chains", chain, chainIDPrefix)
+		}
+	}
+
+	return nil
+}
+
 // Controller is a controller which monitors iptables and loadbalancers and updates iptables accordingly.
 type Controller struct {
 	sync.Mutex
 	loadbalancers        map[string]Loadbalancer
 	started              bool
 	stopCh               chan struct{}
-	ipt                  *iptables.IPTables
+	syncRequestCh        chan struct{}
+	ipt                  IPTables
 	mainChainName        string
 	forwardChainName     string
 	hairpinningChainName string
+	outputChainName      string
+	inputChainName       string
 	hairpinningCIDR      string
-	tickRate             int
+	localTraffic         bool
+	installJumps         bool
+	jumpPosition         JumpPosition
+	cleanupOnExit        bool
+	removeUnknownRules   bool
+	ruleComments         bool
+	rejectMark           uint32
+	instance             string
+	instanceTag          uint8
+	resyncInterval       time.Duration
+	syncDebounce         time.Duration
 	metrics              *Metrics
+	syncErrors           int
+
+	// rejectedPackets contains the rejected packets already counted in the metrics per lb chain
+	rejectedPackets map[string]uint64
 }
 
 // NewController creates a new Controller instance.
-func NewController(tickRate int, metrics *Metrics, hairpinningCIDR string) (*Controller, error) {
+func NewController(config ControllerConfig, metrics *Metrics) (*Controller, error) {
 	ipt, err := iptables.New()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't init iptables, see: %v", err)
 	}
 
-	return &Controller{
+	return NewControllerWithIPTables(ipt, config, metrics)
+}
+
+// NewControllerWithIPTables creates a new Controller instance working on the passed iptables implementation.
+func NewControllerWithIPTables(ipt IPTables, config ControllerConfig, metrics *Metrics) (*Controller, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid controller config, see: %v", err)
+	}
+
+	if config.ResyncInterval <= 0 {
+		config.ResyncInterval = DefaultResyncInterval
+	}
+
+	if config.SyncDebounce <= 0 {
+		config.SyncDebounce = DefaultSyncDebounce
+	}
+
+	if config.RejectMark == 0 {
+		config.RejectMark = DefaultRejectMark
+	}
+
+	c := &Controller{
 		loadbalancers:        make(map[string]Loadbalancer),
 		ipt:                  ipt,
 		stopCh:               make(chan struct{}),
-		mainChainName:        "iptableslb-prerouting",
-		forwardChainName:     "iptableslb-forward",
-		hairpinningChainName: "iptableslb-hairpinning",
-		hairpinningCIDR:      hairpinningCIDR,
-		tickRate:             tickRate,
+		syncRequestCh:        make(chan struct{}, 1),
+		mainChainName:        config.chainName(config.MainChainName, "prerouting"),
+		forwardChainName:     config.chainName(config.ForwardChainName, "forward"),
+		hairpinningChainName: config.chainName(config.HairpinningChainName, "hairpinning"),
+		outputChainName:      config.chainName(config.OutputChainName, "output"),
+		inputChainName:       config.chainName(config.InputChainName, "input"),
+		hairpinningCIDR:      config.HairpinningCIDR,
+		localTraffic:         config.LocalTraffic,
+		installJumps:         config.InstallJumps,
+		jumpPosition:         config.JumpPosition,
+		cleanupOnExit:        config.CleanupOnExit,
+		removeUnknownRules:   config.RemoveUnknownRules,
+		ruleComments:         config.RuleComments,
+		rejectMark:           config.RejectMark,
+		instance:             config.Instance,
+		instanceTag:          InstanceTagForName(config.Instance),
+		resyncInterval:       config.ResyncInterval,
+		syncDebounce:         config.SyncDebounce,
 		metrics:              metrics,
-	}, nil
+		rejectedPackets:      make(map[string]uint64),
+	}
+
+	for _, table := range []string{NATTable, FilterTable} {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list all chains in %s table, see: %v", table, err)
+		}
+
+		err = c.checkInstanceTag(chains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
 }
 
-// UpsertLoadbalancer inserts or updates the passed loadbalancer in the controller.
+// UpsertLoadbalancer inserts or updates the passed loadbalancer in the controller. Loadbalancers of both TCP and UDP
+// get programmed as one lb per protocol.
 func (c *Controller) UpsertLoadbalancer(lb *Loadbalancer) {
 	c.Lock()
 	defer c.Unlock()
 
-	if len(lb.Outputs) == 0 {
-		// empty loadbalancer? kill it!
-		delete(c.loadbalancers, lb.Key())
-		return
-	}
+	defer c.requestSync()
 
-	lbCopy := *lb
-	lbCopy.MarkUpdated()
+	for _, lb := range lb.PerProtocol() {
+		if !lb.hasOutputs() {
+			// empty loadbalancer? kill it!
+			delete(c.loadbalancers, lb.Key())
+			continue
+		}
+
+		lbCopy := *lb
+		lbCopy.Outputs = append([]Endpoint{}, lb.Outputs...)
+		lbCopy.Pools = make([]Pool, 0, len(lb.Pools))
+		for _, pool := range lb.Pools {
+			pool.Outputs = append([]Endpoint{}, pool.Outputs...)
+			lbCopy.Pools = append(lbCopy.Pools, pool)
+		}
 
-	c.loadbalancers[lb.Key()] = lbCopy
+		lbCopy.Weights = make(map[string]int, len(lb.Weights))
+		for output, weight := range lb.Weights {
+			lbCopy.Weights[output] = weight
+		}
+
+		lbCopy.MarkUpdated()
+
+		c.loadbalancers[lb.Key()] = lbCopy
+	}
 }
 
 // DeleteLoadbalancer removes the passed loadbalancer from the controller.
 func (c *Controller) DeleteLoadbalancer(lb *Loadbalancer) {
 	c.Lock()
 	defer c.Unlock()
+	defer c.requestSync()
 
-	delete(c.loadbalancers, lb.Key())
+	for _, lb := range lb.PerProtocol() {
+		delete(c.loadbalancers, lb.Key())
+	}
+}
+
+// requestSync schedules a sync of the controller, it never blocks. Multiple requests till the sync starts are
+// merged into one.
+func (c *Controller) requestSync() {
+	select {
+	case c.syncRequestCh <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Controller) countError() {
+	c.syncErrors++
+
 	if c.metrics != nil {
 		c.metrics.ErrorsTotal.Inc()
 	}
@@ -98,6 +310,13 @@ func (c *Controller) Stop() {
 	for c.started {
 		time.Sleep(1 * time.Second)
 	}
+
+	if c.cleanupOnExit {
+		err := c.Cleanup()
+		if err != nil {
+			glog.Errorf("couldn't clean up iptables, see: %v", err)
+		}
+	}
 }
 
 // Run starts the controller main loop. Calling it doesn't block!
@@ -108,14 +327,19 @@ func (c *Controller) Run() {
 
 	c.started = true
 
+	// Sync right away instead of waiting for the first change or resync
+	c.requestSync()
+
 	go (func() {
 		glog.Infof("Controller started.")
 
-		mainLoopStopCh := c.loop("MainLoop", time.Duration(c.tickRate)*time.Second, c.sync)
+		resyncLoopStopCh := c.loop("ResyncLoop", c.resyncInterval, c.sync)
+		eventLoopStopCh := c.debouncedLoop("EventLoop", c.syncRequestCh, c.syncDebounce, c.sync)
 
 		<-c.stopCh
 
-		close(mainLoopStopCh)
+		close(resyncLoopStopCh)
+		close(eventLoopStopCh)
 		c.started = false
 
 		glog.Infof("Controller stopped.")
@@ -130,14 +354,7 @@ func (c *Controller) loop(name string, waitTime time.Duration, cb func()) chan s
 		for {
 			select {
 			case <-timer.C:
-				startTime := time.Now()
-				glog.V(4).Infof("started syncing %s", name)
-
-				cb()
-
-				neededTime := time.Since(startTime)
-				glog.V(4).Infof("finished syncing %s in %s", name, neededTime.String())
-
+				c.timed(name, cb)
 				timer.Reset(waitTime)
 
 			case <-stopCh:
@@ -153,595 +370,368 @@ func (c *Controller) loop(name string, waitTime time.Duration, cb func()) chan s
 	return stopCh
 }
 
-// Task represents a task which should be executed in an isolated environment (as in: always fresh args, no side-effects)
-type Task func(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID)
+// debouncedLoop calls cb after something got received on triggerCh. Everything received within the debounce time
+// after the first trigger is merged into the same call.
+func (c *Controller) debouncedLoop(name string, triggerCh chan struct{}, debounce time.Duration, cb func()) chan struct{} {
+	stopCh := make(chan struct{})
 
-func (c *Controller) sync() {
-	c.Lock()
-	defer c.Unlock()
+	go (func() {
+		for {
+			select {
+			case <-triggerCh:
+			case <-stopCh:
+				return
+			}
 
-	tasks := []Task{
-		c.deleteChainsStuckInCreation,
-		c.refreshLoadbalancersWithBrokenChains,
-		c.ensureForwardChainExists,
-		c.ensureForwardChainEntries,
-		c.ensureMainChainExists,
-		c.ensureChains,
-		c.ensureHairpinningChainExists,
-		c.ensureMainChainEntries,
-		c.ensureHairpinningChainEntries,
-		c.deleteObsoleteMainChainEntries,
-		c.deleteObsoleteChains,
-		c.deleteObsoleteForwardChainEntries,
-		c.deleteObsoleteHairpinningChainEntries,
-	}
+			timer := time.NewTimer(debounce)
 
-	// Always get data from iptables to avoid running into mismatches between our state and iptables state
-	for _, t := range tasks {
-		taskName := runtime.FuncForPC(reflect.ValueOf(t).Pointer()).Name()
+			select {
+			case <-timer.C:
+			case <-stopCh:
+				timer.Stop()
+				return
+			}
 
-		glog.V(5).Infof("starting %s", taskName)
+			// discard triggers received while debouncing, they're covered by this run
+			select {
+			case <-triggerCh:
+			default:
+			}
 
-		allChains, err := c.ipt.ListChains(NATTable)
-		if err != nil {
-			c.countError()
-			glog.Errorf("couldn't list all chains in nat table, see: %v", err)
-			continue
+			c.timed(name, cb)
 		}
+	})()
 
-		chainIDs := c.findChainIDs(allChains)
-		lbToChains := c.mapLoadbalancerKeyToChainIDs(chainIDs)
-
-		t(allChains, chainIDs, lbToChains)
-
-		glog.V(5).Infof("finished %s", taskName)
-	}
-
-	if c.metrics != nil {
-		c.updateLBMetrics()
-	}
+	return stopCh
 }
 
-func (c *Controller) updateLBMetrics() {
-	c.metrics.LBHealthy.Set(float64(len(c.loadbalancers)))
+func (c *Controller) timed(name string, cb func()) {
+	startTime := time.Now()
+	glog.V(4).Infof("started syncing %s", name)
 
-	for key, lb := range c.loadbalancers {
-		c.metrics.LBHealthyEndpoints.WithLabelValues(key).Set(float64(len(lb.Outputs)))
-	}
-}
+	cb()
 
-func (c *Controller) refreshLoadbalancersWithBrokenChains(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// Check all loadbalancer chains, calculate hash, compare with chainname
-	// IF mismatch: Set lbs LastUpdate to now, so it will be recreated on the next cycle
+	neededTime := time.Since(startTime)
+	glog.V(4).Infof("finished syncing %s in %s", name, neededTime.String())
+}
 
-	for lbKey, chains := range lbToChains {
-		lb, found := c.loadbalancers[lbKey]
-		if !found {
-			glog.V(5).Infof("skipping validating content hashes for chains from lb `%s` since it's deleted anyways", lbKey)
-			continue
-		}
+// Planner plans changes needed to get from the actual to the desired state. It must not have any side-effects on
+// iptables, all modifications have to be returned as changes.
+type Planner func(actual *actualState, desired *desiredState) []Change
 
-		for _, chain := range chains {
-			rules, err := c.ipt.List(NATTable, chain.String())
-			if err != nil {
-				glog.Errorf("couldn't retrieve rules in chain `%s`, see: %v", chain.String(), err)
-				c.countError()
-				continue
-			}
+func (c *Controller) sync() {
+	c.Lock()
+	defer c.Unlock()
 
-			hash := c.calculateHashForRules(rules)
+	// Chains have to exist before rules can reference them and new rules have to be in place before old ones get
+	// removed, so every phase gets planned on its own. Drift gets repaired last, once all rules are in place.
+	c.applyPlanners(c.planChains, c.planAdditions, c.planDeletions, c.planDrift)
 
-			if hash != chain.ContentHash {
-				glog.Warningf("chain `%s` for lb `%s` got manipulated, content hash isn't matching anymore, marking lb as updated so it gets recreated.", chain.String(), lbKey)
-				lb.MarkUpdated()
-				c.loadbalancers[lbKey] = lb
-			}
-		}
+	if c.metrics != nil {
+		c.updateLBMetrics()
+		c.updateRejectedMetrics()
 	}
 }
 
-func (c *Controller) ensureChains(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// For every loadbalancer, check if a corresponding chain exists, if not, create
-	for lbKey, chains := range lbToChains {
-		lb, found := c.loadbalancers[lbKey]
-		if !found {
-			glog.V(4).Infof("skipping ensuring chains for lb `%s` since it's in iptables but not our configuration.", lbKey)
-			continue
-		}
+// applyPlanners plans and applies the changes of the passed planners one after another, errors get counted in
+// syncErrors. The caller has to hold the lock.
+func (c *Controller) applyPlanners(planners ...Planner) {
+	c.syncErrors = 0
 
-		existingChainName := ""
-		for _, chain := range chains {
-			if chain.State == ChainCreated && chain.LastUpdate == lb.LastUpdate {
-				existingChainName = chain.String()
-			}
-		}
+	for _, planner := range planners {
+		plannerName := runtime.FuncForPC(reflect.ValueOf(planner).Pointer()).Name()
 
-		if existingChainName != "" {
-			glog.V(5).Infof("skipping ensure chain for lb `%s` since chain `%s` already exists", lbKey, existingChainName)
-			continue
-		}
+		glog.V(5).Infof("starting %s", plannerName)
 
-		_, err := c.createChainForLB(&lb)
+		// Always get data from iptables to avoid running into mismatches between our state and iptables state
+		actual, err := c.readActualState()
 		if err != nil {
-			glog.Errorf("couldn't create chain for lb `%s`, see: %v", lbKey, err)
 			c.countError()
+			glog.Errorf("couldn't read iptables state, see: %v", err)
+			break
 		}
-	}
-}
-
-func (c *Controller) getChainIDsWithState(chainIDs []ChainID, state ChainState) []ChainID {
-	filteredChainIDs := make([]ChainID, 0)
-
-	for _, chainID := range chainIDs {
-		if chainID.State == state {
-			filteredChainIDs = append(filteredChainIDs, chainID)
-		}
-	}
 
-	return filteredChainIDs
-}
+		desired := c.desiredState()
 
-func (c *Controller) getLatestChainID(chainIDs []ChainID) ChainID {
-	var latest ChainID
+		// Positions of later changes got planned for the chain as it was before a failed change, they'd hit other rules
+		failedChains := make(map[string]struct{})
 
-	for _, chainID := range chainIDs {
-		if chainID.LastUpdate > latest.LastUpdate {
-			latest = chainID
-		}
-	}
-
-	return latest
-}
-
-func (c *Controller) ensureHairpinningChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	if c.hairpinningCIDR == "" {
-		glog.V(5).Infof("skipping ensuring hairpinning chain entries since no cidr is configured")
-		return
-	}
-
-	rules, err := c.ipt.List(NATTable, c.hairpinningChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in hairpinningChain `%s`, see: %v", c.hairpinningChainName, err)
-		return
-	}
-
-	for lbKey, lb := range c.loadbalancers {
-		for _, ep := range lb.Outputs {
-			wantedRule := c.getHairpinningRuleForEndpoint(ep, lb.Protocol)
-
-			if c.rulesContainRule(rules, wantedRule) {
-				glog.V(5).Infof("skipping creation of hairpinning chain entry for ep `%s` of lb `%s` since it already exists", ep.String(), lbKey)
+		for _, change := range planner(actual, desired) {
+			chainKey := change.Table + "/" + change.Chain
+			if _, failed := failedChains[chainKey]; failed && change.Position > 0 {
+				glog.Warningf("skipping to %s since a previous change of the chain failed, it gets planned again on the next sync", change.String())
 				continue
 			}
 
-			err = c.ipt.Append(NATTable, c.hairpinningChainName, strings.Split(wantedRule, " ")...)
+			err = c.applyChange(change)
 			if err != nil {
-				glog.Errorf("couldn't create hairpinning chain entry for lb `%s` to endpoint `%s`, see: %v", lbKey, ep.String(), err)
+				glog.Errorf("couldn't %s, see: %v", change.String(), err)
 				c.countError()
+				failedChains[chainKey] = struct{}{}
 				continue
 			}
 
-			glog.Infof("added hairpinning chain entry for lb `%s` to endpoint `%s`", lbKey, ep.String())
+			glog.Infof("applied: %s", change.String())
+
+			if change.Drift && c.metrics != nil {
+				c.metrics.DriftRepairsTotal.WithLabelValues(change.Table, change.Chain).Inc()
+			}
 		}
-	}
-}
 
-func (c *Controller) deleteObsoleteHairpinningChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	if c.hairpinningCIDR == "" {
-		glog.V(5).Infof("skipping deletion of obsolete hairpinning chain entries since no cidr is configured")
-		return
+		glog.V(5).Infof("finished %s", plannerName)
 	}
+}
 
-	rules, err := c.ipt.List(NATTable, c.hairpinningChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in hairpinningChain `%s`, see: %v", c.hairpinningChainName, err)
-		return
-	}
+func (c *Controller) updateLBMetrics() {
+	c.metrics.LBHealthy.Set(float64(len(c.loadbalancers)))
 
-	wantedRules := make([]string, 0)
+	for key, lb := range c.loadbalancers {
+		c.metrics.LBHealthyEndpoints.WithLabelValues(key).Set(float64(len(lb.Outputs)))
 
-	for _, lb := range c.loadbalancers {
-		for _, ep := range lb.Outputs {
-			wantedRule := c.getHairpinningRuleForEndpoint(ep, lb.Protocol)
-			wantedRules = append(wantedRules, wantedRule)
+		for _, pool := range lb.Pools {
+			c.metrics.LBPoolHealthyEndpoints.WithLabelValues(key, formatIPNets(pool.Sources)).Set(float64(len(pool.Outputs)))
 		}
 	}
+}
 
-	for _, rule := range rules {
-		rule = c.stripNARules(rule)
-
-		if rule == "" {
-			// e.g. -N or -A rule
-			continue
-		}
-
-		if c.rulesContainRule(wantedRules, rule) {
-			glog.V(5).Infof("Not deleting hairpinning rule `%s` since it's a wanted rule", rule)
-			continue
-		}
-
-		err := c.ipt.Delete(NATTable, c.hairpinningChainName, strings.Split(rule, " ")...)
-		if err != nil {
-			glog.Errorf("couldn't delete obsolete hairpinning rule `%s`, see: %v", rule, err)
-		} else {
-			glog.Infof("deleted obsolete hairpinning rule `%s`", rule)
-		}
+// updateRejectedMetrics adds the packets rejected by the source filters of the lbs since the last sync to the
+// metrics. The counters of iptables start at 0 for every new chain of a lb, so the packets already counted are tracked
+// per chain.
+func (c *Controller) updateRejectedMetrics() {
+	if !c.hasSourceFilters() {
+		return
 	}
-}
 
-func (c *Controller) ensureMainChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// For every chain, check if a corresponding entry in the main chain exists, if not, create
-	rules, err := c.ipt.List(NATTable, c.mainChainName)
+	actual, err := c.readActualState()
 	if err != nil {
-		glog.Errorf("couldn't retrieve rules in mainChain `%s`, see: %v", c.mainChainName, err)
+		glog.Errorf("couldn't read iptables state for rejected packets, see: %v", err)
 		return
 	}
 
-	for lbKey, chains := range lbToChains {
-		_, found := c.loadbalancers[lbKey]
-		if !found {
-			glog.V(4).Infof("skipping ensuring mainChain entries for lb `%s` since it's in iptables but not our configuration.", lbKey)
+	rejectedPackets := make(map[string]uint64)
+
+	for key, lb := range c.loadbalancers {
+		if !lb.hasSourceFilters() {
 			continue
 		}
 
-		createdChains := c.getChainIDsWithState(chains, ChainCreated)
+		createdChains := actual.chainIDsForLoadbalancer(lb.ID(c.instanceTag), ChainCreated)
 		if len(createdChains) == 0 {
-			glog.V(4).Infof("skipping mainChainEntries for lb `%s` since no chains have been created for it yet", lbKey)
 			continue
 		}
 
-		latest := c.getLatestChainID(createdChains)
-		rule := c.getRuleStringForMainChainEntryToChain(latest)
-
-		if c.rulesContainRule(rules, rule) {
-			glog.V(5).Infof("skipping mainChainEntries for lb `%s` since newest chain `%s` already exists", lbKey, latest.String())
-			continue
-		}
+		chain := c.getActiveChainID(lb, createdChains).String()
 
-		err = c.ipt.Append(NATTable, c.mainChainName, strings.Split(rule, " ")...)
+		counters, err := c.listCounters(NATTable, chain)
 		if err != nil {
-			glog.Errorf("couldn't create mainChain entry for lb `%s` to chain `%s`, see: %v", lbKey, latest.String(), err)
-			c.countError()
+			glog.Errorf("couldn't read rejected packets of lb `%s`, see: %v", key, err)
 			continue
 		}
 
-		glog.Infof("added mainChain entry for lb `%s` to chain `%s`", lbKey, latest.String())
-	}
-}
-
-func (c *Controller) rulesContainRule(rules []string, rule string) bool {
-	splittedRule := strings.Split(rule, " ")
-	tuples := make([]string, 0)
-
-	for i := 0; i < len(splittedRule); i++ {
-		if i%2 == 1 {
-			tuple := splittedRule[i-1] + " " + splittedRule[i]
-			tuples = append(tuples, tuple)
+		// The last source filter rule returns the rejected packets
+		i := len(c.getSourceFilterRules(&lb)) - 1
+		if i >= len(counters) {
+			continue
 		}
-	}
 
-	for _, r := range rules {
-		if c.allStringsInString(tuples, r) {
-			return true
+		packets := counters[i][0]
+		if packets > c.rejectedPackets[chain] {
+			c.metrics.RejectedPacketsTotal.WithLabelValues(key).Add(float64(packets - c.rejectedPackets[chain]))
 		}
-	}
 
-	return false
-}
-
-func (c *Controller) allStringsInString(all []string, str string) bool {
-	for _, s := range all {
-		if strings.Index(str, s) < 0 {
-			return false
-		}
+		rejectedPackets[chain] = packets
 	}
 
-	return true
+	c.rejectedPackets = rejectedPackets
 }
 
-func (c *Controller) deleteObsoleteChains(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// Remove all chains which ain't referenced in mainchain
-	rules, err := c.ipt.List(NATTable, c.mainChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in mainChain `%s`, see: %v", c.mainChainName, err)
-		c.countError()
-		return
+func (c *Controller) getLatestChainID(chainIDs []ChainID) ChainID {
+	if len(chainIDs) == 0 {
+		return ChainID{}
 	}
 
-	referencedChains := make([]ChainID, 0)
-	for _, rule := range rules {
-		if rule == "-N "+c.mainChainName {
-			continue
-		}
-
-		chainID, err := c.getChainIDForMainChainRule(rule)
-		if err != nil {
-			glog.Errorf("couldn't get chainid for mainchain rule `%s`, see: %v", rule, err)
-			c.countError()
-			continue
-		}
-
-		referencedChains = append(referencedChains, chainID)
-	}
+	latest := chainIDs[0]
 
 	for _, chainID := range chainIDs {
-		if !c.chainIDsContainID(referencedChains, chainID) {
-			err = c.deleteChain(chainID)
-			if err != nil {
-				glog.Errorf("couldn't delete obsolete chain `%s` for lb `%s`, see: %v", chainID.String(), chainID.AsLoadbalancerKey(), err)
-				c.countError()
-				continue
-			}
-
-			glog.Infof("Removed chain `%s` for deleted lb `%s`", chainID.String(), chainID.AsLoadbalancerKey())
+		if GenerationNewer(chainID.Generation, latest.Generation) {
+			latest = chainID
 		}
 	}
+
+	return latest
 }
 
-func (c *Controller) chainIDsContainID(ids []ChainID, id ChainID) bool {
-	for _, i := range ids {
-		if i.String() == id.String() {
-			return true
+// getActiveChainID returns the chain matching the Generation of the passed lb or the latest one if there is none.
+func (c *Controller) getActiveChainID(lb Loadbalancer, chainIDs []ChainID) ChainID {
+	for _, chainID := range chainIDs {
+		if chainID.Generation == lb.Generation {
+			return chainID
 		}
 	}
 
-	return false
+	return c.getLatestChainID(chainIDs)
 }
 
-func (c *Controller) deleteObsoleteMainChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// Map loadbalancer to chain, delete all rules except the latest
-	// in case lb isn't in config at all, remove it
-	rules, err := c.ipt.List(NATTable, c.mainChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in mainChain `%s`, see: %v", c.mainChainName, err)
-		c.countError()
-		return
-	}
-
-	lbToChains = make(map[string][]ChainID)
+func (c *Controller) stripNARules(rule string) string {
+	newRule := ""
+	rules := strings.Split(rule, " ")
+	skipArg := false
 
 	for _, rule := range rules {
-		if rule == "-N "+c.mainChainName {
-			continue
-		}
-
-		chainID, err := c.getChainIDForMainChainRule(rule)
-		if err != nil {
-			glog.Errorf("couldn't get chainid for mainchain rule `%s`, see: %v", rule, err)
-			c.countError()
-			continue
-		}
-
-		key := chainID.AsLoadbalancerKey()
-		lbToChains[key] = append(lbToChains[key], chainID)
-	}
-
-	for lbKey, chains := range lbToChains {
-		// LB got deleted from config, but is still in iptables -> delete it from iptables
-		if _, exists := c.loadbalancers[lbKey]; !exists {
-			for _, chain := range chains {
-				err = c.removeMainChainEntryToChain(chain)
-				if err != nil {
-					glog.Errorf("couldn't remove main chain entry referencing chain `%s` for deleted lb `%s`, see: %v", chain.String(), lbKey, err)
-					c.countError()
-					continue
-				}
-
-				glog.Infof("Removed main chain entry referencing chain `%s` for deleted lb `%s`", chain.String(), lbKey)
-			}
-
+		if rule == "-A" || rule == "-N" {
+			skipArg = true
 			continue
 		}
 
-		// If there's only one chain reference, we dont have to delete shit
-		if len(chains) == 1 {
+		if skipArg {
+			skipArg = false
 			continue
 		}
 
-		// Multiple chains? Let's see which one is the newest and kick out all others
-		newestChain := chains[0]
-		for _, chain := range chains {
-			if chain.LastUpdate > newestChain.LastUpdate {
-				newestChain = chain
-			}
-		}
-
-		for _, chain := range chains {
-			if chain.String() != newestChain.String() {
-				err = c.removeMainChainEntryToChain(chain)
-				if err != nil {
-					glog.Errorf("couldn't remove outdated main chain entry referencing chain `%s` for lb `%s`, see: %v", chain.String(), lbKey, err)
-					c.countError()
-					continue
-				}
-
-				glog.Infof("Removed outdated main chain entry referencing chain `%s` for lb `%s`", chain.String(), lbKey)
-			}
+		if newRule != "" {
+			newRule = newRule + " " + rule
+		} else {
+			newRule = rule
 		}
 	}
-}
 
-func (c *Controller) getChainIDForMainChainRule(rule string) (ChainID, error) {
-	start := strings.Index(rule, " -j")
-	if start < 0 {
-		return ChainID{}, fmt.Errorf("couldn't find jump target in rule `%s`", rule)
-	}
+	return newRule
+}
 
-	offs := 4
-	if len(rule) <= start+offs {
-		return ChainID{}, fmt.Errorf("whooops, we failed hard trying to parse the rules in the main chain, couldnt parse `%s`", rule)
-	}
+func (c *Controller) calculateHashForRules(rules []string) uint32 {
+	x := xxHash32.New(ContentHashSeed)
 
-	substr := rule[start+offs:]
-	ws := strings.Index(substr, " ")
-	if ws < 0 {
-		ws = len(substr)
+	for _, rule := range rules {
+		// So, since -A and -N contain the chain name and the chainname contains the hash we'll simply skip these
+		x.Write([]byte(c.stripNARules(rule)))
 	}
 
-	substr = substr[:ws]
-
-	return TryParseChainID(substr)
+	return x.Sum32()
 }
 
-func (c *Controller) getDestinationFromRule(rule string) (Endpoint, error) {
-	args := strings.Split(rule, " ")
+func (c *Controller) getLoadbalancerChainRules(lb *Loadbalancer) []Rule {
+	rules := c.getSourceFilterRules(lb)
 
-	for i := 0; i < len(args); i++ {
-		if args[i] == "--to-destination" && len(args) > i+1 {
-			endpoint, err := TryParseEndpoint(args[i+1])
-			if err != nil {
-				return Endpoint{}, fmt.Errorf("couldn't parse endpoint from --to-destination arg, see: %v", err)
-			}
-
-			return endpoint, nil
+	// The pools get the traffic of their sources in their order, before the outputs for all sources
+	for _, pool := range lb.Pools {
+		for _, source := range pool.Sources {
+			rules = append(rules, c.getCascadeRules(lb.poolLoadbalancer(pool), source)...)
 		}
 	}
 
-	return Endpoint{}, fmt.Errorf("couldn't find --to-destination arg in rule `%s`", rule)
+	return append(rules, c.getCascadeRules(lb, nil)...)
 }
 
-func (c *Controller) getDestinationFromForwardRule(rule string) (Endpoint, error) {
-	args := strings.Split(rule, " ")
+// getCascadeRules returns the DNAT rules distributing the traffic of the passed source (nil for all sources) over the
+// outputs of the lb.
+func (c *Controller) getCascadeRules(lb *Loadbalancer, source *net.IPNet) []Rule {
+	outputs := lb.weightedOutputs()
+	rules := make([]Rule, 0, len(outputs))
 
-	sIP := ""
-	dIP := ""
-	sPort := 0
-	dPort := 0
-	var err error
-
-	for i := 0; i < len(args); i++ {
-		if len(args) <= i+1 {
-			break
-		}
+	// Outputs 3 - 1 need statistic magic to match only every nth conn, the final output always matches everything
+	// not matched yet. Weighted outputs are repeated, so they get their share of the cascade.
+	for i := len(outputs); i > 0; i-- {
+		output := outputs[i-1]
 
-		nextArg := args[i+1]
+		rule := lb.chainRule()
+		rule.Source = source
+		rule.Comment = c.ruleComment(RuleComment{Loadbalancer: lb.inputKey(), Backend: lb.OutputString(output), Generation: lb.Generation})
+		rule.Jump = "DNAT"
+		rule.ToDestination = &output
 
-		if args[i] == "-s" {
-			sIP = nextArg
+		// Mapped port ranges get shifted relative to the first input port
+		if ports := lb.OutputPorts(output); output.Port != 0 && ports != nil {
+			rule.ToPorts = PortRange{First: ports.First(), Last: ports.Last()}
+			rule.ToBasePort = lb.Ports().First()
 		}
 
-		if args[i] == "-d" {
-			dIP = nextArg
+		if i > 1 {
+			rule.Nth = i
 		}
 
-		if args[i] == "--sport" {
-			sPort, err = strconv.Atoi(nextArg)
-			if err != nil {
-				return Endpoint{}, fmt.Errorf("couldn't atoi sPort in rule `%s`, see: %v", rule, err)
-			}
-		}
-
-		if args[i] == "--dport" {
-			dPort, err = strconv.Atoi(nextArg)
-			if err != nil {
-				return Endpoint{}, fmt.Errorf("couldn't atoi dPort in rule `%s`, see: %v", rule, err)
-			}
-		}
+		rules = append(rules, rule)
 	}
 
-	getEndpoint := func(ip string, port int) Endpoint {
-		if idx := strings.LastIndex(ip, "/"); idx >= 0 {
-			ip = ip[:idx]
-		}
-
-		return Endpoint{IP: net.ParseIP(ip).To4(), Port: uint16(port)}
-	}
+	return rules
+}
 
-	if sIP != "" && dIP != "" {
-		return Endpoint{}, fmt.Errorf("broken rule `%s` got source and dest ip", rule)
-	} else if sPort != 0 && dPort != 0 {
-		return Endpoint{}, fmt.Errorf("broken rule `%s` got source and dest port", rule)
-	} else if sIP != "" && sPort != 0 {
-		return getEndpoint(sIP, sPort), nil
-	} else if dIP != "" && dPort != 0 {
-		return getEndpoint(dIP, dPort), nil
+// getSourceFilterRules returns the rules at the top of the chain of the lb, which mark the traffic of sources that
+// aren't allowed and return it before it gets DNATed. It gets dropped by the forward chain then, see getRejectRule.
+// The counter of the last rule is the number of rejected packets.
+func (c *Controller) getSourceFilterRules(lb *Loadbalancer) []Rule {
+	if !lb.hasSourceFilters() {
+		return make([]Rule, 0)
 	}
 
-	return Endpoint{}, fmt.Errorf("unknown rule `%s` doesnt have source ip + source port or dest ip + dest port", rule)
-}
+	comment := c.ruleComment(RuleComment{Loadbalancer: lb.inputKey(), Generation: lb.Generation})
+	rejected := &Mark{Value: c.rejectMark, Mask: c.rejectMark}
+	accepted := &Mark{Value: 0, Mask: c.rejectMark}
 
-func (c *Controller) stripNARules(rule string) string {
-	newRule := ""
-	rules := strings.Split(rule, " ")
-	skipArg := false
+	// The mark might have been set by someone else, so it gets initialized in any case
+	initial := accepted
+	if len(lb.AllowSources) > 0 {
+		initial = rejected
+	}
 
-	for _, rule := range rules {
-		if rule == "-A" || rule == "-N" {
-			skipArg = true
-			continue
-		}
+	rules := []Rule{{Comment: comment, Jump: "MARK", SetMark: initial}}
 
-		if skipArg {
-			skipArg = false
-			continue
-		}
+	for _, source := range lb.AllowSources {
+		rules = append(rules, Rule{Source: source, Comment: comment, Jump: "MARK", SetMark: accepted})
+	}
 
-		if newRule != "" {
-			newRule = newRule + " " + rule
-		} else {
-			newRule = rule
-		}
+	for _, source := range lb.DenySources {
+		rules = append(rules, Rule{Source: source, Comment: comment, Jump: "MARK", SetMark: rejected})
 	}
 
-	return newRule
+	return append(rules, Rule{Mark: rejected, Comment: comment, Jump: "RETURN"})
 }
 
-func (c *Controller) calculateHashForRules(rules []string) uint32 {
-	x := xxHash32.New(ContentHashSeed)
+// getRejectRule returns the rule of the forward chain dropping the traffic rejected by the source filters of the lbs.
+func (c *Controller) getRejectRule() Rule {
+	return Rule{
+		Mark:    &Mark{Value: c.rejectMark, Mask: c.rejectMark},
+		Comment: c.ruleComment(RuleComment{}),
+		Jump:    "DROP",
+	}
+}
 
-	for _, rule := range rules {
-		// So, since -A and -N contain the chain name and the chainname contains the hash we'll simply skip these
-		x.Write([]byte(c.stripNARules(rule)))
+// hasSourceFilters checks whether any configured lb rejects the traffic of some sources.
+func (c *Controller) hasSourceFilters() bool {
+	for _, lb := range c.loadbalancers {
+		if lb.hasSourceFilters() {
+			return true
+		}
 	}
 
-	return x.Sum32()
+	return false
 }
 
 func (c *Controller) createChainForLB(lb *Loadbalancer) (ChainID, error) {
-	lenOutputs := len(lb.Outputs)
-	if lenOutputs == 0 {
+	if !lb.hasOutputs() {
 		return ChainID{}, fmt.Errorf("zero outputs defined for lb `%s`, dunno what to do here, not creating chain", lb.Key())
 	}
 
-	chain := lb.GetChainID(ChainCreating, 0)
+	chain := lb.GetChainID(c.instanceTag, ChainCreating, 0)
 	err := c.ipt.NewChain(NATTable, chain.String())
 	if err != nil {
 		return ChainID{}, fmt.Errorf("couldn't create chain `%s` for lb `%s`, see: %v", chain.String(), lb.Key(), err)
 	}
 
-	glog.Infof("created chain `%s` for lb `%s`", chain.String(), lb.Key())
-	rules := make([]string, 0)
-
-	// Outputs 3 - 1 need statistic magic to match only every nth conn
-	for i := lenOutputs; i > 1; i-- {
-		output := lb.Outputs[i-1]
-
-		rule := fmt.Sprintf("-p %s -d %s --dport %d -m statistic --mode nth --every %d --packet 0 -j DNAT --to-destination %s", lb.Protocol.String(), lb.Input.IP.String(), lb.Input.Port, i, output.String())
-		err = c.ipt.Append(NATTable, chain.String(), strings.Split(rule, " ")...)
+	for _, rule := range c.getLoadbalancerChainRules(lb) {
+		err = c.ipt.Append(NATTable, chain.String(), rule.Args()...)
 		if err != nil {
-			return ChainID{}, fmt.Errorf("couldn't create rule `%s` in chain `%s` for output `%s` lb `%s`, see: %v", rule, chain.String(), output.String(), lb.Key(), err)
+			return ChainID{}, fmt.Errorf("couldn't create rule `%s` in chain `%s` for lb `%s`, see: %v", rule.String(), chain.String(), lb.Key(), err)
 		}
-
-		rules = append(rules, rule)
 	}
 
-	// Final output always matches everything not matched yet.
-	rule := fmt.Sprintf("-p %s -d %s --dport %d -j DNAT --to-destination %s", lb.Protocol.String(), lb.Input.IP.String(), lb.Input.Port, lb.Outputs[0].String())
-	err = c.ipt.Append(NATTable, chain.String(), strings.Split(rule, " ")...)
-	if err != nil {
-		return ChainID{}, fmt.Errorf("couldn't create rule `%s` in chain `%s` for output `%s` lb `%s`, see: %v", rule, chain.String(), lb.Outputs[0].String(), lb.Key(), err)
-	}
-
-	rules = append(rules, rule)
-
 	// Get rules from remote for hashing, since iptables adds some kungfu, changes arg order, etc.
-	rules, err = c.ipt.List(NATTable, chain.String())
+	rules, err := c.ipt.List(NATTable, chain.String())
 	if err != nil {
 		return ChainID{}, fmt.Errorf("couldn't retrieve rules in chain `%s`, see: %v", chain.String(), err)
 
 	}
 
-	newChainID := lb.GetChainID(ChainCreated, c.calculateHashForRules(rules))
+	newChainID := lb.GetChainID(c.instanceTag, ChainCreated, c.calculateHashForRules(rules))
 
 	err = c.ipt.RenameChain(NATTable, chain.String(), newChainID.String())
 	if err != nil {
@@ -751,44 +741,53 @@ func (c *Controller) createChainForLB(lb *Loadbalancer) (ChainID, error) {
 	return newChainID, nil
 }
 
-func (c *Controller) getHairpinningRuleForEndpoint(ep Endpoint, prot Protocol) string {
-	return fmt.Sprintf("-p %s -m %s -s %s -d %s/32 --dport %d -j MASQUERADE", prot.String(), prot.String(), c.hairpinningCIDR, ep.IP.String(), ep.Port)
-}
+// getHairpinningRuleForEndpoint returns the hairpinning rule of the endpoint, for outputs of lbs with multiple ports
+// the ports get passed as well.
+func (c *Controller) getHairpinningRuleForEndpoint(ep Endpoint, ports PortSet, prot Protocol) (Rule, error) {
+	source, err := parseIPNet(c.hairpinningCIDR)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid hairpinning cidr `%s`, see: %v", c.hairpinningCIDR, err)
+	}
 
-func (c *Controller) getRuleStringForMainChainEntryToChain(chain ChainID) string {
-	return fmt.Sprintf("-p %s -d %s --dport %d -j %s", chain.Protocol.String(), chain.IP.String(), chain.Port, chain.String())
-}
+	rule := Rule{
+		Protocol:        prot,
+		Source:          source,
+		Destination:     hostIPNet(ep.IP),
+		DestinationPort: ep.Port,
+		Comment:         c.ruleComment(RuleComment{Backend: ep.String()}),
+		Jump:            "MASQUERADE",
+	}
 
-func (c *Controller) removeMainChainEntryToChain(chain ChainID) error {
-	rule := c.getRuleStringForMainChainEntryToChain(chain)
-	err := c.ipt.Delete(NATTable, c.mainChainName, strings.Split(rule, " ")...)
-	if err != nil {
-		// FIXME:  ignore "rule not exists" errors
-		return fmt.Errorf("couldn't remove rule `%s` for lb `%s` from main chain, see: %v", rule, chain.AsLoadbalancerKey(), err)
+	if ports != nil {
+		rule.setDestinationPorts(ports)
 	}
 
-	return nil
+	return rule, nil
 }
 
-func (c *Controller) mapLoadbalancerKeyToChainIDs(chainIDs []ChainID) map[string][]ChainID {
-	lbToChain := make(map[string][]ChainID)
-
-	// Gather lbs in iptables
-	for _, chainID := range chainIDs {
-		key := chainID.AsLoadbalancerKey()
-		lbToChain[key] = append(lbToChain[key], chainID)
+// getDispatchChains returns the nat chains which dispatch traffic to the loadbalancer chains, which is the main chain
+// and the output chain if local traffic is enabled.
+func (c *Controller) getDispatchChains() []string {
+	if c.localTraffic {
+		return []string{c.mainChainName, c.outputChainName}
 	}
 
-	// Gather lbs in config
-	for _, lb := range c.loadbalancers {
-		key := lb.Key()
+	return []string{c.mainChainName}
+}
 
-		if _, existing := lbToChain[key]; !existing {
-			lbToChain[key] = make([]ChainID, 0)
-		}
+// getMainChainRulesToChain returns the rules jumping into the chain of the lb, one for its input and one per alias.
+func (c *Controller) getMainChainRulesToChain(lb Loadbalancer, chain ChainID) []Rule {
+	rules := make([]Rule, 0, 1+len(lb.Aliases))
+
+	for _, input := range lb.inputs() {
+		rule := input.inputRule()
+		rule.Comment = c.ruleComment(RuleComment{Loadbalancer: lb.inputKey(), Generation: chain.Generation})
+		rule.Jump = chain.String()
+
+		rules = append(rules, rule)
 	}
 
-	return lbToChain
+	return rules
 }
 
 func (c *Controller) findChainIDs(chains []string) []ChainID {
@@ -801,236 +800,80 @@ func (c *Controller) findChainIDs(chains []string) []ChainID {
 			continue
 		}
 
+		if chainID.InstanceTag != c.instanceTag {
+			glog.V(6).Infof("skipping chain `%s` since it belongs to another instance", chain)
+			continue
+		}
+
 		chainIDs = append(chainIDs, chainID)
 	}
 
 	return chainIDs
 }
 
-func (c *Controller) deleteChain(chainID ChainID) error {
-	chainName := chainID.String()
-
-	err := c.ipt.ClearChain(NATTable, chainName)
-	if err != nil {
-		return fmt.Errorf("couldn't flush chain `%s` (%s), see: %v", chainName, chainID.AsLoadbalancerKey(), err)
-	}
-
-	err = c.ipt.DeleteChain(NATTable, chainName)
-	if err != nil {
-		return fmt.Errorf("couldn't delete chain `%s` (%s), see: %v", chainName, chainID.AsLoadbalancerKey(), err)
+// checkInstanceTag fails if one of the passed chains is a managed chain of another instance with the same instance
+// tag, the instances would take the loadbalancer chains of each other for their own.
+func (c *Controller) checkInstanceTag(chains []string) error {
+	if c.instance == "" {
+		return nil
 	}
 
-	return nil
-}
-
-func (c *Controller) deleteChainsStuckInCreation(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	for _, chainID := range chainIDs {
-		if chainID.State == ChainCreating {
-			glog.Warningf("chain `%s` (%s) stuck in creation, deleting it...", chainID.String(), chainID.AsLoadbalancerKey())
-
-			err := c.deleteChain(chainID)
-			if err != nil {
-				glog.Errorf("couldn't cleanup chain stuck in creation, see: %v", err)
-				c.countError()
-			}
+	for _, chain := range chains {
+		match := instanceChainRegexp.FindStringSubmatch(chain)
+		if match == nil || match[1] == c.instance || InstanceTagForName(match[1]) != c.instanceTag {
+			continue
 		}
-	}
-}
 
-func (c *Controller) ensureMainChainExists(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	found := false
-	for _, chain := range allChains {
-		if chain == c.mainChainName {
-			found = true
-			glog.V(4).Infof("skipping creation of mainchain since it already exists")
-			return
-		}
+		return fmt.Errorf("chain `%s` of instance `%s` has the same instance tag %d as instance `%s`, their loadbalancer chains can't be told apart, use another instance name", chain, match[1], c.instanceTag, c.instance)
 	}
 
-	if !found {
-		glog.V(4).Infof("creating mainchain...")
-		err := c.ipt.NewChain(NATTable, c.mainChainName)
-		if err != nil {
-			glog.Errorf("couldn't create mainchain, see: %v", err)
-			c.countError()
-			return
-		}
-		glog.V(4).Infof("created mainchain")
-	}
+	return nil
 }
 
-func (c *Controller) ensureHairpinningChainExists(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	if c.hairpinningCIDR == "" {
-		glog.V(5).Infof("skipping ensuring hairpinning chain since no cidr is configured")
-		return
-	}
-
-	allChains, err := c.ipt.ListChains(NATTable)
+func (c *Controller) deleteChain(table string, chain string) error {
+	err := c.ipt.ClearChain(table, chain)
 	if err != nil {
-		glog.Errorf("couldn't list all chains in nat table, see: %v", err)
-		c.countError()
-		return
-	}
-
-	found := false
-	for _, chain := range allChains {
-		if chain == c.hairpinningChainName {
-			found = true
-			glog.V(4).Infof("skipping creation of hairpinning chain since it already exists")
-			return
-		}
+		return fmt.Errorf("couldn't flush chain `%s`, see: %v", chain, err)
 	}
 
-	if !found {
-		glog.V(4).Infof("creating hairpinning chain...")
-		err := c.ipt.NewChain(NATTable, c.hairpinningChainName)
-		if err != nil {
-			glog.Errorf("couldn't create hairpinning chain, see: %v", err)
-			c.countError()
-			return
-		}
-		glog.V(4).Infof("created hairpinning chain")
-	}
-}
-
-func (c *Controller) ensureForwardChainExists(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	allChains, err := c.ipt.ListChains(FilterTable)
+	err = c.ipt.DeleteChain(table, chain)
 	if err != nil {
-		glog.Errorf("couldn't list all chains in filter table, see: %v", err)
-		c.countError()
-		return
+		return fmt.Errorf("couldn't delete chain `%s`, see: %v", chain, err)
 	}
 
-	found := false
-	for _, chain := range allChains {
-		if chain == c.forwardChainName {
-			found = true
-			glog.V(4).Infof("skipping creation of forward chain since it already exists")
-			return
-		}
-	}
-
-	if !found {
-		glog.V(4).Infof("creating forwardChain...")
-		err := c.ipt.NewChain(FilterTable, c.forwardChainName)
-		if err != nil {
-			glog.Errorf("couldn't create forwardChain, see: %v", err)
-			c.countError()
-			return
-		}
-		glog.V(4).Infof("created forwardChain")
-	}
+	return nil
 }
 
-func (c *Controller) getSrcForwardRuleStringForEndpointAndProt(endpoint Endpoint, prot Protocol) string {
+func (c *Controller) getSrcForwardRuleForEndpointAndProt(endpoint Endpoint, ports PortSet, prot Protocol) Rule {
 	// iptables -t filter -A FORWARD -s 10.0.0.2 --sport 1234 -j ACCEPT
-	return fmt.Sprintf("-p %s -s %s --sport %d -j ACCEPT", prot.String(), endpoint.IP.String(), endpoint.Port)
-}
-
-func (c *Controller) getDstForwardRuleStringForEndpointAndProt(endpoint Endpoint, prot Protocol) string {
-	// iptables -t filter -A FORWARD -d 10.0.0.2 --dport 1234 -j ACCEPT
-	return fmt.Sprintf("-p %s -d %s --dport %d -j ACCEPT", prot.String(), endpoint.IP.String(), endpoint.Port)
-}
-
-func (c *Controller) ensureForwardChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// Iterate over all lbs (in config) and ensure forward entries for every output
-	rules, err := c.ipt.List(FilterTable, c.forwardChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in forwardChain `%s`, see: %v", c.forwardChainName, err)
-		c.countError()
-		return
+	rule := Rule{
+		Protocol:   prot,
+		Source:     hostIPNet(endpoint.IP),
+		SourcePort: endpoint.Port,
+		Comment:    c.ruleComment(RuleComment{Backend: endpoint.String()}),
+		Jump:       "ACCEPT",
 	}
 
-	for lbKey, lb := range c.loadbalancers {
-		for _, output := range lb.Outputs {
-			srcRule := c.getSrcForwardRuleStringForEndpointAndProt(output, lb.Protocol)
-			if !c.rulesContainRule(rules, srcRule) {
-				err = c.ipt.Append(FilterTable, c.forwardChainName, strings.Split(srcRule, " ")...)
-				if err != nil {
-					glog.Errorf("couldn't create source forward rule for output `%s` of lb `%s`, see: %v", output.String(), lbKey, err)
-					c.countError()
-				} else {
-					glog.Infof("added source forward rule for output `%s` of lb `%s`", output.String(), lbKey)
-				}
-			}
-
-			dstRule := c.getDstForwardRuleStringForEndpointAndProt(output, lb.Protocol)
-			if !c.rulesContainRule(rules, dstRule) {
-				err = c.ipt.Append(FilterTable, c.forwardChainName, strings.Split(dstRule, " ")...)
-				if err != nil {
-					glog.Errorf("couldn't create destination forward rule for output `%s` of lb `%s`, see: %v", output.String(), lbKey, err)
-					c.countError()
-				} else {
-					glog.V(4).Infof("added destination forward rule for output `%s` of lb `%s`", output.String(), lbKey)
-				}
-			}
-		}
+	if ports != nil {
+		rule.setSourcePorts(ports)
 	}
+
+	return rule
 }
 
-func (c *Controller) deleteObsoleteForwardChainEntries(allChains []string, chainIDs []ChainID, lbToChains map[string][]ChainID) {
-	// Delete everything not referenced by any NAT chain (so in case we couldnt create new outputs, the old ones (not in config anymore) can still accept traffic)
-	forwardRules, err := c.ipt.List(FilterTable, c.forwardChainName)
-	if err != nil {
-		glog.Errorf("couldn't retrieve rules in forwardChain `%s`, see: %v", c.forwardChainName, err)
-		c.countError()
-		return
+func (c *Controller) getDstForwardRuleForEndpointAndProt(endpoint Endpoint, ports PortSet, prot Protocol) Rule {
+	// iptables -t filter -A FORWARD -d 10.0.0.2 --dport 1234 -j ACCEPT
+	rule := Rule{
+		Protocol:        prot,
+		Destination:     hostIPNet(endpoint.IP),
+		DestinationPort: endpoint.Port,
+		Comment:         c.ruleComment(RuleComment{Backend: endpoint.String()}),
+		Jump:            "ACCEPT",
 	}
 
-	referencedEndpoints := make(map[string]struct{})
-
-	for _, chainID := range chainIDs {
-		rulesInChain, err := c.ipt.List(NATTable, chainID.String())
-		if err != nil {
-			glog.Errorf("WILL NOT DELETE ANY OBSOLETE FORWARD CHAIN ENTRIES, see: couldn't retrieve rules in chain `%s`, see: %v", chainID.String(), err)
-			c.countError()
-			return
-		}
-
-		for _, rule := range rulesInChain {
-			if rule == "-N "+chainID.String() {
-				continue
-			}
-
-			dest, err := c.getDestinationFromRule(rule)
-			if err != nil {
-				glog.Errorf("WILL NOT DELETE ANY OBSOLETE FORWARD CHAIN ENTRIES, see: couldn't find endpoint in rule `%s`, see: %v", rule, err)
-				c.countError()
-				return
-			}
-
-			referencedEndpoints[dest.String()] = struct{}{}
-		}
+	if ports != nil {
+		rule.setDestinationPorts(ports)
 	}
 
-	for _, rule := range forwardRules {
-		rule = c.stripNARules(rule)
-
-		if rule == "" {
-			// e.g. -N or -A rule
-			continue
-		}
-
-		dest, err := c.getDestinationFromForwardRule(rule)
-		if err != nil {
-			glog.Errorf("can't delete potential obsolete forward chain entry, see: couldn't get destination from forward rule `%s`, see: %v", rule, err)
-			c.countError()
-			continue
-		}
-
-		_, isReferenced := referencedEndpoints[dest.String()]
-		if !isReferenced {
-			// Fuckly hack since iptables gives us the mask, but doesnt like it when we give it...
-			rule = strings.ReplaceAll(rule, dest.IP.String()+"/32", dest.IP.String())
-
-			err := c.ipt.Delete(FilterTable, c.forwardChainName, strings.Split(rule, " ")...)
-			if err != nil {
-				glog.Errorf("couldn't delete obsolete forward rule `%s`, see: %v", rule, err)
-				c.countError()
-				continue
-			}
-
-			glog.V(4).Infof("deleted obsolete forward rule `%s`", rule)
-		}
-	}
+	return rule
 }
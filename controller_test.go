@@ -1,13 +1,18 @@
 package main
 
 import (
+	"net"
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMainChainCreation(t *testing.T) {
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
@@ -62,14 +67,14 @@ func TestLBWithMultipleOutputsAdded(t *testing.T) {
 	output2, _ := TryParseEndpoint("10.100.0.2:1002")
 	output3, _ := TryParseEndpoint("10.100.0.3:1003")
 
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb := NewLoadbalancer(ProtocolTCP, input, output1, output2, output3)
-	lb.LastUpdate = uint32(12345)
+	lb.Generation = uint32(12345)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -87,7 +92,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -95,7 +100,7 @@ Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual := iptablesLNVTNAT(t)
 
@@ -105,7 +110,7 @@ Chain iptableslb-prerouting (0 references)
 }
 
 func TestDeleteUnknownLB(t *testing.T) {
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
@@ -123,7 +128,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -131,7 +136,7 @@ Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actualBefore := iptablesLNVTNAT(t)
 
@@ -139,7 +144,7 @@ Chain iptableslb-prerouting (0 references)
 		t.Fatalf("BEFORE expected `%s` got `%s`", expectedBefore, actualBefore)
 	}
 
-	ctrl, err = NewController(1, nil, "")
+	ctrl, err = NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
@@ -173,14 +178,14 @@ func TestLBWithSingleOutputsAndExplicitDelete(t *testing.T) {
 	input, _ := TryParseEndpoint("10.50.1.1:1234")
 	output1, _ := TryParseEndpoint("10.100.0.1:1001")
 
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb := NewLoadbalancer(ProtocolTCP, input, output1)
-	lb.LastUpdate = uint32(12345)
+	lb.Generation = uint32(12345)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -198,13 +203,13 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAADA5AeSXG0U= (1 references)
+Chain LB$-IQDgJGy/AAAwOeSXG0U6D6K8 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 to:10.100.0.1:1001
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AeSXG0U=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOeSXG0U6D6K8  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual := iptablesLNVTNAT(t)
 
@@ -251,7 +256,7 @@ Chain iptableslb-prerouting (0 references)
 }
 
 func TestMultipleLBs(t *testing.T) {
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
@@ -261,9 +266,9 @@ func TestMultipleLBs(t *testing.T) {
 	output12, _ := TryParseEndpoint("10.100.0.2:1002")
 	output13, _ := TryParseEndpoint("10.100.0.3:1003")
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb1 := NewLoadbalancer(ProtocolTCP, input1, output11, output12, output13)
-	lb1.LastUpdate = uint32(12345)
+	lb1.Generation = uint32(12345)
 	ctrl.loadbalancers[lb1.Key()] = *lb1
 
 	input2, _ := TryParseEndpoint("10.50.2.1:1234")
@@ -271,9 +276,9 @@ func TestMultipleLBs(t *testing.T) {
 	output22, _ := TryParseEndpoint("10.100.2.2:1002")
 	output23, _ := TryParseEndpoint("10.100.2.3:1003")
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb2 := NewLoadbalancer(ProtocolTCP, input2, output21, output22, output23)
-	lb2.LastUpdate = uint32(456789)
+	lb2.Generation = uint32(456789)
 	ctrl.loadbalancers[lb2.Key()] = *lb2
 
 	ctrl.sync()
@@ -292,13 +297,13 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-1gEKMgIBBNIABvhVAR4gROc= (1 references)
+Chain LB$-IQDKZAOtAAb4VR4gROd9l6KF (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.2.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.2.2:1002
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 to:10.100.2.1:1001
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -306,8 +311,8 @@ Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234
-    0     0 LB$-1gEKMgIBBNIABvhVAR4gROc=  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234
+    0     0 LB$-IQDKZAOtAAb4VR4gROd9l6KF  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234`
 
 	expectedB := `
 Chain PREROUTING (policy ACCEPT 0 packets, 0 bytes)
@@ -322,13 +327,13 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-1gEKMgIBBNIABvhVAR4gROc= (1 references)
+Chain LB$-IQDKZAOtAAb4VR4gROd9l6KF (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.2.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.2.2:1002
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 to:10.100.2.1:1001
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -336,8 +341,8 @@ Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-1gEKMgIBBNIABvhVAR4gROc=  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDKZAOtAAb4VR4gROd9l6KF  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual := iptablesLNVTNAT(t)
 
@@ -362,7 +367,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-1gEKMgIBBNIABvhVAR4gROc= (1 references)
+Chain LB$-IQDKZAOtAAb4VR4gROd9l6KF (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.2.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.2.2:1002
@@ -370,7 +375,7 @@ Chain LB$-1gEKMgIBBNIABvhVAR4gROc= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-1gEKMgIBBNIABvhVAR4gROc=  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234`
+    0     0 LB$-IQDKZAOtAAb4VR4gROd9l6KF  tcp  --  *      *       0.0.0.0/0            10.50.2.1            tcp dpt:1234`
 
 	actual = iptablesLNVTNAT(t)
 
@@ -411,14 +416,14 @@ func TestRemoveSingleEndpointFromLB(t *testing.T) {
 	output2, _ := TryParseEndpoint("10.100.0.2:1002")
 	output3, _ := TryParseEndpoint("10.100.0.3:1003")
 
-	ctrl, err := NewController(1, nil, "")
+	ctrl, err := NewController(ControllerConfig{}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb := NewLoadbalancer(ProtocolTCP, input, output1, output2, output3)
-	lb.LastUpdate = uint32(12345)
+	lb.Generation = uint32(12345)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -436,7 +441,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -444,7 +449,7 @@ Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual := iptablesLNVTNAT(t)
 
@@ -453,7 +458,7 @@ Chain iptableslb-prerouting (0 references)
 	}
 
 	lb = NewLoadbalancer(ProtocolTCP, input, output1, output3)
-	lb.LastUpdate = uint32(45678)
+	lb.Generation = uint32(45678)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -471,14 +476,14 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAALJuAaZZdWA= (1 references)
+Chain LB$-IQDgJGy/AACybqZZdWAp26mI (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 to:10.100.0.1:1001
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAALJuAaZZdWA=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AACybqZZdWAp26mI  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual = iptablesLNVTNAT(t)
 
@@ -519,14 +524,14 @@ func TestHairpinningUpAndDown(t *testing.T) {
 	output2, _ := TryParseEndpoint("10.100.0.2:1002")
 	output3, _ := TryParseEndpoint("10.100.0.3:1003")
 
-	ctrl, err := NewController(1, nil, "42.42.42.0/24")
+	ctrl, err := NewController(ControllerConfig{HairpinningCIDR: "42.42.42.0/24"}, nil)
 	if err != nil {
 		t.Fatalf("Controller couldn't start, see: %v", err)
 	}
 
-	// dont use upsert since it changes the LastUpdate date and we can't compare chain names anymore
+	// dont use upsert since it resets the Generation and we can't compare chain names anymore
 	lb := NewLoadbalancer(ProtocolTCP, input, output1, output2, output3)
-	lb.LastUpdate = uint32(12345)
+	lb.Generation = uint32(12345)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -544,7 +549,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAADA5AfMq03E= (1 references)
+Chain LB$-IQDgJGy/AAAwOfMq03FQ0Dl3 (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 3 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.2:1002
@@ -558,7 +563,7 @@ Chain iptableslb-hairpinning (0 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAADA5AfMq03E=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AAAwOfMq03FQ0Dl3  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 	actual := iptablesLNVTNAT(t)
 
 	if strings.TrimSpace(expected) != strings.TrimSpace(actual) {
@@ -566,7 +571,7 @@ Chain iptableslb-prerouting (0 references)
 	}
 
 	lb = NewLoadbalancer(ProtocolTCP, input, output1, output3)
-	lb.LastUpdate = uint32(45678)
+	lb.Generation = uint32(45678)
 	ctrl.loadbalancers[lb.Key()] = *lb
 
 	ctrl.sync()
@@ -584,7 +589,7 @@ Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
 Chain POSTROUTING (policy ACCEPT 0 packets, 0 bytes)
  pkts bytes target     prot opt in     out     source               destination         
 
-Chain LB$-CgEKMgEBBNIAALJuAaZZdWA= (1 references)
+Chain LB$-IQDgJGy/AACybqZZdWAp26mI (1 references)
  pkts bytes target     prot opt in     out     source               destination         
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 statistic mode nth every 2 to:10.100.0.3:1003
     0     0 DNAT       tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234 to:10.100.0.1:1001
@@ -596,7 +601,7 @@ Chain iptableslb-hairpinning (0 references)
 
 Chain iptableslb-prerouting (0 references)
  pkts bytes target     prot opt in     out     source               destination         
-    0     0 LB$-CgEKMgEBBNIAALJuAaZZdWA=  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
+    0     0 LB$-IQDgJGy/AACybqZZdWAp26mI  tcp  --  *      *       0.0.0.0/0            10.50.1.1            tcp dpt:1234`
 
 	actual = iptablesLNVTNAT(t)
 
@@ -653,3 +658,485 @@ func iptablesClearCounters(t *testing.T) {
 }
 
 // TODO tests for the forward chain
+
+func TestUpsertTriggersDebouncedSync(t *testing.T) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{ResyncInterval: time.Hour, SyncDebounce: 50 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	ctrl.Run()
+	defer ctrl.Stop()
+
+	ctrl.UpsertLoadbalancer(NewLoadbalancer(ProtocolTCP, input1, output1))
+	ctrl.UpsertLoadbalancer(NewLoadbalancer(ProtocolTCP, input2, output1))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ctrl.Lock()
+		rules, err := ipt.List(NATTable, ctrl.mainChainName)
+		ctrl.Unlock()
+
+		if err == nil && len(rules) == 3 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected both loadbalancers to be synced without waiting for the resync interval")
+}
+
+func TestInstancesDontDeleteEachOthersChains(t *testing.T) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	ipt := NewDryRunIPTables(nil)
+
+	blue, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "blue"}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	green, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "green"}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	lb1 := NewLoadbalancer(ProtocolTCP, input1, output1)
+	blue.loadbalancers[lb1.Key()] = *lb1
+
+	lb2 := NewLoadbalancer(ProtocolTCP, input2, output2)
+	green.loadbalancers[lb2.Key()] = *lb2
+
+	blue.sync()
+	green.sync()
+	blue.sync()
+
+	for _, ctrl := range []*Controller{blue, green} {
+		rules, err := ipt.List(NATTable, ctrl.mainChainName)
+		if err != nil {
+			t.Fatalf("couldn't list main chain `%s`, see: %v", ctrl.mainChainName, err)
+		}
+
+		if len(rules) != 2 {
+			t.Fatalf("expected exactly one entry in main chain `%s` but got %v", ctrl.mainChainName, rules)
+		}
+
+		rule, err := TryParseRule(rules[1])
+		if err != nil {
+			t.Fatalf("couldn't parse main chain rule, see: %v", err)
+		}
+
+		if _, err := ipt.List(NATTable, rule.Jump); err != nil {
+			t.Fatalf("chain `%s` of instance `%s` got deleted", rule.Jump, ctrl.mainChainName)
+		}
+	}
+}
+
+func TestInstancesWithSameTagRefuseToStart(t *testing.T) {
+	if InstanceTagForName("blue") != InstanceTagForName("red40") {
+		t.Fatalf("expected instances `blue` and `red40` to share their instance tag")
+	}
+
+	ipt := NewDryRunIPTables(nil)
+
+	blue, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "blue"}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	red, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "red40"}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	blue.sync()
+	if blue.syncErrors != 0 {
+		t.Fatalf("expected sync of first instance to succeed but got %d errors", blue.syncErrors)
+	}
+
+	if _, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "red40"}, nil); err == nil {
+		t.Fatalf("expected an error for an instance sharing its tag with the chains of another one")
+	}
+
+	// an instance started before the chains of the other one existed doesn't touch iptables either
+	red.sync()
+	if red.syncErrors == 0 {
+		t.Fatalf("expected sync of instance sharing its tag to fail")
+	}
+
+	if _, err := NewControllerWithIPTables(ipt, ControllerConfig{Instance: "green"}, nil); err != nil {
+		t.Fatalf("Controller with another tag couldn't start, see: %v", err)
+	}
+}
+
+func TestInstanceNameTooLong(t *testing.T) {
+	_, err := NewControllerWithIPTables(NewDryRunIPTables(nil), ControllerConfig{Instance: "averyverylongname"}, nil)
+	if err == nil {
+		t.Fatalf("expected an error for chain names exceeding the iptables limit")
+	}
+}
+
+func TestLocalTrafficUsesSameLBChain(t *testing.T) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{LocalTraffic: true}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	lb := NewLoadbalancer(ProtocolTCP, input1, output1)
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+
+	assertDispatchChainsEqual := func(expectedEntries int) {
+		mainRules, err := ipt.List(NATTable, ctrl.mainChainName)
+		if err != nil {
+			t.Fatalf("couldn't list main chain, see: %v", err)
+		}
+
+		outputRules, err := ipt.List(NATTable, ctrl.outputChainName)
+		if err != nil {
+			t.Fatalf("couldn't list output chain, see: %v", err)
+		}
+
+		if len(mainRules) != expectedEntries+1 || len(outputRules) != expectedEntries+1 {
+			t.Fatalf("expected %d entries in main and output chain but got %v and %v", expectedEntries, mainRules, outputRules)
+		}
+
+		for i := 1; i < len(mainRules); i++ {
+			if strings.TrimPrefix(mainRules[i], "-A "+ctrl.mainChainName) != strings.TrimPrefix(outputRules[i], "-A "+ctrl.outputChainName) {
+				t.Fatalf("expected output chain to jump to the same chains as the main chain, got %v and %v", mainRules, outputRules)
+			}
+		}
+	}
+
+	assertDispatchChainsEqual(1)
+
+	lb.Outputs = append(lb.Outputs, output2)
+	lb.MarkUpdated()
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+
+	assertDispatchChainsEqual(1)
+
+	chains, _ := ipt.ListChains(NATTable)
+	if len(ctrl.findChainIDs(chains)) != 1 {
+		t.Fatalf("expected the outdated lb chain to be deleted, got %v", chains)
+	}
+
+	delete(ctrl.loadbalancers, lb.Key())
+	ctrl.sync()
+
+	assertDispatchChainsEqual(0)
+}
+
+func TestRestartAdoptsExistingChains(t *testing.T) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+	output3, _ := TryParseEndpoint("10.100.0.3:1003")
+
+	ipt := NewDryRunIPTables(nil)
+
+	before, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	lb1 := NewLoadbalancer(ProtocolTCP, input1, output1, output2)
+	lb1.Generation = 1000
+	before.loadbalancers[lb1.Key()] = *lb1
+
+	lb2 := NewLoadbalancer(ProtocolTCP, input2, output1)
+	lb2.Generation = 1000
+	before.loadbalancers[lb2.Key()] = *lb2
+
+	before.sync()
+
+	after, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	// same outputs in a different order
+	lb1 = NewLoadbalancer(ProtocolTCP, input1, output2, output1)
+	lb1.Generation = 2000
+	after.loadbalancers[lb1.Key()] = *lb1
+
+	// changed outputs
+	lb2 = NewLoadbalancer(ProtocolTCP, input2, output1, output3)
+	lb2.Generation = 2000
+	after.loadbalancers[lb2.Key()] = *lb2
+
+	changesBefore := len(ipt.Changes())
+	after.sync()
+	changes := ipt.Changes()[changesBefore:]
+
+	for _, change := range changes {
+		if strings.Contains(change, GetLoadbalancerKey(ProtocolTCP, input1)) || strings.Contains(change, "10.50.1.1") {
+			t.Fatalf("expected unchanged lb to keep its chain, but got change `%s`", change)
+		}
+	}
+
+	if after.loadbalancers[lb1.Key()].Generation != 1000 {
+		t.Fatalf("expected unchanged lb to adopt the existing chain")
+	}
+
+	chains, _ := ipt.ListChains(NATTable)
+	chainIDs := after.findChainIDs(chains)
+	if len(chainIDs) != 2 || after.getActiveChainID(*lb2, chainIDs).Generation != 2000 {
+		t.Fatalf("expected changed lb to get a new chain, got %v", chains)
+	}
+
+	rules, err := ipt.List(NATTable, after.mainChainName)
+	if err != nil || len(rules) != 3 {
+		t.Fatalf("expected one main chain entry per lb but got %v, %v", rules, err)
+	}
+}
+
+func TestRapidUpsertsAllReachIPTables(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:1234")
+	outputs := make([]Endpoint, 0)
+	for _, str := range []string{"10.100.0.1:1001", "10.100.0.2:1002", "10.100.0.3:1003", "10.100.0.4:1004"} {
+		output, _ := TryParseEndpoint(str)
+		outputs = append(outputs, output)
+	}
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	// every upsert happens within the same second, each one has to end up in iptables anyway
+	for _, expected := range [][]Endpoint{outputs[:1], outputs[:2], outputs[:3], outputs[:2], outputs[1:4], outputs[:1]} {
+		ctrl.UpsertLoadbalancer(NewLoadbalancer(ProtocolTCP, input, expected...))
+		ctrl.sync()
+
+		if ctrl.syncErrors != 0 {
+			t.Fatalf("expected sync to succeed, got %d errors", ctrl.syncErrors)
+		}
+
+		mainRules, err := ipt.List(NATTable, ctrl.mainChainName)
+		if err != nil || len(mainRules) != 2 {
+			t.Fatalf("expected exactly one main chain entry but got %v, %v", mainRules, err)
+		}
+
+		rule, _ := TryParseRule(mainRules[1])
+		lbRules, err := ipt.List(NATTable, rule.Jump)
+		if err != nil {
+			t.Fatalf("couldn't list active chain `%s`, see: %v", rule.Jump, err)
+		}
+
+		actual := make([]Endpoint, 0)
+		for _, lbRule := range lbRules[1:] {
+			parsed, _ := TryParseRule(lbRule)
+			actual = append(actual, *parsed.ToDestination)
+		}
+
+		if !EndpointsEqual(actual, expected) {
+			t.Fatalf("expected outputs %v in active chain but got %v", expected, actual)
+		}
+	}
+}
+
+func TestGenerationWrapsAround(t *testing.T) {
+	if !GenerationNewer(1, 0xFFFFFFFF) || GenerationNewer(0xFFFFFFFF, 1) {
+		t.Fatalf("expected generation 1 to be newer than 0xFFFFFFFF")
+	}
+
+	if NextGeneration(0xFFFFFFFF) != 1 {
+		t.Fatalf("expected generation 0 to be skipped, got %d", NextGeneration(0xFFFFFFFF))
+	}
+
+	ctrl, err := NewControllerWithIPTables(NewDryRunIPTables(nil), ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	input, _ := TryParseEndpoint("10.50.1.1:1234")
+	lb := NewLoadbalancer(ProtocolTCP, input)
+	existing := []ChainID{lb.GetChainID(0, ChainCreated, 0)}
+	existing[0].Generation = 0xFFFFFFFE
+	existing = append(existing, existing[0])
+	existing[1].Generation = 0xFFFFFFFF
+
+	if generation := ctrl.getNewGeneration(*lb, existing); generation != 1 {
+		t.Fatalf("expected new generation 1 after wraparound, got %d", generation)
+	}
+
+	if latest := ctrl.getLatestChainID([]ChainID{existing[1], NewChainID(ProtocolTCP, input.IP, input.Port, 1, ChainCreated, 0)}); latest.Generation != 1 {
+		t.Fatalf("expected chain with generation 1 to be the latest, got %d", latest.Generation)
+	}
+}
+
+func TestMigrationFromV1Chains(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	// chain as created by older versions
+	lb := NewLoadbalancer(ProtocolTCP, input, output1)
+	v1Rules := []string{"-p", "tcp", "-d", "10.50.1.1", "--dport", "1234", "-j", "DNAT", "--to-destination", "10.100.0.1:1001"}
+	v1Chain := ChainID{Version: ChainIDVersion1, Protocol: ProtocolTCP, IP: input.IP, Port: input.Port, Generation: 12345, State: ChainCreated}
+	v1Chain.CRC = calculateChainIDCRC(v1Chain.Protocol, v1Chain.IP, v1Chain.Port, 0)
+	v1Chain.ContentHash = ctrl.calculateHashForRules([]string{"-N x", "-A x " + strings.Join(v1Rules, " ")})
+
+	for _, step := range [][]string{
+		{"-N", ctrl.mainChainName},
+		{"-N", v1Chain.String()},
+		{"-A", v1Chain.String()},
+		{"-A", ctrl.mainChainName, "-p", "tcp", "-d", "10.50.1.1", "--dport", "1234", "-j", v1Chain.String()},
+	} {
+		var err error
+		switch {
+		case step[0] == "-N":
+			err = ipt.NewChain(NATTable, step[1])
+		case len(step) == 2:
+			err = ipt.Append(NATTable, step[1], v1Rules...)
+		default:
+			err = ipt.Append(NATTable, step[1], step[2:]...)
+		}
+
+		if err != nil {
+			t.Fatalf("couldn't set up v1 chain, see: %v", err)
+		}
+	}
+
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+
+	if ctrl.loadbalancers[lb.Key()].Generation != 12345 {
+		t.Fatalf("expected unchanged lb to adopt v1 chain `%s`", v1Chain.String())
+	}
+
+	lb.Outputs = append(lb.Outputs, output2)
+	lb.MarkUpdated()
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+
+	chains, _ := ipt.ListChains(NATTable)
+	chainIDs := ctrl.findChainIDs(chains)
+	if len(chainIDs) != 1 || chainIDs[0].Version != ChainIDVersion2 || chainIDs[0].Generation != 12346 {
+		t.Fatalf("expected v1 chain to be replaced by a v2 one, got %v", chains)
+	}
+
+	mainRules, _ := ipt.List(NATTable, ctrl.mainChainName)
+	if len(mainRules) != 2 || !strings.HasSuffix(mainRules[1], chainIDs[0].String()) {
+		t.Fatalf("expected main chain to jump to the v2 chain, got %v", mainRules)
+	}
+}
+
+func TestTCPUDPLoadbalancerCreatesChainPerProtocol(t *testing.T) {
+	definition, err := parseLoadbalancerDefinition("tcpudp://10.50.1.1:53", "10.100.0.1-2:53", "none", EndpointParseOptions{})
+	if err != nil {
+		t.Fatalf("couldn't parse lb, see: %v", err)
+	}
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	lb := definition.Loadbalancer
+	ctrl.UpsertLoadbalancer(lb)
+	ctrl.sync()
+
+	rules, err := ipt.List(NATTable, ctrl.mainChainName)
+	if err != nil {
+		t.Fatalf("couldn't list main chain, see: %v", err)
+	}
+
+	protocols := make([]string, 0)
+	for _, raw := range rules[1:] {
+		rule, err := TryParseRule(raw)
+		if err != nil {
+			t.Fatalf("couldn't parse main chain rule, see: %v", err)
+		}
+
+		protocols = append(protocols, rule.Protocol.String())
+
+		chainRules, err := ipt.List(NATTable, rule.Jump)
+		if err != nil || len(chainRules) != 3 {
+			t.Fatalf("expected chain `%s` with 2 DNAT rules but got %v, %v", rule.Jump, chainRules, err)
+		}
+	}
+
+	if strings.Join(protocols, ",") != "tcp,udp" {
+		t.Fatalf("expected a chain for tcp and udp but got `%s`", strings.Join(protocols, ","))
+	}
+
+	// removing all outputs removes both chains
+	ctrl.UpsertLoadbalancer(NewLoadbalancer(lb.Protocol, lb.Input))
+	ctrl.sync()
+
+	rules, err = ipt.List(NATTable, ctrl.mainChainName)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected empty main chain but got %v, %v", rules, err)
+	}
+}
+
+func TestRejectedPacketsMetric(t *testing.T) {
+	metrics := &Metrics{
+		ErrorsTotal:          prometheus.NewCounter(prometheus.CounterOpts{Name: "errors_total"}),
+		LBHealthy:            prometheus.NewGauge(prometheus.GaugeOpts{Name: "lb_healthy"}),
+		LBHealthyEndpoints:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "lb_healthy_endpoints"}, []string{"lb"}),
+		UnknownRules:         prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "unknown_rules"}, []string{"table", "chain"}),
+		DriftRepairsTotal:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "drift_repairs_total"}, []string{"table", "chain"}),
+		RejectedPacketsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lb_rejected_packets_total"}, []string{"lb"}),
+	}
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(countingIPTables{ipt}, ControllerConfig{}, metrics)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:443?deny=10.1.0.0/16", "10.100.0.1:8443", "none", EndpointParseOptions{})
+	if err != nil {
+		t.Fatalf("couldn't parse lb, see: %v", err)
+	}
+
+	lb := definition.Loadbalancer
+	ctrl.UpsertLoadbalancer(lb)
+
+	// the fake counters of the returning rule don't change, so they only get counted once
+	for i := 0; i < 2; i++ {
+		ctrl.sync()
+
+		rejected := testutil.ToFloat64(metrics.RejectedPacketsTotal.WithLabelValues(lb.Key()))
+		if rejected != 111 {
+			t.Fatalf("expected 111 rejected packets after sync %d but got %v", i+1, rejected)
+		}
+	}
+
+	// a new chain starts counting at 0 again
+	lb.AllowSources = []*net.IPNet{hostIPNet(net.ParseIP("10.2.0.1"))}
+	ctrl.UpsertLoadbalancer(lb)
+	ctrl.sync()
+
+	rejected := testutil.ToFloat64(metrics.RejectedPacketsTotal.WithLabelValues(lb.Key()))
+	if rejected != 111+1111 {
+		t.Fatalf("expected %d rejected packets but got %v", 111+1111, rejected)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDNSMinTTL is the minimum time resolved records are cached, protects the dns servers from records with
+	// a tiny or zero ttl.
+	DefaultDNSMinTTL = 5 * time.Second
+
+	// DefaultDNSMaxTTL is the maximum time resolved records are cached.
+	DefaultDNSMaxTTL = 1 * time.Hour
+
+	// DefaultDNSTimeout is the timeout of a single dns query.
+	DefaultDNSTimeout = 5 * time.Second
+)
+
+// DNSOutput is an output which gets resolved via dns, either a hostname with port like "api.internal:8080" or a SRV
+// name like "_http._tcp.api.internal", which contains the ports itself.
+type DNSOutput struct {
+	Name string
+	Port uint16
+}
+
+// IsSRV checks whether the output is a SRV name.
+func (o DNSOutput) IsSRV() bool {
+	return strings.HasPrefix(o.Name, "_")
+}
+
+func (o DNSOutput) String() string {
+	if o.IsSRV() {
+		return o.Name
+	}
+
+	return o.Name + ":" + strconv.Itoa(int(o.Port))
+}
+
+// isDNSOutput checks whether the passed part of an output list is a hostname or SRV name instead of ips.
+func isDNSOutput(part string) bool {
+	if strings.HasPrefix(part, "_") {
+		return true
+	}
+
+	host := strings.Split(part, ":")[0]
+
+	return strings.IndexFunc(host, func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+	}) >= 0 && !strings.HasPrefix(part, "!")
+}
+
+// TryParseDNSOutput tries to parse a hostname with port like "api.internal:8080" or a SRV name like
+// "_http._tcp.api.internal".
+func TryParseDNSOutput(str string) (DNSOutput, error) {
+	if strings.HasPrefix(str, "_") {
+		if strings.Contains(str, ":") {
+			return DNSOutput{}, fmt.Errorf("SRV name `%s` mustn't contain a port, it's part of the records", str)
+		}
+
+		if _, ok := dns.IsDomainName(str); !ok {
+			return DNSOutput{}, fmt.Errorf("invalid SRV name `%s`", str)
+		}
+
+		return DNSOutput{Name: str}, nil
+	}
+
+	splitted := strings.Split(str, ":")
+	if len(splitted) != 2 {
+		return DNSOutput{}, fmt.Errorf("expected hostname:port but got `%s`", str)
+	}
+
+	if _, ok := dns.IsDomainName(splitted[0]); !ok {
+		return DNSOutput{}, fmt.Errorf("invalid hostname `%s`", splitted[0])
+	}
+
+	port, err := parsePort(splitted[1])
+	if err != nil {
+		return DNSOutput{}, fmt.Errorf("couldn't parse port of `%s`, see: %v", str, err)
+	}
+
+	return DNSOutput{Name: splitted[0], Port: port}, nil
+}
+
+// splitOutputs splits an output list into the parts consisting of ips, which can be parsed by TryParseEndpoints, and
+// the ones which have to be resolved via dns.
+func splitOutputs(str string) (string, []DNSOutput, error) {
+	static := make([]string, 0)
+	dnsOutputs := make([]DNSOutput, 0)
+
+	for _, part := range strings.Split(str, ",") {
+		if !isDNSOutput(part) {
+			static = append(static, part)
+			continue
+		}
+
+		output, err := TryParseDNSOutput(part)
+		if err != nil {
+			return "", nil, err
+		}
+
+		dnsOutputs = append(dnsOutputs, output)
+	}
+
+	return strings.Join(static, ","), dnsOutputs, nil
+}
+
+// Backend is an output of a loadbalancer with its share of traffic and priority.
+type Backend struct {
+	Endpoint Endpoint
+
+	// Weight is the relative share of traffic, at least 1
+	Weight int
+
+	// Priority is the tier of the backend, backends of a higher priority only get traffic if all backends of lower
+	// priorities are down
+	Priority int
+}
+
+// Resolver resolves dns outputs into backends.
+type Resolver struct {
+	Servers []string
+	MinTTL  time.Duration
+	MaxTTL  time.Duration
+	client  *dns.Client
+}
+
+// NewResolver creates a resolver querying the passed servers (host:port).
+func NewResolver(servers ...string) *Resolver {
+	return &Resolver{
+		Servers: servers,
+		MinTTL:  DefaultDNSMinTTL,
+		MaxTTL:  DefaultDNSMaxTTL,
+		client:  &dns.Client{Net: "udp", Timeout: DefaultDNSTimeout},
+	}
+}
+
+// NewResolverFromResolvConf creates a resolver querying the nameservers configured in the passed resolv.conf.
+func NewResolverFromResolvConf(path string) (*Resolver, error) {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read nameservers from `%s`, see: %v", path, err)
+	}
+
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+
+	return NewResolver(servers...), nil
+}
+
+// Resolve resolves the passed output and returns the backends together with the time they're valid for.
+func (r *Resolver) Resolve(output DNSOutput) ([]Backend, time.Duration, error) {
+	if !output.IsSRV() {
+		ips, ttl, err := r.resolveA(output.Name, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		backends := make([]Backend, 0, len(ips))
+		for _, ip := range ips {
+			backends = append(backends, Backend{Endpoint: NewEndpoint(ip, output.Port), Weight: 1})
+		}
+
+		return backends, r.clampTTL(ttl), nil
+	}
+
+	answer, err := r.query(output.Name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ttl minTTL
+	backends := make([]Backend, 0)
+
+	for _, rr := range answer.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		ttl.add(time.Duration(srv.Hdr.Ttl) * time.Second)
+
+		ips, ipTTL, err := r.resolveA(srv.Target, answer.Extra)
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't resolve target `%s` of SRV record `%s`, see: %v", srv.Target, output.Name, err)
+		}
+
+		ttl.add(ipTTL)
+
+		// weight 0 is meant for targets which should only get traffic if there is no other one, the closest we can get
+		// is the smallest share
+		weight := int(srv.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+
+		for _, ip := range ips {
+			backends = append(backends, Backend{Endpoint: NewEndpoint(ip, srv.Port), Weight: weight, Priority: int(srv.Priority)})
+		}
+	}
+
+	if len(backends) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records found for `%s`", output.Name)
+	}
+
+	sort.SliceStable(backends, func(i, j int) bool {
+		return backends[i].Priority < backends[j].Priority
+	})
+
+	// Priorities are relative to the record set, the lowest one becomes 0 which is the one of configured outputs
+	lowest := backends[0].Priority
+	for i := range backends {
+		backends[i].Priority -= lowest
+	}
+
+	return backends, r.clampTTL(ttl.ttl), nil
+}
+
+// resolveA resolves the ipv4 addresses of the passed name, records in the passed additional section are used
+// instead of querying them. CNAMEs get followed.
+func (r *Resolver) resolveA(name string, additional []dns.RR) ([]net.IP, time.Duration, error) {
+	records := additional
+	target := dns.Fqdn(name)
+
+	if !containsA(records, target) {
+		answer, err := r.query(name, dns.TypeA)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		records = answer.Answer
+	}
+
+	var ttl minTTL
+	ips := make([]net.IP, 0)
+
+	// CNAMEs are listed in front of the records they point to
+	for _, rr := range records {
+		if !strings.EqualFold(rr.Header().Name, target) {
+			continue
+		}
+
+		switch record := rr.(type) {
+		case *dns.CNAME:
+			ttl.add(time.Duration(record.Hdr.Ttl) * time.Second)
+			target = record.Target
+		case *dns.A:
+			ttl.add(time.Duration(record.Hdr.Ttl) * time.Second)
+			ips = append(ips, record.A.To4())
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no A records found for `%s`", name)
+	}
+
+	return ips, ttl.ttl, nil
+}
+
+func containsA(records []dns.RR, name string) bool {
+	for _, rr := range records {
+		if _, ok := rr.(*dns.A); ok && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// query sends the question to all servers till one answers.
+func (r *Resolver) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	var lastErr error
+
+	for _, server := range r.Servers {
+		answer, _, err := r.client.Exchange(msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if answer.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("couldn't resolve `%s`, server `%s` responded with %s", name, server, dns.RcodeToString[answer.Rcode])
+		}
+
+		return answer, nil
+	}
+
+	if lastErr == nil {
+		return nil, fmt.Errorf("couldn't resolve `%s`, no nameservers configured", name)
+	}
+
+	return nil, fmt.Errorf("couldn't resolve `%s`, see: %v", name, lastErr)
+}
+
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < r.MinTTL {
+		return r.MinTTL
+	}
+
+	if ttl > r.MaxTTL {
+		return r.MaxTTL
+	}
+
+	return ttl
+}
+
+// minTTL tracks the smallest ttl of multiple records, a ttl of 0 is a valid one as well.
+type minTTL struct {
+	ttl time.Duration
+	set bool
+}
+
+// add takes the passed ttl into account.
+func (m *minTTL) add(ttl time.Duration) {
+	if !m.set || ttl < m.ttl {
+		m.ttl = ttl
+		m.set = true
+	}
+}
+
+// Watch resolves the output whenever its ttl expired and passes the backends to onUpdate. In case the resolution
+// fails, the previous backends are kept and it gets retried after the minimum ttl.
+func (r *Resolver) Watch(output DNSOutput, stopCh <-chan struct{}, onUpdate func(backends []Backend)) {
+	for {
+		backends, ttl, err := r.Resolve(output)
+		if err != nil {
+			glog.Warningf("couldn't resolve output `%s`, keeping the previous backends, see: %v", output.String(), err)
+			ttl = r.MinTTL
+		} else {
+			glog.V(4).Infof("resolved output `%s` to %d backends, valid for %s", output.String(), len(backends), ttl)
+			onUpdate(backends)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(ttl):
+		}
+	}
+}
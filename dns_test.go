@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gotest.tools/assert"
+)
+
+// testDNSServer is an in-process dns server answering with the configured records.
+type testDNSServer struct {
+	sync.Mutex
+	server  *dns.Server
+	records map[uint16][]dns.RR
+	extra   []dns.RR
+}
+
+func startTestDNSServer(t *testing.T) (*testDNSServer, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+
+	s := &testDNSServer{records: make(map[uint16][]dns.RR)}
+
+	started := make(chan struct{})
+	s.server = &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(s.serveDNS),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go s.server.ActivateAndServe()
+	<-started
+
+	return s, conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) stop() {
+	s.server.Shutdown()
+}
+
+func (s *testDNSServer) set(records ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = make(map[uint16][]dns.RR)
+	s.extra = nil
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+
+		s.records[rr.Header().Rrtype] = append(s.records[rr.Header().Rrtype], rr)
+	}
+}
+
+func (s *testDNSServer) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+
+	question := req.Question[0]
+
+	for _, rr := range s.records[dns.TypeCNAME] {
+		if question.Qtype == dns.TypeA && rr.Header().Name == question.Name {
+			msg.Answer = append(msg.Answer, rr)
+			question.Name = rr.(*dns.CNAME).Target
+		}
+	}
+
+	for _, rr := range s.records[question.Qtype] {
+		if rr.Header().Name == question.Name {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+
+	msg.Extra = s.extra
+
+	if len(msg.Answer) == 0 {
+		msg.Rcode = dns.RcodeNameError
+	}
+
+	w.WriteMsg(msg)
+}
+
+func TestTryParseDNSOutput(t *testing.T) {
+	output, err := TryParseDNSOutput("api.internal:8080")
+	assert.NilError(t, err)
+	assert.Equal(t, output, DNSOutput{Name: "api.internal", Port: 8080})
+	assert.Assert(t, !output.IsSRV())
+
+	output, err = TryParseDNSOutput("_http._tcp.api.internal")
+	assert.NilError(t, err)
+	assert.Equal(t, output, DNSOutput{Name: "_http._tcp.api.internal"})
+	assert.Assert(t, output.IsSRV())
+
+	_, err = TryParseDNSOutput("api.internal")
+	assert.ErrorContains(t, err, "expected hostname:port")
+
+	_, err = TryParseDNSOutput("api.internal:0")
+	assert.ErrorContains(t, err, "invalid port")
+
+	_, err = TryParseDNSOutput("_http._tcp.api.internal:80")
+	assert.ErrorContains(t, err, "mustn't contain a port")
+}
+
+func TestSplitOutputs(t *testing.T) {
+	static, dnsOutputs, err := splitOutputs("10.0.0.1:80,api.internal:8080,10.0.1.0/30:80,!10.0.1.1,_http._tcp.api.internal")
+	assert.NilError(t, err)
+	assert.Equal(t, static, "10.0.0.1:80,10.0.1.0/30:80,!10.0.1.1")
+	assert.DeepEqual(t, dnsOutputs, []DNSOutput{{Name: "api.internal", Port: 8080}, {Name: "_http._tcp.api.internal"}})
+
+	static, dnsOutputs, err = splitOutputs("10.0.0.1-5:80")
+	assert.NilError(t, err)
+	assert.Equal(t, static, "10.0.0.1-5:80")
+	assert.Equal(t, len(dnsOutputs), 0)
+}
+
+func TestParseLoadbalancerDefinitionWithDNSOutputs(t *testing.T) {
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:80", "api.internal:8080", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(definition.Loadbalancer.Outputs), 0)
+	assert.DeepEqual(t, definition.DNSOutputs, []DNSOutput{{Name: "api.internal", Port: 8080}})
+
+	definition, err = parseLoadbalancerDefinition("tcp://10.50.1.1:80", "10.0.0.1:80,api.internal:8080", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(definition.Loadbalancer.Outputs), 1)
+	assert.Equal(t, len(definition.DNSOutputs), 1)
+}
+
+func TestResolveA(t *testing.T) {
+	server, addr := startTestDNSServer(t)
+	defer server.stop()
+	server.set(
+		"api.internal. 30 IN CNAME web.internal.",
+		"web.internal. 60 IN A 10.0.0.1",
+		"web.internal. 20 IN A 10.0.0.2",
+	)
+
+	resolver := NewResolver(addr)
+	backends, ttl, err := resolver.Resolve(DNSOutput{Name: "api.internal", Port: 8080})
+	assert.NilError(t, err)
+	assert.Equal(t, ttl, 20*time.Second)
+	assert.Equal(t, len(backends), 2)
+	assert.Equal(t, backends[0].Endpoint.String(), "10.0.0.1:8080")
+	assert.Equal(t, backends[1].Endpoint.String(), "10.0.0.2:8080")
+	assert.Equal(t, backends[0].Weight, 1)
+
+	// ttls get clamped
+	server.set("api.internal. 0 IN A 10.0.0.1")
+	_, ttl, err = resolver.Resolve(DNSOutput{Name: "api.internal", Port: 8080})
+	assert.NilError(t, err)
+	assert.Equal(t, ttl, DefaultDNSMinTTL)
+
+	// a ttl of 0 is the minimum even if it comes first
+	resolver.MinTTL = time.Second
+	server.set(
+		"api.internal. 0 IN A 10.0.0.1",
+		"api.internal. 60 IN A 10.0.0.2",
+	)
+	_, ttl, err = resolver.Resolve(DNSOutput{Name: "api.internal", Port: 8080})
+	assert.NilError(t, err)
+	assert.Equal(t, ttl, time.Second)
+
+	server.set()
+	_, _, err = resolver.Resolve(DNSOutput{Name: "api.internal", Port: 8080})
+	assert.ErrorContains(t, err, "NXDOMAIN")
+}
+
+func TestResolveSRV(t *testing.T) {
+	server, addr := startTestDNSServer(t)
+	defer server.stop()
+	server.set(
+		"_http._tcp.api.internal. 60 IN SRV 20 0 8081 backup.internal.",
+		"_http._tcp.api.internal. 60 IN SRV 10 30 8080 web1.internal.",
+		"_http._tcp.api.internal. 60 IN SRV 10 10 8080 web2.internal.",
+		"web1.internal. 60 IN A 10.0.0.1",
+		"web2.internal. 60 IN A 10.0.0.2",
+		"backup.internal. 60 IN A 10.0.1.1",
+	)
+
+	resolver := NewResolver(addr)
+	backends, _, err := resolver.Resolve(DNSOutput{Name: "_http._tcp.api.internal"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, backends, []Backend{
+		{Endpoint: NewEndpoint(net.IPv4(10, 0, 0, 1).To4(), 8080), Weight: 30, Priority: 0},
+		{Endpoint: NewEndpoint(net.IPv4(10, 0, 0, 2).To4(), 8080), Weight: 10, Priority: 0},
+		{Endpoint: NewEndpoint(net.IPv4(10, 0, 1, 1).To4(), 8081), Weight: 1, Priority: 10},
+	})
+
+	// targets in the additional section don't get queried
+	server.set(
+		"_http._tcp.api.internal. 60 IN SRV 10 10 8080 web1.internal.",
+	)
+	extra, _ := dns.NewRR("web1.internal. 60 IN A 10.0.0.5")
+	server.Lock()
+	server.extra = []dns.RR{extra}
+	server.Unlock()
+
+	backends, _, err = resolver.Resolve(DNSOutput{Name: "_http._tcp.api.internal"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(backends), 1)
+	assert.Equal(t, backends[0].Endpoint.String(), "10.0.0.5:8080")
+}
+
+func TestResolveFailsOver(t *testing.T) {
+	server, addr := startTestDNSServer(t)
+	defer server.stop()
+
+	// nothing listens on the first server
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	unreachable := conn.LocalAddr().String()
+	conn.Close()
+
+	resolver := NewResolver(unreachable, addr)
+	resolver.client.Timeout = 100 * time.Millisecond
+
+	_, _, err = resolver.Resolve(DNSOutput{Name: "api.internal", Port: 80})
+	assert.ErrorContains(t, err, "NXDOMAIN")
+}
+
+func TestWatchReresolves(t *testing.T) {
+	server, addr := startTestDNSServer(t)
+	defer server.stop()
+	server.set("api.internal. 1 IN A 10.0.0.1")
+
+	resolver := NewResolver(addr)
+	resolver.MinTTL = 10 * time.Millisecond
+	resolver.MaxTTL = 10 * time.Millisecond
+
+	updates := make(chan []Backend, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	go resolver.Watch(DNSOutput{Name: "api.internal", Port: 80}, stopCh, func(backends []Backend) {
+		updates <- backends
+	})
+
+	backends := <-updates
+	assert.Equal(t, backends[0].Endpoint.String(), "10.0.0.1:80")
+
+	server.set("api.internal. 1 IN A 10.0.0.2")
+
+	timeout := time.After(5 * time.Second)
+	for backends[0].Endpoint.String() != "10.0.0.2:80" {
+		select {
+		case backends = <-updates:
+		case <-timeout:
+			t.Fatalf("output didn't get re-resolved")
+		}
+	}
+}
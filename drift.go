@@ -0,0 +1,296 @@
+package main
+
+import (
+	"github.com/golang/glog"
+)
+
+// ruleStatus classifies a rule found in a managed chain.
+type ruleStatus int
+
+const (
+	// ruleUnknown is a rule the controller doesn't create
+	ruleUnknown ruleStatus = iota
+	// ruleKnown is a rule exactly like the controller creates it
+	ruleKnown
+	// ruleOutdated is a rule the controller creates, but with a different comment, e.g. created by an older version
+	ruleOutdated
+)
+
+// getRuleStatus compares the rule with the one the controller would create instead.
+func getRuleStatus(rule Rule, expected Rule) ruleStatus {
+	if rule.Equals(expected) {
+		return ruleKnown
+	}
+
+	if rule.withoutComment().Equals(expected.withoutComment()) {
+		return ruleOutdated
+	}
+
+	return ruleUnknown
+}
+
+// managedChain describes a chain completely owned by the controller.
+type managedChain struct {
+	Table string
+	Chain string
+
+	// Status checks whether the rule is one the controller creates in this chain
+	Status func(rule Rule) ruleStatus
+
+	// Expected contains the rules wanted in the chain in their expected order
+	Expected []Rule
+}
+
+func (c *Controller) getManagedChains(actual *actualState, desired *desiredState) []managedChain {
+	chains := []managedChain{
+		{Table: FilterTable, Chain: c.forwardChainName, Status: c.forwardRuleStatus, Expected: desired.forwardRules},
+		{Table: FilterTable, Chain: c.inputChainName, Status: c.inputRuleStatus, Expected: desired.inputRules},
+	}
+
+	dispatchRules := c.getDispatchRules(actual)
+	for _, dispatchChain := range c.getDispatchChains() {
+		chains = append(chains, managedChain{Table: NATTable, Chain: dispatchChain, Status: c.dispatchRuleStatus, Expected: dispatchRules})
+	}
+
+	if c.hairpinningCIDR != "" {
+		chains = append(chains, managedChain{Table: NATTable, Chain: c.hairpinningChainName, Status: c.hairpinningRuleStatus, Expected: desired.hairpinningRules})
+	}
+
+	return chains
+}
+
+// getDispatchRules returns the main (and output) chain entries of all loadbalancers with created chains.
+func (c *Controller) getDispatchRules(actual *actualState) []Rule {
+	rules := make([]Rule, 0)
+
+	for _, lbKey := range c.sortedLoadbalancerKeys() {
+		lb := c.loadbalancers[lbKey]
+
+		createdChains := actual.chainIDsForLoadbalancer(lb.ID(c.instanceTag), ChainCreated)
+		if len(createdChains) == 0 {
+			continue
+		}
+
+		rules = append(rules, c.getMainChainRulesToChain(lb, c.getActiveChainID(lb, createdChains))...)
+	}
+
+	return rules
+}
+
+// dispatchRuleStatus checks whether the rule jumps to a chain of the instance and matches the input of its lb. Rules
+// jumping into the chain of a lb with aliases match one of its inputs, which can only be checked while the lb is
+// configured. Rules into chains of other lbs with aliases are known in case they look like the ones of the controller.
+func (c *Controller) dispatchRuleStatus(rule Rule) ruleStatus {
+	chainID, err := rule.JumpChainID()
+	if err != nil || chainID.InstanceTag != c.instanceTag {
+		return ruleUnknown
+	}
+
+	input, ok := loadbalancerForInputRule(rule)
+	if !ok {
+		return ruleUnknown
+	}
+
+	if input.ID(c.instanceTag) == chainID.LoadbalancerID {
+		return getRuleStatus(rule, c.getMainChainRulesToChain(*input, chainID)[0])
+	}
+
+	for _, lb := range c.loadbalancers {
+		if lb.ID(c.instanceTag) != chainID.LoadbalancerID {
+			continue
+		}
+
+		status := ruleUnknown
+		for _, expected := range c.getMainChainRulesToChain(lb, chainID) {
+			switch getRuleStatus(rule, expected) {
+			case ruleKnown:
+				return ruleKnown
+			case ruleOutdated:
+				status = ruleOutdated
+			}
+		}
+
+		return status
+	}
+
+	// The comment contains the key of the lb, which can't be derived from the rule
+	return getRuleStatus(rule.withoutComment(), c.getMainChainRulesToChain(*input, chainID)[0].withoutComment())
+}
+
+// forwardRuleStatus checks whether the rule accepts traffic from or to an endpoint or drops rejected traffic like the
+// controller does.
+func (c *Controller) forwardRuleStatus(rule Rule) ruleStatus {
+	if status := getRuleStatus(rule, c.getRejectRule()); status != ruleUnknown {
+		return status
+	}
+
+	endpoint, err := rule.ForwardEndpoint()
+	if err != nil {
+		return ruleUnknown
+	}
+
+	expected := c.getDstForwardRuleForEndpointAndProt(endpoint, rule.DestinationPorts, rule.Protocol)
+	if rule.Source != nil {
+		expected = c.getSrcForwardRuleForEndpointAndProt(endpoint, rule.SourcePorts, rule.Protocol)
+	}
+
+	return getRuleStatus(rule, expected)
+}
+
+// inputRuleStatus checks whether the rule drops rejected traffic like the controller does.
+func (c *Controller) inputRuleStatus(rule Rule) ruleStatus {
+	return getRuleStatus(rule, c.getRejectRule())
+}
+
+// hairpinningRuleStatus checks whether the rule masquerades traffic to an endpoint like the controller does.
+func (c *Controller) hairpinningRuleStatus(rule Rule) ruleStatus {
+	if rule.Destination == nil {
+		return ruleUnknown
+	}
+
+	expected, err := c.getHairpinningRuleForEndpoint(NewEndpoint(rule.Destination.IP, rule.DestinationPort), rule.DestinationPorts, rule.Protocol)
+	if err != nil {
+		return ruleUnknown
+	}
+
+	return getRuleStatus(rule, expected)
+}
+
+// planDrift detects rules in the managed chains the controller didn't create, which get reported and, if enabled,
+// removed. Rules of the controller with an outdated comment always get removed, their replacement got added already.
+// Afterwards the rules of the controller get moved back into the expected order. Obsolete rules get deleted by their
+// spec, but moves address positions, so every change is simulated on a copy of the chain to get them right.
+func (c *Controller) planDrift(actual *actualState, desired *desiredState) []Change {
+	changes := make([]Change, 0)
+
+	for _, chain := range c.getManagedChains(actual, desired) {
+		if !actual.hasChain(chain.Table, chain.Chain) {
+			continue
+		}
+
+		rules := make([]Rule, len(actual.rules[chain.Table][chain.Chain]))
+		copy(rules, actual.rules[chain.Table][chain.Chain])
+
+		// Unknown, duplicated and outdated rules
+		unknownCount := 0
+		removals := make([]int, 0)
+		reasons := make(map[int]string)
+		for i, rule := range rules {
+			status := chain.Status(rule)
+
+			if status == ruleOutdated {
+				removals = append(removals, i)
+				reasons[i] = "outdated comment"
+				continue
+			}
+
+			if status == ruleUnknown || RulesContain(rules[:i], rule) {
+				unknownCount++
+				glog.Warningf("found unknown rule `%s` at position %d in managed chain `%s` of table `%s`", rule.String(), i+1, chain.Chain, chain.Table)
+
+				if c.removeUnknownRules {
+					removals = append(removals, i)
+					reasons[i] = "unknown rule"
+				}
+			}
+		}
+
+		if c.metrics != nil {
+			c.metrics.UnknownRules.WithLabelValues(chain.Table, chain.Chain).Set(float64(unknownCount))
+		}
+
+		// Deleting by spec removes the first equal rule, which might be another copy of a duplicated one
+		removed := make([]Rule, 0, len(removals))
+		for _, i := range removals {
+			removed = append(removed, rules[i])
+			changes = append(changes, Change{
+				Type:   ChangeDeleteRule,
+				Table:  chain.Table,
+				Chain:  chain.Chain,
+				Rule:   rules[i],
+				Reason: reasons[i],
+				Drift:  true,
+			})
+		}
+
+		for _, rule := range removed {
+			for i := range rules {
+				if rules[i].Equals(rule) {
+					rules = append(rules[:i], rules[i+1:]...)
+					break
+				}
+			}
+		}
+
+		changes = append(changes, c.planRuleOrder(chain, rules)...)
+	}
+
+	return changes
+}
+
+// planRuleOrder plans moving the expected rules in the passed chain into their expected order. Rules not expected
+// stay where they are.
+func (c *Controller) planRuleOrder(chain managedChain, rules []Rule) []Change {
+	changes := make([]Change, 0)
+
+	expected := make([]Rule, 0, len(chain.Expected))
+	for _, rule := range chain.Expected {
+		if RulesContain(rules, rule) {
+			expected = append(expected, rule)
+		}
+	}
+
+	isExpected := func(rule Rule) bool {
+		return RulesContain(expected, rule)
+	}
+
+	for i, wanted := range expected {
+		// position of the i-th expected rule currently in the chain
+		current := -1
+		for pos, seen := 0, 0; pos < len(rules); pos++ {
+			if !isExpected(rules[pos]) {
+				continue
+			}
+
+			if seen == i {
+				current = pos
+				break
+			}
+
+			seen++
+		}
+
+		if current < 0 || rules[current].Equals(wanted) {
+			continue
+		}
+
+		from := -1
+		for pos := current + 1; pos < len(rules); pos++ {
+			if rules[pos].Equals(wanted) {
+				from = pos
+				break
+			}
+		}
+
+		if from < 0 {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Type:        ChangeMoveRule,
+			Table:       chain.Table,
+			Chain:       chain.Chain,
+			Rule:        rules[from],
+			Position:    current + 1,
+			OldPosition: from + 1,
+			Reason:      "rule out of order",
+			Drift:       true,
+		})
+
+		moved := rules[from]
+		rules = append(rules[:from], rules[from+1:]...)
+		rules = append(rules[:current], append([]Rule{moved}, rules[current:]...)...)
+	}
+
+	return changes
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func setupDriftTest(t *testing.T, config ControllerConfig) (*DryRunIPTables, *Controller) {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	assert.NilError(t, err)
+
+	lb1 := NewLoadbalancer(ProtocolTCP, input1, output1)
+	ctrl.loadbalancers[lb1.Key()] = *lb1
+
+	lb2 := NewLoadbalancer(ProtocolTCP, input2, output2)
+	ctrl.loadbalancers[lb2.Key()] = *lb2
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	return ipt, ctrl
+}
+
+func TestUnknownRulesGetReported(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{})
+
+	assert.NilError(t, ipt.Insert(NATTable, ctrl.mainChainName, 1, "-p", "tcp", "--dport", "22", "-j", "ACCEPT"))
+	before, _ := ipt.List(NATTable, ctrl.mainChainName)
+
+	changesBefore := len(ipt.Changes())
+	ctrl.sync()
+
+	assert.Equal(t, ctrl.syncErrors, 0)
+	assert.Equal(t, len(ipt.Changes()), changesBefore)
+
+	after, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.DeepEqual(t, after, before)
+}
+
+func TestUnknownRulesGetRemoved(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{RemoveUnknownRules: true})
+
+	mainBefore, _ := ipt.List(NATTable, ctrl.mainChainName)
+	forwardBefore, _ := ipt.List(FilterTable, ctrl.forwardChainName)
+
+	assert.NilError(t, ipt.Insert(NATTable, ctrl.mainChainName, 1, "-p", "tcp", "--dport", "22", "-j", "ACCEPT"))
+	assert.NilError(t, ipt.Append(NATTable, ctrl.mainChainName, "-p", "tcp", "-d", "10.50.3.1", "--dport", "1234", "-j", "ACCEPT"))
+	assert.NilError(t, ipt.Insert(FilterTable, ctrl.forwardChainName, 2, "-j", "DROP"))
+
+	// duplicate of a managed rule
+	assert.NilError(t, ipt.Append(FilterTable, ctrl.forwardChainName, listedRuleArgs(forwardBefore[1])...))
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	mainAfter, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.DeepEqual(t, mainAfter, mainBefore)
+
+	forwardAfter, _ := ipt.List(FilterTable, ctrl.forwardChainName)
+	assert.DeepEqual(t, forwardAfter, forwardBefore)
+}
+
+func TestRuleOrderGetsEnforced(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{})
+
+	before, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.Equal(t, len(before), 3)
+
+	// move the first entry to the end and add a foreign rule at the top
+	assert.NilError(t, ipt.Append(NATTable, ctrl.mainChainName, listedRuleArgs(before[1])...))
+	assert.NilError(t, ipt.Delete(NATTable, ctrl.mainChainName, "1"))
+	assert.NilError(t, ipt.Insert(NATTable, ctrl.mainChainName, 1, "-j", "RETURN"))
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	after, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.DeepEqual(t, after, []string{before[0], "-A " + ctrl.mainChainName + " -j RETURN", before[1], before[2]})
+}
+
+func TestDriftChangesDontHitRulesAddedMeanwhile(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{RemoveUnknownRules: true})
+
+	before, _ := ipt.List(NATTable, ctrl.mainChainName)
+
+	// out of order, plus an unknown rule
+	assert.NilError(t, ipt.Append(NATTable, ctrl.mainChainName, listedRuleArgs(before[1])...))
+	assert.NilError(t, ipt.Delete(NATTable, ctrl.mainChainName, "1"))
+	assert.NilError(t, ipt.Append(NATTable, ctrl.mainChainName, "-j", "RETURN"))
+
+	actual, err := ctrl.readActualState()
+	assert.NilError(t, err)
+
+	changes := ctrl.planDrift(actual, ctrl.desiredState())
+	assert.Equal(t, len(changes), 2)
+
+	// another tool inserts a rule between planning and applying
+	assert.NilError(t, ipt.Insert(NATTable, ctrl.mainChainName, 1, "-p", "tcp", "--dport", "22", "-j", "ACCEPT"))
+
+	assert.Equal(t, changes[0].Type, ChangeDeleteRule)
+	assert.NilError(t, ctrl.applyChange(changes[0]))
+
+	assert.Equal(t, changes[1].Type, ChangeMoveRule)
+	assert.ErrorContains(t, ctrl.applyChange(changes[1]), "instead of")
+
+	after, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.DeepEqual(t, after, []string{
+		before[0],
+		before[1],
+		"-A " + ctrl.mainChainName + " -p tcp --dport 22 -j ACCEPT",
+		before[2],
+		before[1],
+	})
+}
+
+func TestPositionsAfterFailedChangeGetSkipped(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{})
+
+	before, _ := ipt.List(NATTable, ctrl.mainChainName)
+
+	ctrl.applyPlanners(func(actual *actualState, desired *desiredState) []Change {
+		return []Change{
+			{Type: ChangeDeleteRule, Table: NATTable, Chain: ctrl.mainChainName, Rule: Rule{Jump: "RETURN"}, Position: 5},
+			{Type: ChangeInsertRule, Table: NATTable, Chain: ctrl.mainChainName, Rule: Rule{Jump: "RETURN"}, Position: 1},
+			{Type: ChangeAppendRule, Table: NATTable, Chain: ctrl.mainChainName, Rule: Rule{Jump: "ACCEPT"}},
+		}
+	})
+
+	assert.Equal(t, ctrl.syncErrors, 1)
+
+	after, _ := ipt.List(NATTable, ctrl.mainChainName)
+	assert.DeepEqual(t, after, append(before, "-A "+ctrl.mainChainName+" -j ACCEPT"))
+}
+
+// listedRuleArgs returns the arguments of a rule as listed by iptables
+func listedRuleArgs(listed string) []string {
+	rule, _ := TryParseRule(listed)
+	return rule.Args()
+}
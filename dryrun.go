@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DryRunIPTables simulates iptables in memory. The state of every table gets copied from the base on first access,
+// afterwards all modifications only happen in memory and are recorded as iptables commands, see Changes().
+type DryRunIPTables struct {
+	base    IPTables
+	tables  map[string]*dryRunTable
+	changes []string
+}
+
+type dryRunTable struct {
+	chains []string
+	rules  map[string][]string
+}
+
+// NewDryRunIPTables creates a new simulation on top of the passed base. If base is nil, all tables start empty.
+func NewDryRunIPTables(base IPTables) *DryRunIPTables {
+	return &DryRunIPTables{
+		base:    base,
+		tables:  make(map[string]*dryRunTable),
+		changes: make([]string, 0),
+	}
+}
+
+// Changes returns all modifications done so far as iptables commands.
+func (d *DryRunIPTables) Changes() []string {
+	return d.changes
+}
+
+func (d *DryRunIPTables) record(table string, args ...string) {
+	d.changes = append(d.changes, fmt.Sprintf("iptables -t %s %s", table, formatRuleSpec(args)))
+}
+
+func (d *DryRunIPTables) table(table string) (*dryRunTable, error) {
+	t, found := d.tables[table]
+	if found {
+		return t, nil
+	}
+
+	t = &dryRunTable{
+		chains: make([]string, 0),
+		rules:  make(map[string][]string),
+	}
+
+	if d.base != nil {
+		chains, err := d.base.ListChains(table)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list chains of table `%s`, see: %v", table, err)
+		}
+
+		for _, chain := range chains {
+			rules, err := d.base.List(table, chain)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't list rules of chain `%s` in table `%s`, see: %v", chain, table, err)
+			}
+
+			t.chains = append(t.chains, chain)
+			t.rules[chain] = make([]string, 0)
+
+			for _, rule := range rules {
+				if strings.HasPrefix(rule, "-A ") {
+					t.rules[chain] = append(t.rules[chain], rule)
+				}
+			}
+		}
+	}
+
+	d.tables[table] = t
+
+	return t, nil
+}
+
+func (d *DryRunIPTables) chain(table, chain string) (*dryRunTable, error) {
+	t, err := d.table(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found := t.rules[chain]; !found {
+		return nil, fmt.Errorf("chain `%s` doesn't exist in table `%s`", chain, table)
+	}
+
+	return t, nil
+}
+
+// ListChains lists all chains of the passed table.
+func (d *DryRunIPTables) ListChains(table string) ([]string, error) {
+	t, err := d.table(table)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := make([]string, len(t.chains))
+	copy(chains, t.chains)
+
+	return chains, nil
+}
+
+// List lists all rules of the passed chain in the same format as `iptables -S` does.
+func (d *DryRunIPTables) List(table, chain string) ([]string, error) {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []string{"-N " + chain}
+	rules = append(rules, t.rules[chain]...)
+
+	return rules, nil
+}
+
+// Exists checks whether the passed rule exists in the chain.
+func (d *DryRunIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return false, err
+	}
+
+	return indexOfRule(t.rules[chain], rulespec) >= 0, nil
+}
+
+// NewChain creates a new chain, it's an error if the chain exists already.
+func (d *DryRunIPTables) NewChain(table, chain string) error {
+	t, err := d.table(table)
+	if err != nil {
+		return err
+	}
+
+	if _, found := t.rules[chain]; found {
+		return fmt.Errorf("chain `%s` already exists in table `%s`", chain, table)
+	}
+
+	t.chains = append(t.chains, chain)
+	t.rules[chain] = make([]string, 0)
+	d.record(table, "-N", chain)
+
+	return nil
+}
+
+// ClearChain flushes the passed chain or creates it if it doesn't exist yet.
+func (d *DryRunIPTables) ClearChain(table, chain string) error {
+	t, err := d.table(table)
+	if err != nil {
+		return err
+	}
+
+	if _, found := t.rules[chain]; !found {
+		return d.NewChain(table, chain)
+	}
+
+	if len(t.rules[chain]) == 0 {
+		return nil
+	}
+
+	t.rules[chain] = make([]string, 0)
+	d.record(table, "-F", chain)
+
+	return nil
+}
+
+// RenameChain renames the passed chain.
+func (d *DryRunIPTables) RenameChain(table, oldChain, newChain string) error {
+	t, err := d.chain(table, oldChain)
+	if err != nil {
+		return err
+	}
+
+	if _, found := t.rules[newChain]; found {
+		return fmt.Errorf("chain `%s` already exists in table `%s`", newChain, table)
+	}
+
+	for i, chain := range t.chains {
+		if chain == oldChain {
+			t.chains[i] = newChain
+		}
+	}
+
+	rules := make([]string, 0, len(t.rules[oldChain]))
+	for _, rule := range t.rules[oldChain] {
+		rules = append(rules, "-A "+newChain+strings.TrimPrefix(rule, "-A "+oldChain))
+	}
+
+	delete(t.rules, oldChain)
+	t.rules[newChain] = rules
+	d.record(table, "-E", oldChain, newChain)
+
+	return nil
+}
+
+// DeleteChain deletes the passed (empty) chain.
+func (d *DryRunIPTables) DeleteChain(table, chain string) error {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return err
+	}
+
+	if len(t.rules[chain]) > 0 {
+		return fmt.Errorf("chain `%s` in table `%s` isn't empty", chain, table)
+	}
+
+	for i, c := range t.chains {
+		if c == chain {
+			t.chains = append(t.chains[:i], t.chains[i+1:]...)
+			break
+		}
+	}
+
+	delete(t.rules, chain)
+	d.record(table, "-X", chain)
+
+	return nil
+}
+
+// Append appends the passed rule to the chain.
+func (d *DryRunIPTables) Append(table, chain string, rulespec ...string) error {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return err
+	}
+
+	rule := "-A " + chain + " " + formatRuleSpec(rulespec)
+	t.rules[chain] = append(t.rules[chain], rule)
+	d.record(table, append([]string{"-A", chain}, rulespec...)...)
+
+	return nil
+}
+
+// Insert inserts the passed rule at the (1-based) position into the chain.
+func (d *DryRunIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return err
+	}
+
+	rules := t.rules[chain]
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("index %d of insertion into chain `%s` in table `%s` is out of range", pos, chain, table)
+	}
+
+	rule := "-A " + chain + " " + formatRuleSpec(rulespec)
+
+	newRules := make([]string, 0, len(rules)+1)
+	newRules = append(newRules, rules[:pos-1]...)
+	newRules = append(newRules, rule)
+	newRules = append(newRules, rules[pos-1:]...)
+
+	t.rules[chain] = newRules
+	d.record(table, append([]string{"-I", chain, fmt.Sprintf("%d", pos)}, rulespec...)...)
+
+	return nil
+}
+
+// Delete deletes the first rule in the chain matching the passed rule. A single number as rule deletes the rule at
+// this (1-based) position.
+func (d *DryRunIPTables) Delete(table, chain string, rulespec ...string) error {
+	t, err := d.chain(table, chain)
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	if len(rulespec) == 1 {
+		if pos, err := strconv.Atoi(rulespec[0]); err == nil {
+			if pos < 1 || pos > len(t.rules[chain]) {
+				return fmt.Errorf("index %d of deletion from chain `%s` in table `%s` is out of range", pos, chain, table)
+			}
+
+			idx = pos - 1
+		}
+	}
+
+	if idx < 0 {
+		idx = indexOfRule(t.rules[chain], rulespec)
+	}
+
+	if idx < 0 {
+		return fmt.Errorf("rule `%s` doesn't exist in chain `%s` of table `%s`", formatRuleSpec(rulespec), chain, table)
+	}
+
+	t.rules[chain] = append(t.rules[chain][:idx], t.rules[chain][idx+1:]...)
+	d.record(table, append([]string{"-D", chain}, rulespec...)...)
+
+	return nil
+}
+
+func indexOfRule(rules []string, rulespec []string) int {
+	wanted := normalizeRuleSpec(rulespec)
+
+	for i, rule := range rules {
+		// Skip "-A <chain>"
+		args, err := splitRuleSpec(rule)
+		if err != nil || len(args) < 2 {
+			continue
+		}
+
+		if normalizeRuleSpec(args[2:]) == wanted {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// normalizeRuleSpec brings the passed rule into a canonical form, since iptables reorders arguments, adds implicit
+// matches (e.g. "-m tcp") and netmasks when listing rules.
+func normalizeRuleSpec(rulespec []string) string {
+	options := make([]string, 0)
+	protocol := ""
+
+	for i := 0; i < len(rulespec); i++ {
+		option := rulespec[i]
+		values := make([]string, 0)
+
+		for i+1 < len(rulespec) && !strings.HasPrefix(rulespec[i+1], "-") {
+			i++
+			values = append(values, rulespec[i])
+		}
+
+		if option == "-p" && len(values) == 1 {
+			protocol = values[0]
+		}
+
+		if (option == "-s" || option == "-d") && len(values) == 1 {
+			values[0] = strings.TrimSuffix(values[0], "/32")
+		}
+
+		options = append(options, strings.TrimSpace(option+" "+strings.Join(values, " ")))
+	}
+
+	normalized := make([]string, 0, len(options))
+	for _, option := range options {
+		if protocol != "" && option == "-m "+protocol {
+			continue
+		}
+
+		normalized = append(normalized, option)
+	}
+
+	sort.Strings(normalized)
+
+	return strings.Join(normalized, " ")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// ExportFormatIPTables renders the rules as input for `iptables-restore --noflush`.
+	ExportFormatIPTables = "iptables-restore"
+
+	// ExportFormatNFT renders the rules as script for `nft -f`.
+	ExportFormatNFT = "nft"
+)
+
+// exportChain contains a managed chain with all its rules.
+type exportChain struct {
+	Name  string
+	Rules []Rule
+}
+
+// exportTable contains the managed chains and the jumps into them of a single table.
+type exportTable struct {
+	Name   string
+	Chains []exportChain
+	Jumps  []builtinJump
+
+	// JumpIndex is the 1-based position the jumps get inserted at, 0 means append
+	JumpIndex int
+}
+
+// Export renders all rules wanted for the passed loadbalancers in the passed format. The rules get calculated by a
+// sync against an empty iptables simulation, so they're exactly the ones the controller creates. All loadbalancer
+// chains get the first generation, which makes the output deterministic.
+func Export(w io.Writer, config ControllerConfig, loadbalancers []*Loadbalancer, format string) error {
+	if format != ExportFormatIPTables && format != ExportFormatNFT {
+		return fmt.Errorf("unknown export format `%s`, available: %s, %s", format, ExportFormatIPTables, ExportFormatNFT)
+	}
+
+	if config.JumpPosition.Before != "" || config.JumpPosition.After != "" {
+		return fmt.Errorf("jump position `%s` can't be exported, only positions and append are supported", config.JumpPosition.String())
+	}
+
+	tables, err := getExportTables(config, loadbalancers)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{"# generated by iptableslb export"}
+
+	if format == ExportFormatIPTables {
+		lines = append(lines, renderIPTablesRestore(tables)...)
+	} else {
+		nftLines, err := renderNFT(tables)
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, nftLines...)
+	}
+
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+
+	return err
+}
+
+func getExportTables(config ControllerConfig, loadbalancers []*Loadbalancer) ([]exportTable, error) {
+	// The built-in chains don't exist in the simulation, the jumps get rendered separately
+	syncConfig := config
+	syncConfig.InstallJumps = false
+
+	ipt := NewDryRunIPTables(nil)
+
+	ctrl, err := NewControllerWithIPTables(ipt, syncConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lb := range loadbalancers {
+		for _, lb := range lb.PerProtocol() {
+			if !lb.hasOutputs() {
+				continue
+			}
+
+			exported := *lb
+			exported.MarkUpdated()
+			ctrl.loadbalancers[lb.Key()] = exported
+		}
+	}
+
+	ctrl.sync()
+
+	if ctrl.syncErrors > 0 {
+		return nil, fmt.Errorf("%d errors happened while calculating the rules, see logs for details", ctrl.syncErrors)
+	}
+
+	// The controller used for syncing doesn't know about the jumps, the one into the input chain depends on the lbs
+	jumpCtrl, err := NewControllerWithIPTables(ipt, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	jumpCtrl.loadbalancers = ctrl.loadbalancers
+
+	tables := []exportTable{{Name: FilterTable}, {Name: NATTable}}
+
+	for i := range tables {
+		chains, err := ipt.ListChains(tables[i].Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// The managed chains first, followed by the loadbalancer chains
+		sort.SliceStable(chains, func(a, b int) bool {
+			_, errA := TryParseChainID(chains[a])
+			_, errB := TryParseChainID(chains[b])
+			if (errA == nil) != (errB == nil) {
+				return errA != nil
+			}
+
+			return chains[a] < chains[b]
+		})
+
+		for _, chain := range chains {
+			rawRules, err := ipt.List(tables[i].Name, chain)
+			if err != nil {
+				return nil, err
+			}
+
+			exported := exportChain{Name: chain, Rules: make([]Rule, 0, len(rawRules))}
+			for _, rawRule := range rawRules {
+				if !strings.HasPrefix(rawRule, "-A ") {
+					continue
+				}
+
+				rule, err := TryParseRule(rawRule)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse rule `%s` in chain `%s`, see: %v", rawRule, chain, err)
+				}
+
+				exported.Rules = append(exported.Rules, rule)
+			}
+
+			tables[i].Chains = append(tables[i].Chains, exported)
+		}
+
+		tables[i].JumpIndex = config.JumpPosition.Index
+
+		for _, jump := range jumpCtrl.getBuiltinJumps() {
+			if jump.Table == tables[i].Name && jump.Enabled {
+				tables[i].Jumps = append(tables[i].Jumps, jump)
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+// renderIPTablesRestore renders the tables for `iptables-restore --noflush`, which flushes the declared managed chains
+// but keeps the built-in ones.
+func renderIPTablesRestore(tables []exportTable) []string {
+	lines := make([]string, 0)
+
+	for _, table := range tables {
+		lines = append(lines, "*"+table.Name)
+
+		for _, chain := range table.Chains {
+			lines = append(lines, ":"+chain.Name+" - [0:0]")
+		}
+
+		for _, chain := range table.Chains {
+			for _, rule := range chain.Rules {
+				lines = append(lines, "-A "+chain.Name+" "+rule.String())
+			}
+		}
+
+		for _, jump := range table.Jumps {
+			if table.JumpIndex > 0 {
+				lines = append(lines, fmt.Sprintf("-I %s %d %s", jump.Chain, table.JumpIndex, jump.Rule().String()))
+			} else {
+				lines = append(lines, "-A "+jump.Chain+" "+jump.Rule().String())
+			}
+		}
+
+		lines = append(lines, "COMMIT")
+	}
+
+	return lines
+}
+
+// renderNFT renders the tables as nft script. The chains get declared and flushed first, so the script can be applied
+// repeatedly and chains can be referenced before they're defined.
+func renderNFT(tables []exportTable) ([]string, error) {
+	lines := make([]string, 0)
+
+	for _, table := range tables {
+		lines = append(lines, "table ip "+table.Name+" {")
+		for _, chain := range table.Chains {
+			lines = append(lines, "\tchain "+nftQuote(chain.Name)+" {", "\t}")
+		}
+		lines = append(lines, "}")
+
+		for _, chain := range table.Chains {
+			lines = append(lines, fmt.Sprintf("flush chain ip %s %s", table.Name, nftQuote(chain.Name)))
+		}
+
+		lines = append(lines, "table ip "+table.Name+" {")
+		for _, chain := range table.Chains {
+			lines = append(lines, "\tchain "+nftQuote(chain.Name)+" {")
+
+			for _, rule := range chain.Rules {
+				nftRule, err := toNFTRule(rule)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't translate rule `%s` of chain `%s`, see: %v", rule.String(), chain.Name, err)
+				}
+
+				lines = append(lines, "\t\t"+nftRule)
+			}
+
+			lines = append(lines, "\t}")
+		}
+		lines = append(lines, "}")
+
+		for _, jump := range table.Jumps {
+			if table.JumpIndex > 0 {
+				// nft inserts relative to rule handles, position 1 is the only one which doesn't need one
+				if table.JumpIndex != 1 {
+					return nil, fmt.Errorf("jump position %d can't be exported for nft, only 1 and append are supported", table.JumpIndex)
+				}
+
+				lines = append(lines, fmt.Sprintf("insert rule ip %s %s jump %s", table.Name, jump.Chain, nftQuote(jump.Target)))
+			} else {
+				lines = append(lines, fmt.Sprintf("add rule ip %s %s jump %s", table.Name, jump.Chain, nftQuote(jump.Target)))
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// toNFTRule translates a rule created by the controller into nft syntax.
+func toNFTRule(rule Rule) (string, error) {
+	if len(rule.Unknown) > 0 {
+		return "", fmt.Errorf("arguments `%s` can't be translated", strings.Join(rule.Unknown, " "))
+	}
+
+	parts := make([]string, 0)
+
+	if rule.Source != nil {
+		parts = append(parts, "ip saddr "+formatIPNet(rule.Source))
+	}
+
+	if rule.Destination != nil {
+		parts = append(parts, "ip daddr "+formatIPNet(rule.Destination))
+	}
+
+	if rule.DestinationLocal {
+		parts = append(parts, "fib daddr type local")
+	}
+
+	if rule.InInterface != "" {
+		// iptables uses `+` as wildcard suffix of interface names, nft `*`
+		parts = append(parts, "iifname "+strconv.Quote(strings.Replace(rule.InInterface, "+", "*", 1)))
+	}
+
+	sourcePorts := nftPorts(rule.SourcePort, rule.SourcePorts)
+	destinationPorts := nftPorts(rule.DestinationPort, rule.DestinationPorts)
+
+	if (sourcePorts != "" || destinationPorts != "") && rule.Protocol == ProtocolUNK {
+		return "", fmt.Errorf("ports require a protocol")
+	}
+
+	if sourcePorts != "" {
+		parts = append(parts, rule.Protocol.String()+" sport "+sourcePorts)
+	}
+
+	if destinationPorts != "" {
+		parts = append(parts, rule.Protocol.String()+" dport "+destinationPorts)
+	}
+
+	if rule.Protocol != ProtocolUNK && sourcePorts == "" && destinationPorts == "" {
+		parts = append(parts, "meta l4proto "+rule.Protocol.String())
+	}
+
+	if rule.Nth != 0 {
+		parts = append(parts, fmt.Sprintf("numgen inc mod %d 0", rule.Nth))
+	}
+
+	if rule.Mark != nil && rule.Mark.Mask == ^uint32(0) {
+		parts = append(parts, fmt.Sprintf("meta mark 0x%x", rule.Mark.Value))
+	} else if rule.Mark != nil {
+		parts = append(parts, fmt.Sprintf("meta mark and 0x%x == 0x%x", rule.Mark.Mask, rule.Mark.Value))
+	}
+
+	parts = append(parts, "counter")
+
+	switch {
+	case rule.Jump == "DNAT" && rule.ToDestination != nil && rule.ToBasePort != 0:
+		// nft doesn't know port shifting like iptables
+		return "", fmt.Errorf("DNAT to `%s` shifts the ports, which can't be translated", rule.dnatTarget())
+	case rule.Jump == "DNAT" && rule.ToDestination != nil:
+		parts = append(parts, "dnat to "+rule.dnatTarget())
+	case rule.Jump == "MARK" && rule.SetMark != nil:
+		// --set-xmark clears the bits of the mask and xors the value
+		mark := fmt.Sprintf("meta mark set meta mark and 0x%x", ^rule.SetMark.Mask)
+		if rule.SetMark.Value != 0 {
+			mark += fmt.Sprintf(" xor 0x%x", rule.SetMark.Value)
+		}
+
+		parts = append(parts, mark)
+	case rule.Jump == "MASQUERADE":
+		parts = append(parts, "masquerade")
+	case rule.Jump == "ACCEPT" || rule.Jump == "DROP" || rule.Jump == "RETURN":
+		parts = append(parts, strings.ToLower(rule.Jump))
+	case rule.Jump != "":
+		parts = append(parts, "jump "+nftQuote(rule.Jump))
+	}
+
+	if rule.Comment != "" {
+		parts = append(parts, "comment "+nftQuote(rule.Comment))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// nftPorts formats a port match, e.g. "80", "10000-10100" or "{ 21, 30000-30100 }". It returns an empty string if no
+// port gets matched.
+func nftPorts(port uint16, ports PortSet) string {
+	switch {
+	case port != 0:
+		return strconv.Itoa(int(port))
+	case len(ports) == 1:
+		return ports.String()
+	case len(ports) > 1:
+		return "{ " + strings.Replace(ports.String(), ",", ", ", -1) + " }"
+	default:
+		return ""
+	}
+}
+
+// nftQuote quotes the passed identifier or string, so characters like $ don't get interpreted by nft.
+func nftQuote(str string) string {
+	return strconv.Quote(str)
+}
+
+func export(config ControllerConfig, loadbalancers []*Loadbalancer, format string) int {
+	err := Export(os.Stdout, config, loadbalancers, format)
+	if err != nil {
+		glog.Errorf("couldn't export rules, see: %v", err)
+		return PlanExitFailed
+	}
+
+	return PlanExitUpToDate
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func getExportTestLoadbalancers(t *testing.T) []*Loadbalancer {
+	input1, _ := TryParseEndpoint("10.50.1.1:1234")
+	input2, _ := TryParseEndpoint("10.50.2.1:53")
+	outputs1, err := TryParseEndpoints("10.100.0.1-2:1001")
+	assert.NilError(t, err)
+	output2, _ := TryParseEndpoint("10.100.1.1:53")
+
+	return []*Loadbalancer{
+		NewLoadbalancer(ProtocolUDP, input2, output2),
+		NewLoadbalancer(ProtocolTCP, input1, outputs1...),
+	}
+}
+
+func TestExportIPTablesRestore(t *testing.T) {
+	config := ControllerConfig{HairpinningCIDR: "42.42.42.0/24", InstallJumps: true, RuleComments: true}
+
+	out := &bytes.Buffer{}
+	assert.NilError(t, Export(out, config, getExportTestLoadbalancers(t), ExportFormatIPTables))
+
+	// deterministic, regardless of the order of the loadbalancers
+	lbs := getExportTestLoadbalancers(t)
+	reversed := &bytes.Buffer{}
+	assert.NilError(t, Export(reversed, config, []*Loadbalancer{lbs[1], lbs[0]}, ExportFormatIPTables))
+	assert.Equal(t, out.String(), reversed.String())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, lines[1], "*filter")
+	assert.Equal(t, lines[2], ":iptableslb-forward - [0:0]")
+	assert.Equal(t, lines[len(lines)-1], "COMMIT")
+
+	// apply the export to a simulation, the controller has nothing left to do afterwards
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(FilterTable, "FORWARD"))
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+	assert.NilError(t, ipt.NewChain(NATTable, "POSTROUTING"))
+
+	table := ""
+	for _, line := range lines[1:] {
+		args, err := splitRuleSpec(line)
+		assert.NilError(t, err)
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, ":"):
+			assert.NilError(t, ipt.NewChain(table, args[0][1:]))
+		case args[0] == "-A":
+			assert.NilError(t, ipt.Append(table, args[1], args[2:]...))
+		}
+	}
+
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	assert.NilError(t, err)
+	for _, lb := range getExportTestLoadbalancers(t) {
+		ctrl.loadbalancers[lb.Key()] = *lb
+	}
+
+	changesBefore := len(ipt.Changes())
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+	assert.DeepEqual(t, ipt.Changes()[changesBefore:], []string{})
+}
+
+func TestExportNFT(t *testing.T) {
+	out := &bytes.Buffer{}
+	assert.NilError(t, Export(out, ControllerConfig{InstallJumps: true, JumpPosition: JumpPosition{Index: 1}}, getExportTestLoadbalancers(t), ExportFormatNFT))
+
+	script := out.String()
+	assert.Assert(t, strings.Contains(script, "flush chain ip nat \"iptableslb-prerouting\""))
+	assert.Assert(t, strings.Contains(script, "ip daddr 10.50.1.1 tcp dport 1234 numgen inc mod 2 0 counter dnat to 10.100.0.2:1001"))
+	assert.Assert(t, strings.Contains(script, "ip daddr 10.50.1.1 tcp dport 1234 counter jump \"LB$"))
+	assert.Assert(t, strings.Contains(script, "ip saddr 10.100.1.1 udp sport 53 counter accept"))
+	assert.Assert(t, strings.Contains(script, "insert rule ip nat PREROUTING jump \"iptableslb-prerouting\""))
+
+	err := Export(out, ControllerConfig{InstallJumps: true, JumpPosition: JumpPosition{Index: 2}}, getExportTestLoadbalancers(t), ExportFormatNFT)
+	assert.Assert(t, err != nil)
+
+	err = Export(out, ControllerConfig{}, getExportTestLoadbalancers(t), "pf")
+	assert.Assert(t, err != nil)
+}
+
+func TestToNFTRule(t *testing.T) {
+	rule, err := TryParseRule("-A x -p tcp -s 42.42.42.0/24 -d 10.0.0.1 --dport 80 -m comment --comment \"iptableslb backend=10.0.0.1:80\" -j MASQUERADE")
+	assert.NilError(t, err)
+
+	nftRule, err := toNFTRule(rule)
+	assert.NilError(t, err)
+	assert.Equal(t, nftRule, "ip saddr 42.42.42.0/24 ip daddr 10.0.0.1 tcp dport 80 counter masquerade comment \"iptableslb backend=10.0.0.1:80\"")
+
+	rule, err = TryParseRule("-A x -p udp -d 10.0.0.1 -m multiport --dports 21,30000:30100 -j DNAT --to-destination 10.100.0.1")
+	assert.NilError(t, err)
+
+	nftRule, err = toNFTRule(rule)
+	assert.NilError(t, err)
+	assert.Equal(t, nftRule, "ip daddr 10.0.0.1 udp dport { 21, 30000-30100 } counter dnat to 10.100.0.1")
+
+	// nft can't shift ports
+	rule, err = TryParseRule("-A x -p udp -d 10.0.0.1 --dport 10000:10100 -j DNAT --to-destination 10.100.0.1:20000-20100/10000")
+	assert.NilError(t, err)
+	_, err = toNFTRule(rule)
+	assert.Assert(t, err != nil)
+
+	rule, err = TryParseRule("-A x -m conntrack --ctstate NEW -j ACCEPT")
+	assert.NilError(t, err)
+	_, err = toNFTRule(rule)
+	assert.Assert(t, err != nil)
+
+	rule, err = TryParseRule("-A x -s 10.0.0.0/8 -j MARK --set-xmark 0x20000/0x20000")
+	assert.NilError(t, err)
+
+	nftRule, err = toNFTRule(rule)
+	assert.NilError(t, err)
+	assert.Equal(t, nftRule, "ip saddr 10.0.0.0/8 counter meta mark set meta mark and 0xfffdffff xor 0x20000")
+
+	rule, err = TryParseRule("-A x -m mark --mark 0x20000/0x20000 -j DROP")
+	assert.NilError(t, err)
+
+	nftRule, err = toNFTRule(rule)
+	assert.NilError(t, err)
+	assert.Equal(t, nftRule, "meta mark and 0x20000 == 0x20000 counter drop")
+
+	rule, err = TryParseRule("-A x -p tcp -i eth+ -m addrtype --dst-type LOCAL --dport 443 -j DNAT --to-destination 10.100.0.1:8443")
+	assert.NilError(t, err)
+
+	nftRule, err = toNFTRule(rule)
+	assert.NilError(t, err)
+	assert.Equal(t, nftRule, "fib daddr type local iifname \"eth*\" tcp dport 443 counter dnat to 10.100.0.1:8443")
+}
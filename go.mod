@@ -1,15 +1,29 @@
 module iptableslb
 
-go 1.12
+go 1.17
 
 require (
 	github.com/NectGmbH/health v0.0.0-20190712123504-e59c70a573e1
 	github.com/coreos/go-iptables v0.4.1
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6 // indirect
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/miekg/dns v1.1.50
 	github.com/pierrec/xxHash v0.1.5
 	github.com/prometheus/client_golang v1.1.0
+	golang.org/x/sys v0.10.0
 	gotest.tools v2.2.0+incompatible
 )
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/google/go-cmp v0.3.0 // indirect
+	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90 // indirect
+	github.com/prometheus/common v0.6.0 // indirect
+	github.com/prometheus/procfs v0.0.3 // indirect
+	golang.org/x/net v0.11.0 // indirect
+)
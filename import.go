@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/golang/glog"
+)
+
+// importedRule is a hand-written rule which is part of an imported loadbalancer.
+type importedRule struct {
+	Chain string
+	Rule  Rule
+
+	// Cascade is set for the DNAT rules in custom chains, which get removed together with their chain
+	Cascade bool
+}
+
+// ImportedLoadbalancer is a loadbalancer built from hand-written DNAT rules.
+type ImportedLoadbalancer struct {
+	Loadbalancer *Loadbalancer
+
+	// Rules contains the DNAT rules and jumps into cascade chains the loadbalancer got built from
+	Rules []importedRule
+
+	// Chains contains the cascade chains which are only used by the loadbalancer
+	Chains []string
+
+	// Warnings contains differences between the hand-written rules and the ones iptableslb creates
+	Warnings []string
+}
+
+// isImportableDNAT checks whether the rule is a plain (optionally nth distributed) DNAT to a single endpoint.
+func isImportableDNAT(rule Rule) bool {
+	return rule.Jump == "DNAT" && rule.ToDestination != nil && rule.ToDestination.Port != 0 && rule.ToPorts == (PortRange{}) &&
+		len(rule.SourcePorts) == 0 && len(rule.DestinationPorts) == 0 && len(rule.Unknown) == 0
+}
+
+// importableMatch checks whether the rule matches a single protocol, destination ip and port, which makes up the
+// input of a loadbalancer.
+func importableMatch(rule Rule) bool {
+	if rule.Protocol == ProtocolUNK || rule.Destination == nil || rule.DestinationPort == 0 || rule.Source != nil || rule.SourcePort != 0 {
+		return false
+	}
+
+	ones, bits := rule.Destination.Mask.Size()
+
+	return ones == bits && rule.InInterface == "" && !rule.DestinationLocal && len(rule.Unknown) == 0
+}
+
+// listForeignNATRules returns the rules of all chains in the nat table except the managed ones, together with the
+// scanned chains in the order iptables lists them.
+func (c *Controller) listForeignNATRules() (map[string][]Rule, []string, error) {
+	chains, err := c.ipt.ListChains(NATTable)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't list chains of table `%s`, see: %v", NATTable, err)
+	}
+
+	rules := make(map[string][]Rule)
+	scannedChains := make([]string, 0, len(chains))
+
+	for _, chain := range chains {
+		if _, err := TryParseChainID(chain); err == nil || stringsContain([]string{c.mainChainName, c.outputChainName, c.hairpinningChainName}, chain) {
+			continue
+		}
+
+		rawRules, err := c.ipt.List(NATTable, chain)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't retrieve rules in chain `%s` of table `%s`, see: %v", chain, NATTable, err)
+		}
+
+		for _, rawRule := range rawRules {
+			if !strings.HasPrefix(rawRule, "-A ") {
+				continue
+			}
+
+			rule, err := TryParseRule(rawRule)
+			if err != nil {
+				return nil, nil, fmt.Errorf("couldn't parse rule `%s` in chain `%s` of table `%s`, see: %v", rawRule, chain, NATTable, err)
+			}
+
+			rules[chain] = append(rules[chain], rule)
+		}
+
+		scannedChains = append(scannedChains, chain)
+	}
+
+	return rules, scannedChains, nil
+}
+
+// FindImports scans the nat table for hand-written DNAT rules and groups them by protocol, destination ip and
+// port into loadbalancers. DNAT rules in custom chains get imported as part of the rule jumping into the chain,
+// e.g. `-p tcp -d 10.0.0.1 --dport 80 -j web` with `web` containing a `statistic nth` cascade. The managed chains of
+// all instances are skipped.
+func (c *Controller) FindImports() ([]ImportedLoadbalancer, error) {
+	rules, scannedChains, err := c.listForeignNATRules()
+	if err != nil {
+		return nil, err
+	}
+
+	// Custom chains consisting of DNAT rules only, those are the targets of cascades
+	cascades := make(map[string]struct{})
+	references := make(map[string]int)
+	for _, chain := range scannedChains {
+		for _, rule := range rules[chain] {
+			references[rule.Jump]++
+		}
+
+		if len(rules[chain]) == 0 {
+			continue
+		}
+
+		cascade := true
+		for _, rule := range rules[chain] {
+			cascade = cascade && isImportableDNAT(rule)
+		}
+
+		if cascade {
+			cascades[chain] = struct{}{}
+		}
+	}
+
+	imports := make([]ImportedLoadbalancer, 0)
+	importsByKey := make(map[string]int)
+	add := func(match Rule, chain string, dnats []Rule) {
+		lb := NewLoadbalancer(match.Protocol, NewEndpoint(match.Destination.IP, match.DestinationPort))
+
+		index, found := importsByKey[lb.Key()]
+		if !found {
+			index = len(imports)
+			importsByKey[lb.Key()] = index
+			imports = append(imports, ImportedLoadbalancer{Loadbalancer: lb})
+		}
+
+		imported := &imports[index]
+		imported.Rules = append(imported.Rules, importedRule{Chain: chain, Rule: match})
+
+		for _, dnat := range dnats {
+			imported.Loadbalancer.Outputs = EndpointsAppendUnique(imported.Loadbalancer.Outputs, *dnat.ToDestination)
+		}
+	}
+
+	for _, chain := range scannedChains {
+		if _, isCascade := cascades[chain]; isCascade {
+			continue
+		}
+
+		for _, rule := range rules[chain] {
+			if !importableMatch(rule) {
+				continue
+			}
+
+			if isImportableDNAT(rule) {
+				add(rule, chain, []Rule{rule})
+				continue
+			}
+
+			if _, isCascade := cascades[rule.Jump]; isCascade && rule.Nth == 0 {
+				add(rule, chain, rules[rule.Jump])
+
+				index := importsByKey[GetLoadbalancerKey(rule.Protocol, NewEndpoint(rule.Destination.IP, rule.DestinationPort))]
+				if references[rule.Jump] == 1 {
+					imports[index].Chains = append(imports[index].Chains, rule.Jump)
+				}
+
+				for _, dnat := range rules[rule.Jump] {
+					imports[index].Rules = append(imports[index].Rules, importedRule{Chain: rule.Jump, Rule: dnat, Cascade: true})
+				}
+			}
+		}
+	}
+
+	for i := range imports {
+		imports[i].Warnings = getImportWarnings(imports[i])
+	}
+
+	return imports, nil
+}
+
+// getImportWarnings compares the distribution of the hand-written DNAT rules with the even one of iptableslb.
+func getImportWarnings(imported ImportedLoadbalancer) []string {
+	warnings := make([]string, 0)
+
+	dnats := make([]Rule, 0)
+	for _, rule := range imported.Rules {
+		if rule.Rule.Jump == "DNAT" {
+			dnats = append(dnats, rule.Rule)
+		}
+	}
+
+	if len(dnats) != len(imported.Loadbalancer.Outputs) {
+		warnings = append(warnings, "contains duplicate backends, they'll only get a single share of traffic")
+	}
+
+	for i, dnat := range dnats {
+		expected := len(dnats) - i
+		if expected == 1 {
+			expected = 0
+		}
+
+		if dnat.Nth != expected {
+			warnings = append(warnings, "traffic isn't distributed evenly, iptableslb distributes it evenly across all backends")
+			break
+		}
+	}
+
+	return warnings
+}
+
+// writeImports writes the passed loadbalancers as config file.
+func writeImports(w io.Writer, imports []ImportedLoadbalancer) error {
+	for _, imported := range imports {
+		health := "none"
+		switch imported.Loadbalancer.Protocol {
+		case ProtocolTCP:
+			health = "tcp"
+		case ProtocolSCTP:
+			health = "sctp"
+		}
+
+		lines := make([]string, 0)
+		for _, warning := range imported.Warnings {
+			lines = append(lines, "# WARNING: "+warning)
+		}
+
+		for _, rule := range imported.Rules {
+			lines = append(lines, fmt.Sprintf("# imported from chain `%s`: %s", rule.Chain, rule.Rule.String()))
+		}
+
+		lines = append(lines, formatConfigLine(imported.Loadbalancer, health), "")
+
+		_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planImportRemoval plans the removal of the hand-written rules of all passed loadbalancers whose managed chains are
+// live, which means the prerouting chain jumps into the managed main chain and it dispatches to a created chain of
+// the loadbalancer.
+func (c *Controller) planImportRemoval(imports []ImportedLoadbalancer) Planner {
+	return func(actual *actualState, desired *desiredState) []Change {
+		changes := make([]Change, 0)
+
+		if !RulesContain(actual.rules[NATTable]["PREROUTING"], Rule{Jump: c.mainChainName}) {
+			glog.Warningf("not removing any imported rules since chain `PREROUTING` doesn't jump to `%s`", c.mainChainName)
+			return changes
+		}
+
+		for _, imported := range imports {
+			live := false
+			for _, rule := range actual.rules[NATTable][c.mainChainName] {
+				chainID, err := rule.JumpChainID()
+				live = live || (err == nil && c.dispatchRuleStatus(rule) != ruleUnknown && chainID.LoadbalancerID == imported.Loadbalancer.ID(c.instanceTag))
+			}
+
+			if !live {
+				glog.Warningf("not removing imported rules of lb `%s` since it isn't managed by iptableslb yet", imported.Loadbalancer.Key())
+				continue
+			}
+
+			reason := fmt.Sprintf("imported as lb `%s`", imported.Loadbalancer.Key())
+
+			for _, rule := range imported.Rules {
+				if rule.Cascade {
+					continue
+				}
+
+				changes = append(changes, Change{Type: ChangeDeleteRule, Table: NATTable, Chain: rule.Chain, Rule: rule.Rule, Reason: reason})
+			}
+
+			for _, chain := range imported.Chains {
+				changes = append(changes, Change{Type: ChangeDeleteChain, Table: NATTable, Chain: chain, Reason: reason})
+			}
+		}
+
+		return changes
+	}
+}
+
+// RemoveImports removes the hand-written rules of all passed loadbalancers whose managed chains are live.
+func (c *Controller) RemoveImports(imports []ImportedLoadbalancer) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.applyPlanners(c.planImportRemoval(imports))
+
+	if c.syncErrors > 0 {
+		return fmt.Errorf("%d errors happened while removing imported rules, see logs for details", c.syncErrors)
+	}
+
+	return nil
+}
+
+// createConfigFile creates the config at the passed path, an existing file only gets overwritten if overwrite is set.
+func createConfigFile(path string, overwrite bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("config `%s` already exists, pass -overwrite-config to replace it", path)
+	}
+
+	return f, err
+}
+
+// importRules writes the loadbalancers found in hand-written DNAT rules as config to the passed path (or stdout if
+// empty) and, if remove is set, removes the hand-written rules of all loadbalancers already managed by iptableslb. An
+// existing config only gets replaced if overwrite is set.
+func importRules(config ControllerConfig, path string, overwrite bool, remove bool, dryRun bool) int {
+	var ipt IPTables
+	ipt, err := iptables.New()
+	if err != nil {
+		glog.Errorf("couldn't init iptables, see: %v", err)
+		return PlanExitFailed
+	}
+
+	var dryRunIPT *DryRunIPTables
+	if dryRun {
+		dryRunIPT = NewDryRunIPTables(ipt)
+		ipt = dryRunIPT
+	}
+
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	if err != nil {
+		glog.Errorf("couldn't init controller, see: %v", err)
+		return PlanExitFailed
+	}
+
+	imports, err := ctrl.FindImports()
+	if err != nil {
+		glog.Errorf("couldn't find rules to import, see: %v", err)
+		return PlanExitFailed
+	}
+
+	if !remove {
+		out := io.Writer(os.Stdout)
+		if path != "" {
+			f, err := createConfigFile(path, overwrite)
+			if err != nil {
+				glog.Errorf("couldn't create config `%s`, see: %v", path, err)
+				return PlanExitFailed
+			}
+			defer f.Close()
+
+			out = f
+		}
+
+		err = writeImports(out, imports)
+		if err != nil {
+			glog.Errorf("couldn't write config, see: %v", err)
+			return PlanExitFailed
+		}
+
+		return PlanExitUpToDate
+	}
+
+	err = ctrl.RemoveImports(imports)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return PlanExitFailed
+	}
+
+	if dryRun {
+		return printChanges(dryRunIPT.Changes())
+	}
+
+	return PlanExitUpToDate
+}
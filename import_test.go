@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func setupImportTest(t *testing.T) *DryRunIPTables {
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(FilterTable, "FORWARD"))
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+	assert.NilError(t, ipt.NewChain(NATTable, "web"))
+
+	for _, rule := range [][]string{
+		// nth cascade directly in PREROUTING
+		{"PREROUTING", "-d", "10.50.1.1/32", "-p", "tcp", "-m", "tcp", "--dport", "80", "-m", "statistic", "--mode", "nth", "--every", "2", "--packet", "0", "-j", "DNAT", "--to-destination", "10.100.0.1:8080"},
+		{"PREROUTING", "-d", "10.50.1.1/32", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "10.100.0.2:8080"},
+		// cascade in a custom chain
+		{"PREROUTING", "-d", "10.50.2.1/32", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "web"},
+		{"web", "-m", "statistic", "--mode", "nth", "--every", "3", "--packet", "0", "-j", "DNAT", "--to-destination", "10.100.1.1:53"},
+		{"web", "-m", "statistic", "--mode", "nth", "--every", "2", "--packet", "0", "-j", "DNAT", "--to-destination", "10.100.1.2:53"},
+		{"web", "-j", "DNAT", "--to-destination", "10.100.1.3:53"},
+		// uneven distribution
+		{"PREROUTING", "-d", "10.50.3.1/32", "-p", "tcp", "-m", "tcp", "--dport", "443", "-m", "statistic", "--mode", "nth", "--every", "4", "--packet", "0", "-j", "DNAT", "--to-destination", "10.100.2.1:443"},
+		{"PREROUTING", "-d", "10.50.3.1/32", "-p", "tcp", "-m", "tcp", "--dport", "443", "-j", "DNAT", "--to-destination", "10.100.2.2:443"},
+		// not importable, matches on more than the input
+		{"PREROUTING", "-s", "192.168.0.0/16", "-d", "10.50.4.1/32", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "DNAT", "--to-destination", "10.100.3.1:22"},
+		{"PREROUTING", "-i", "eth0", "-d", "10.50.4.1/32", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "DNAT", "--to-destination", "10.100.3.1:22"},
+		{"PREROUTING", "-j", "ACCEPT"},
+	} {
+		assert.NilError(t, ipt.Append(NATTable, rule[0], rule[1:]...))
+	}
+
+	return ipt
+}
+
+func TestFindImports(t *testing.T) {
+	ipt := setupImportTest(t)
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	assert.NilError(t, err)
+
+	imports, err := ctrl.FindImports()
+	assert.NilError(t, err)
+	assert.Equal(t, len(imports), 3)
+
+	out := &bytes.Buffer{}
+	assert.NilError(t, writeImports(out, imports))
+
+	config := make([]string, 0)
+	warnings := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "# WARNING") {
+			warnings++
+		}
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			config = append(config, line)
+		}
+	}
+
+	assert.DeepEqual(t, config, []string{
+		"tcp://10.50.1.1:80 10.100.0.1:8080,10.100.0.2:8080 tcp",
+		"udp://10.50.2.1:53 10.100.1.1:53,10.100.1.2:53,10.100.1.3:53 none",
+		"tcp://10.50.3.1:443 10.100.2.1:443,10.100.2.2:443 tcp",
+	})
+	assert.Equal(t, warnings, 1)
+
+	// the written config can be read by the daemon
+	var inFlags, outFlags, healthFlags sliceFlags
+	assert.NilError(t, readConfig(out, &inFlags, &outFlags, &healthFlags))
+
+	definitions, err := parseLoadbalancerFlags(inFlags, outFlags, healthFlags, EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(definitions), 3)
+	assert.Assert(t, EndpointsEqual(definitions[1].Loadbalancer.Outputs, imports[1].Loadbalancer.Outputs))
+}
+
+func TestImportedRulesOnlyGetRemovedOnceLive(t *testing.T) {
+	ipt := setupImportTest(t)
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{InstallJumps: true}, nil)
+	assert.NilError(t, err)
+
+	imports, err := ctrl.FindImports()
+	assert.NilError(t, err)
+
+	// nothing is managed yet
+	before, _ := ipt.List(NATTable, "PREROUTING")
+	assert.NilError(t, ctrl.RemoveImports(imports))
+	after, _ := ipt.List(NATTable, "PREROUTING")
+	assert.DeepEqual(t, after, before)
+
+	// only the first two get managed
+	for _, imported := range imports[:2] {
+		ctrl.loadbalancers[imported.Loadbalancer.Key()] = *imported.Loadbalancer
+	}
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	assert.NilError(t, ctrl.RemoveImports(imports))
+
+	prerouting, _ := ipt.List(NATTable, "PREROUTING")
+	for _, rule := range prerouting {
+		assert.Assert(t, !strings.Contains(rule, "10.50.1.1") && !strings.Contains(rule, "10.50.2.1"), "rule `%s` wasn't removed", rule)
+	}
+
+	assert.Assert(t, strings.Contains(strings.Join(prerouting, "\n"), "10.50.3.1"))
+
+	chains, _ := ipt.ListChains(NATTable)
+	assert.Assert(t, !stringsContain(chains, "web"))
+}
+
+func TestReadConfig(t *testing.T) {
+	var inFlags, outFlags, healthFlags sliceFlags
+
+	err := readConfig(strings.NewReader("# comment\n\ntcp://10.0.0.1:80  10.1.0.1:80,10.1.0.2:80 http\n"), &inFlags, &outFlags, &healthFlags)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, inFlags, sliceFlags{"tcp://10.0.0.1:80"})
+	assert.DeepEqual(t, outFlags, sliceFlags{"10.1.0.1:80,10.1.0.2:80"})
+	assert.DeepEqual(t, healthFlags, sliceFlags{"http"})
+
+	err = readConfig(strings.NewReader("tcp://10.0.0.1:80 10.1.0.1:80\n"), &inFlags, &outFlags, &healthFlags)
+	assert.Assert(t, err != nil)
+}
+
+func TestCreateConfigFileDoesntOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptableslb")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lbs.conf")
+	assert.NilError(t, ioutil.WriteFile(path, []byte("tcp://10.0.0.1:80 10.1.0.1:80 http\n"), 0644))
+
+	_, err = createConfigFile(path, false)
+	assert.ErrorContains(t, err, "already exists")
+
+	content, err := ioutil.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "tcp://10.0.0.1:80 10.1.0.1:80 http\n")
+
+	f, err := createConfigFile(path, true)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+
+	content, err = ioutil.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "")
+
+	f, err = createConfigFile(filepath.Join(dir, "new.conf"), false)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+}
+
+func TestFormatConfigLineWithPools(t *testing.T) {
+	line := "tcp://10.0.0.1:80?allow=10.0.0.0/8 10.1.0.0/16,10.2.0.1=10.1.0.1:80,10.1.0.2:80;10.5.0.0/16=10.1.0.3:80;10.1.0.4:80 none"
+
+	var inFlags, outFlags, healthFlags sliceFlags
+	assert.NilError(t, readConfig(strings.NewReader(line), &inFlags, &outFlags, &healthFlags))
+
+	definition, err := parseLoadbalancerDefinition(inFlags[0], outFlags[0], healthFlags[0], EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(definition.Loadbalancer.Pools), 2)
+	assert.Equal(t, formatConfigLine(definition.Loadbalancer, "none"), line)
+
+	_, err = parseLoadbalancerDefinition("tcp://10.0.0.1:80", "10.1.0.1:80;10.1.0.2:80", "none", EndpointParseOptions{})
+	assert.ErrorContains(t, err, "expected pool in format")
+
+	_, err = parseLoadbalancerDefinition("tcp://10.0.0.1:80", "10.0.0.0/8=10.1.0.1:80", "none", EndpointParseOptions{})
+	assert.ErrorContains(t, err, "outputs for all remaining sources are missing")
+
+	_, err = parseLoadbalancerDefinition("tcp://10.0.0.1:80", "10.0.0.0/8=api.internal:80;10.1.0.1:80", "none", EndpointParseOptions{})
+	assert.ErrorContains(t, err, "aren't supported as outputs of pools")
+
+	// the limit applies to the outputs of all pools together
+	options := EndpointParseOptions{MaxEndpoints: 4}
+	_, err = parseLoadbalancerDefinition("tcp://10.0.0.1:80", "10.0.0.0/8=10.1.0.1-3:80;10.1.0.4-5:80", "none", options)
+	assert.ErrorContains(t, err, "expands to more than 4 endpoints")
+
+	_, err = parseLoadbalancerDefinition("tcp://10.0.0.1:80", "10.0.0.0/8=10.1.0.1-3:80;10.1.0.3-4:80", "none", options)
+	assert.NilError(t, err)
+}
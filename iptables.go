@@ -0,0 +1,16 @@
+package main
+
+// IPTables contains all iptables operations the controller relies on, so it can either work on the real tables
+// (github.com/coreos/go-iptables) or on a simulation of them (see DryRunIPTables).
+type IPTables interface {
+	ListChains(table string) ([]string, error)
+	List(table, chain string) ([]string, error)
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	RenameChain(table, oldChain, newChain string) error
+	DeleteChain(table, chain string) error
+	Append(table, chain string, rulespec ...string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+}
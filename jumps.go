@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// JumpPosition describes where the jumps to the managed chains get installed in the built-in chains.
+type JumpPosition struct {
+	// Index is the 1-based position the jump gets inserted at, 0 means append.
+	Index int
+
+	// Before contains the comment of the rule the jump gets inserted in front of.
+	Before string
+
+	// After contains the comment of the rule the jump gets inserted behind.
+	After string
+}
+
+// TryParseJumpPosition tries to parse a jump position like "append", "1", "before:<comment>" or "after:<comment>".
+func TryParseJumpPosition(str string) (JumpPosition, error) {
+	switch {
+	case str == "" || str == "append":
+		return JumpPosition{}, nil
+	case strings.HasPrefix(str, "before:") && len(str) > len("before:"):
+		return JumpPosition{Before: str[len("before:"):]}, nil
+	case strings.HasPrefix(str, "after:") && len(str) > len("after:"):
+		return JumpPosition{After: str[len("after:"):]}, nil
+	}
+
+	index, err := strconv.Atoi(str)
+	if err != nil || index < 1 {
+		return JumpPosition{}, fmt.Errorf("expected \"append\", a position >= 1, \"before:<comment>\" or \"after:<comment>\" but got `%s`", str)
+	}
+
+	return JumpPosition{Index: index}, nil
+}
+
+func (p JumpPosition) String() string {
+	switch {
+	case p.Before != "":
+		return "before:" + p.Before
+	case p.After != "":
+		return "after:" + p.After
+	case p.Index > 0:
+		return strconv.Itoa(p.Index)
+	default:
+		return "append"
+	}
+}
+
+// insertIndex returns the 1-based index a jump has to be inserted at into a chain with the passed rules, 0 means
+// append. Indexes after the last rule result in appending.
+func (p JumpPosition) insertIndex(rules []Rule) (int, error) {
+	comment := p.Before
+	if comment == "" {
+		comment = p.After
+	}
+
+	if comment == "" {
+		if p.Index > len(rules) {
+			return 0, nil
+		}
+
+		return p.Index, nil
+	}
+
+	for i, rule := range rules {
+		if rule.Comment != comment {
+			continue
+		}
+
+		if p.Before != "" {
+			return i + 1, nil
+		}
+
+		if i+2 > len(rules) {
+			return 0, nil
+		}
+
+		return i + 2, nil
+	}
+
+	return 0, fmt.Errorf("couldn't find rule with comment `%s`", comment)
+}
+
+// builtinJump represents a jump from a built-in chain to a managed chain.
+type builtinJump struct {
+	Table   string
+	Chain   string
+	Target  string
+	Enabled bool
+}
+
+// Rule returns the rule which has to exist in the built-in chain.
+func (j builtinJump) Rule() Rule {
+	return Rule{Jump: j.Target}
+}
+
+func (c *Controller) getBuiltinJumps() []builtinJump {
+	return []builtinJump{
+		{Table: FilterTable, Chain: "FORWARD", Target: c.forwardChainName, Enabled: c.installJumps},
+		{Table: NATTable, Chain: "PREROUTING", Target: c.mainChainName, Enabled: c.installJumps},
+		{Table: NATTable, Chain: "OUTPUT", Target: c.outputChainName, Enabled: c.installJumps && c.localTraffic},
+		{Table: NATTable, Chain: "POSTROUTING", Target: c.hairpinningChainName, Enabled: c.installJumps && c.hairpinningCIDR != ""},
+		{Table: FilterTable, Chain: "INPUT", Target: c.inputChainName, Enabled: c.installJumps && c.hasSourceFilters()},
+	}
+}
+
+// planJumps plans the installation of all missing jumps from the built-in chains to the managed ones.
+func (c *Controller) planJumps(actual *actualState) []Change {
+	changes := make([]Change, 0)
+
+	for _, jump := range c.getBuiltinJumps() {
+		if !jump.Enabled {
+			continue
+		}
+
+		rules := actual.rules[jump.Table][jump.Chain]
+		rule := jump.Rule()
+
+		if RulesContain(rules, rule) {
+			continue
+		}
+
+		index, err := c.jumpPosition.insertIndex(rules)
+		if err != nil {
+			glog.Errorf("couldn't determine position of jump to `%s` in chain `%s`, see: %v", jump.Target, jump.Chain, err)
+			c.countError()
+			continue
+		}
+
+		change := Change{
+			Type:     ChangeAppendRule,
+			Table:    jump.Table,
+			Chain:    jump.Chain,
+			Rule:     rule,
+			Reason:   "jump to managed chain missing",
+			Position: index,
+		}
+
+		if index > 0 {
+			change.Type = ChangeInsertRule
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseJumpPosition(t *testing.T) {
+	for str, expected := range map[string]JumpPosition{
+		"":                JumpPosition{},
+		"append":          JumpPosition{},
+		"3":               JumpPosition{Index: 3},
+		"before:drop all": JumpPosition{Before: "drop all"},
+		"after:allow ssh": JumpPosition{After: "allow ssh"},
+	} {
+		position, err := TryParseJumpPosition(str)
+		assert.NilError(t, err)
+		assert.Equal(t, position, expected)
+	}
+
+	for _, str := range []string{"0", "-1", "first", "before:"} {
+		_, err := TryParseJumpPosition(str)
+		assert.Assert(t, err != nil, "expected error for `%s`", str)
+	}
+}
+
+func TestJumpPositionInsertIndex(t *testing.T) {
+	rules := []Rule{
+		{Comment: "allow ssh", Jump: "ACCEPT"},
+		{Comment: "drop all", Jump: "DROP"},
+	}
+
+	for position, expected := range map[JumpPosition]int{
+		JumpPosition{}:                    0,
+		JumpPosition{Index: 1}:            1,
+		JumpPosition{Index: 3}:            0,
+		JumpPosition{Before: "drop all"}:  2,
+		JumpPosition{After: "allow ssh"}:  2,
+		JumpPosition{After: "drop all"}:   0,
+		JumpPosition{Before: "allow ssh"}: 1,
+	} {
+		index, err := position.insertIndex(rules)
+		assert.NilError(t, err)
+		assert.Equal(t, index, expected, "position %s", position.String())
+	}
+
+	_, err := JumpPosition{Before: "unknown"}.insertIndex(rules)
+	assert.Assert(t, err != nil)
+}
+
+func TestJumpsGetInstalledAndRepaired(t *testing.T) {
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(FilterTable, "FORWARD"))
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+	assert.NilError(t, ipt.NewChain(NATTable, "POSTROUTING"))
+	assert.NilError(t, ipt.Append(FilterTable, "FORWARD", "-m", "comment", "--comment", "drop all", "-j", "DROP"))
+	assert.NilError(t, ipt.Append(NATTable, "PREROUTING", "-j", "ACCEPT"))
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{
+		HairpinningCIDR: "42.42.42.0/24",
+		InstallJumps:    true,
+		JumpPosition:    JumpPosition{Index: 1},
+	}, nil)
+	assert.NilError(t, err)
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	forward, err := ipt.List(FilterTable, "FORWARD")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, forward, []string{
+		"-N FORWARD",
+		"-A FORWARD -j iptableslb-forward",
+		"-A FORWARD -m comment --comment \"drop all\" -j DROP",
+	})
+
+	prerouting, err := ipt.List(NATTable, "PREROUTING")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prerouting, []string{"-N PREROUTING", "-A PREROUTING -j iptableslb-prerouting", "-A PREROUTING -j ACCEPT"})
+
+	postrouting, err := ipt.List(NATTable, "POSTROUTING")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, postrouting, []string{"-N POSTROUTING", "-A POSTROUTING -j iptableslb-hairpinning"})
+
+	// jumps don't get installed twice, but re-added if they disappear
+	assert.NilError(t, ipt.Delete(NATTable, "PREROUTING", "-j", "iptableslb-prerouting"))
+	ctrl.sync()
+	ctrl.sync()
+
+	prerouting, err = ipt.List(NATTable, "PREROUTING")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prerouting, []string{"-N PREROUTING", "-A PREROUTING -j iptableslb-prerouting", "-A PREROUTING -j ACCEPT"})
+}
+
+func TestJumpBeforeMissingCommentIsAnError(t *testing.T) {
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(FilterTable, "FORWARD"))
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{
+		InstallJumps: true,
+		JumpPosition: JumpPosition{Before: "drop all"},
+	}, nil)
+	assert.NilError(t, err)
+
+	ctrl.sync()
+	assert.Assert(t, ctrl.syncErrors > 0)
+
+	forward, err := ipt.List(FilterTable, "FORWARD")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, forward, []string{"-N FORWARD"})
+}
+
+func TestInputJumpOnlyWithSourceFilters(t *testing.T) {
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(FilterTable, "FORWARD"))
+	assert.NilError(t, ipt.NewChain(FilterTable, "INPUT"))
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{InstallJumps: true}, nil)
+	assert.NilError(t, err)
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	input, err := ipt.List(FilterTable, "INPUT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, input, []string{"-N INPUT"})
+
+	definition, err := parseLoadbalancerDefinition("tcp://*:443?deny=10.1.0.0/16", "10.100.0.1:8443", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+	ctrl.loadbalancers[definition.Loadbalancer.Key()] = *definition.Loadbalancer
+
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	input, err = ipt.List(FilterTable, "INPUT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, input, []string{"-N INPUT", "-A INPUT -j iptableslb-input"})
+
+	inputChain, err := ipt.List(FilterTable, "iptableslb-input")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, inputChain, []string{"-N iptableslb-input", "-A iptableslb-input -m mark --mark 0x20000/0x20000 -j DROP"})
+}
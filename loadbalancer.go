@@ -2,17 +2,55 @@ package main
 
 import (
 	"fmt"
-	"time"
+	"net"
+	"strings"
 )
 
 // Loadbalancer represents an mapping between the public endpoint and all target endpoints
 type Loadbalancer struct {
-	LastUpdate uint32
-	Protocol   Protocol
-	Input      Endpoint
-	Outputs    []Endpoint
+	// Generation identifies the chain of the lb, it gets assigned by the controller. 0 means the lb changed and
+	// the controller has to program it.
+	Generation uint32
+
+	Protocol Protocol
+	Input    Endpoint
+	Outputs  []Endpoint
+
+	// InputPorts contains the ports of inputs with multiple ports, the port of the input is the first of them. Outputs
+	// of these lbs either have no port, which keeps the destination port, or the port the first input port gets
+	// mapped to, the other ports keep their distance to it.
+	InputPorts PortSet
+
+	// InputNet contains the destinations of inputs matching a cidr, the ip of the input is its network address then.
+	InputNet *net.IPNet
+
+	// InputAnyLocal marks wildcard inputs (`*`) matching all local addresses, the ip of the input is 0.0.0.0 then.
+	InputAnyLocal bool
+
+	// InputInterface restricts the input to traffic arriving on the interface.
+	InputInterface string
+
+	// Aliases contains further inputs with the same protocol and ports sharing the chain of the lb, only their input
+	// fields are used.
+	Aliases []Loadbalancer
+
+	// Pools contain outputs which only get the traffic of some sources, they're checked in their order. All other
+	// traffic goes to Outputs.
+	Pools []Pool
+
+	// AllowSources restricts the traffic of the lb to the sources within these networks, if set. Traffic of sources
+	// within DenySources gets rejected even if it's allowed.
+	AllowSources []*net.IPNet
+	DenySources  []*net.IPNet
+
+	// Weights contains the relative share of traffic per output, keyed by the output string. Outputs without weight
+	// get 1.
+	Weights map[string]int
 }
 
+// maxOutputWeight limits the number of rules a single output can get in the chain of the lb.
+const maxOutputWeight = 10
+
 // NewLoadbalancer creates a new loadbalancer instance from the passed arguments.
 func NewLoadbalancer(proto Protocol, input Endpoint, outputs ...Endpoint) *Loadbalancer {
 	lb := &Loadbalancer{
@@ -21,24 +59,528 @@ func NewLoadbalancer(proto Protocol, input Endpoint, outputs ...Endpoint) *Loadb
 		Outputs:  outputs,
 	}
 
-	lb.MarkUpdated()
-
 	return lb
 }
 
-// MarkUpdated updated the lastUpdate timer on the lb signalling the controller that it has to update the iptables rules.
+// MarkUpdated resets the generation of the lb signalling the controller that it has to update the iptables rules.
 func (lb *Loadbalancer) MarkUpdated() {
-	lb.LastUpdate = uint32(time.Now().Unix())
+	lb.Generation = 0
+}
+
+// GenerationNewer checks whether generation a is newer than b, respecting wraparounds of the counter.
+func GenerationNewer(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// NextGeneration returns the generation following the passed one, skipping 0 since it's reserved for unprogrammed
+// loadbalancers.
+func NextGeneration(generation uint32) uint32 {
+	generation++
+	if generation == 0 {
+		generation = 1
+	}
+
+	return generation
 }
 
-// Key gets a key identifying the loadbalancer by IP, Port and Protocol
+// Key gets a key identifying the loadbalancer by IP, Port and Protocol, the keys of aliases follow comma separated.
 func (lb *Loadbalancer) Key() string {
-	return GetLoadbalancerKey(lb.Protocol, lb.Input)
+	key := lb.inputKey()
+	for _, alias := range lb.Aliases {
+		key += "," + alias.Key()
+	}
+
+	return key
+}
+
+// InputString returns the input of the lb in the notation of the `-in` parameter, which is its key followed by the
+// source filters, e.g. "tcp://10.0.0.1:443?allow=10.1.0.0/16&deny=10.1.2.0/24".
+func (lb *Loadbalancer) InputString() string {
+	params := make([]string, 0, 2)
+	if len(lb.AllowSources) > 0 {
+		params = append(params, "allow="+formatIPNets(lb.AllowSources))
+	}
+
+	if len(lb.DenySources) > 0 {
+		params = append(params, "deny="+formatIPNets(lb.DenySources))
+	}
+
+	if len(params) == 0 {
+		return lb.Key()
+	}
+
+	return lb.Key() + "?" + strings.Join(params, "&")
+}
+
+// hasSourceFilters checks whether the traffic of some sources gets rejected.
+func (lb *Loadbalancer) hasSourceFilters() bool {
+	return len(lb.AllowSources) > 0 || len(lb.DenySources) > 0
+}
+
+// inputKey returns the key of the input of the lb without its aliases, e.g. "tcp://10.0.0.1:443".
+func (lb *Loadbalancer) inputKey() string {
+	return fmt.Sprintf("%s://%s:%s", lb.Protocol.String(), lb.inputHost(), lb.Ports().String())
+}
+
+// inputs returns loadbalancers without outputs for the input and every alias of the lb.
+func (lb *Loadbalancer) inputs() []*Loadbalancer {
+	inputs := make([]*Loadbalancer, 0, 1+len(lb.Aliases))
+
+	input := newLoadbalancerForInput(lb)
+	input.Aliases = nil
+	inputs = append(inputs, input)
+
+	for i := range lb.Aliases {
+		inputs = append(inputs, newLoadbalancerForInput(&lb.Aliases[i]))
+	}
+
+	return inputs
+}
+
+// inputHost returns the destination part of the input in the notation of the `-in` parameter, e.g. "10.0.0.1", "*"
+// or "10.0.0.0/24%eth1".
+func (lb *Loadbalancer) inputHost() string {
+	host := lb.Input.IP.String()
+	if lb.InputAnyLocal {
+		host = "*"
+	} else if lb.InputNet != nil {
+		host = lb.InputNet.String()
+	}
+
+	if lb.InputInterface != "" {
+		host += "%" + lb.InputInterface
+	}
+
+	return host
+}
+
+// inputDestination returns the destination network of the input, nil for wildcard inputs.
+func (lb *Loadbalancer) inputDestination() *net.IPNet {
+	if lb.InputAnyLocal {
+		return nil
+	} else if lb.InputNet != nil {
+		return lb.InputNet
+	}
+
+	return hostIPNet(lb.Input.IP)
+}
+
+// chainRule returns the match of the DNAT rules in the chain of the lb. Chains shared by aliases only match protocol
+// and ports, the destinations get matched by the rules jumping into them.
+func (lb *Loadbalancer) chainRule() Rule {
+	if len(lb.Aliases) == 0 {
+		return lb.inputRule()
+	}
+
+	rule := Rule{Protocol: lb.Protocol}
+	rule.setDestinationPorts(lb.Ports())
+
+	return rule
+}
+
+// inputRule returns a rule matching the traffic of the input.
+func (lb *Loadbalancer) inputRule() Rule {
+	rule := Rule{
+		Protocol:         lb.Protocol,
+		Destination:      lb.inputDestination(),
+		InInterface:      lb.InputInterface,
+		DestinationLocal: lb.InputAnyLocal,
+	}
+
+	rule.setDestinationPorts(lb.Ports())
+
+	return rule
+}
+
+// loadbalancerForInputRule returns a loadbalancer without outputs whose input matches the same traffic as the passed
+// rule, false if the rule doesn't match an input.
+func loadbalancerForInputRule(rule Rule) (*Loadbalancer, bool) {
+	ports := rule.GetDestinationPorts()
+	if rule.Protocol == ProtocolUNK || len(ports) == 0 || (rule.Destination == nil) == !rule.DestinationLocal {
+		return nil, false
+	}
+
+	lb := NewLoadbalancer(rule.Protocol, NewEndpoint(net.IPv4zero.To4(), ports.First()))
+	lb.InputInterface = rule.InInterface
+	lb.InputAnyLocal = rule.DestinationLocal
+
+	if len(rule.DestinationPorts) > 0 {
+		lb.InputPorts = rule.DestinationPorts
+	}
+
+	if rule.Destination != nil {
+		lb.Input.IP = rule.Destination.IP.To4()
+		if ones, bits := rule.Destination.Mask.Size(); ones != bits {
+			lb.InputNet = rule.Destination
+		}
+	}
+
+	return lb, true
+}
+
+// maxInterfaceNameLength is the maximum length of interface names supported by linux.
+const maxInterfaceNameLength = 15
+
+// TryParseLoadbalancerInput parses the input of a loadbalancer like TryParseInput and returns the loadbalancer
+// without outputs. Instead of an ip the input may contain a wildcard (`*`) matching all local addresses or a cidr,
+// optionally followed by the interface the traffic has to arrive on, e.g. "tcp://*%eth1:443". Further inputs with the
+// same protocol and ports may follow comma separated as aliases, e.g. "tcp://10.0.0.1:443,tcp://10.1.0.1:443". The
+// sources allowed to reach the lb can be restricted by a query, e.g. "tcp://10.0.0.1:443?allow=10.0.0.0/8".
+func TryParseLoadbalancerInput(str string) (*Loadbalancer, error) {
+	query := ""
+	if i := strings.Index(str, "?"); i >= 0 {
+		str, query = str[:i], str[i+1:]
+	}
+
+	inputs := splitInputs(str)
+
+	lb, err := tryParseSingleLoadbalancerInput(inputs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, input := range inputs[1:] {
+		alias, err := tryParseSingleLoadbalancerInput(input)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse alias `%s`, see: %v", input, err)
+		}
+
+		if alias.Protocol != lb.Protocol || alias.Ports().String() != lb.Ports().String() {
+			return nil, fmt.Errorf("alias `%s` doesn't have the same protocol and ports as `%s`", input, inputs[0])
+		}
+
+		lb.Aliases = append(lb.Aliases, *alias)
+	}
+
+	if query != "" {
+		err = parseSourceFilters(lb, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lb, nil
+}
+
+// parseSourceFilters parses source filters like "allow=10.0.0.0/8,192.168.0.0/16&deny=10.1.0.0/16" into the lb.
+func parseSourceFilters(lb *Loadbalancer, query string) error {
+	for _, param := range strings.Split(query, "&") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("expected source filter in format allow=<cidrs> or deny=<cidrs> but got `%s`", param)
+		}
+
+		sources := make([]*net.IPNet, 0)
+		for _, source := range strings.Split(kv[1], ",") {
+			ipNet, err := parseIPNet(source)
+			if err != nil || ipNet.IP.To4() == nil {
+				return fmt.Errorf("couldn't parse source `%s` as ipv4 cidr", source)
+			}
+
+			sources = append(sources, ipNet)
+		}
+
+		switch kv[0] {
+		case "allow":
+			lb.AllowSources = append(lb.AllowSources, sources...)
+		case "deny":
+			lb.DenySources = append(lb.DenySources, sources...)
+		default:
+			return fmt.Errorf("unknown source filter `%s`, use either \"allow\" or \"deny\"", kv[0])
+		}
+	}
+
+	return nil
+}
+
+func formatIPNets(ipNets []*net.IPNet) string {
+	strs := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		strs = append(strs, formatIPNet(ipNet))
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// splitInputs splits comma separated inputs, commas not followed by a scheme separate ports.
+func splitInputs(str string) []string {
+	inputs := make([]string, 0, 1)
+
+	for _, part := range strings.Split(str, ",") {
+		if len(inputs) > 0 && !strings.Contains(part, "://") {
+			inputs[len(inputs)-1] += "," + part
+			continue
+		}
+
+		inputs = append(inputs, part)
+	}
+
+	return inputs
+}
+
+func tryParseSingleLoadbalancerInput(str string) (*Loadbalancer, error) {
+	splitted := strings.Split(str, "//")
+	hostEnd := strings.LastIndex(str, ":")
+	if len(splitted) != 2 || hostEnd < len(splitted[0])+2 {
+		return nil, fmt.Errorf("expected string in format schema://ip:port but got `%s`", str)
+	}
+
+	scheme := splitted[0] + "//"
+	host := str[len(scheme):hostEnd]
+	ports := str[hostEnd+1:]
+
+	iface := ""
+	if i := strings.Index(host, "%"); i >= 0 {
+		host, iface = host[:i], host[i+1:]
+		if iface == "" || len(iface) > maxInterfaceNameLength || strings.ContainsAny(iface, " /:%") {
+			return nil, fmt.Errorf("invalid interface `%s`", iface)
+		}
+	}
+
+	var inputNet *net.IPNet
+	anyLocal := host == "*"
+
+	if anyLocal {
+		host = net.IPv4zero.String()
+	} else if strings.Contains(host, "/") {
+		ipNet, err := parseIPNet(host)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("couldn't parse `%s` as ipv4 cidr", host)
+		}
+
+		host = ipNet.IP.String()
+		if ones, bits := ipNet.Mask.Size(); ones != bits {
+			inputNet = ipNet
+		}
+	}
+
+	prot, input, inputPorts, err := TryParseInput(scheme + host + ":" + ports)
+	if err != nil {
+		return nil, err
+	}
+
+	lb := NewLoadbalancer(prot, input)
+	lb.InputPorts = inputPorts
+	lb.InputNet = inputNet
+	lb.InputAnyLocal = anyLocal
+	lb.InputInterface = iface
+
+	return lb, nil
+}
+
+// newLoadbalancerForInput creates a loadbalancer without outputs with the input of the passed one.
+func newLoadbalancerForInput(input *Loadbalancer) *Loadbalancer {
+	lb := NewLoadbalancer(input.Protocol, input.Input)
+	lb.InputPorts = input.InputPorts
+	lb.InputNet = input.InputNet
+	lb.InputAnyLocal = input.InputAnyLocal
+	lb.InputInterface = input.InputInterface
+	lb.Aliases = input.Aliases
+	lb.AllowSources = input.AllowSources
+	lb.DenySources = input.DenySources
+
+	return lb
+}
+
+// InputOverlaps checks whether traffic may match the inputs (including aliases) of both loadbalancers. Wildcard inputs
+// overlap with all inputs of the same protocol and ports, since every destination may be a local one.
+func (lb *Loadbalancer) InputOverlaps(other *Loadbalancer) bool {
+	for _, a := range lb.inputs() {
+		for _, b := range other.inputs() {
+			if inputsOverlap(a, b) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func inputsOverlap(a *Loadbalancer, b *Loadbalancer) bool {
+	if !a.Protocol.Overlaps(b.Protocol) || !a.Ports().Overlaps(b.Ports()) {
+		return false
+	}
+
+	if a.InputInterface != "" && b.InputInterface != "" && a.InputInterface != b.InputInterface {
+		return false
+	}
+
+	x, y := a.inputDestination(), b.inputDestination()
+
+	return x == nil || y == nil || x.Contains(y.IP) || y.Contains(x.IP)
+}
+
+// PerProtocol returns a loadbalancer per network protocol of the current one. Loadbalancers of both TCP and UDP get
+// split up into one for each, sharing the outputs and weights, all others are returned as is.
+func (lb *Loadbalancer) PerProtocol() []*Loadbalancer {
+	if lb.Protocol != ProtocolTCPUDP {
+		return []*Loadbalancer{lb}
+	}
+
+	lbs := make([]*Loadbalancer, 0, 2)
+	for _, prot := range lb.Protocol.Protocols() {
+		lbCopy := *lb
+		lbCopy.Protocol = prot
+		lbCopy.Aliases = make([]Loadbalancer, 0, len(lb.Aliases))
+		for _, alias := range lb.Aliases {
+			alias.Protocol = prot
+			lbCopy.Aliases = append(lbCopy.Aliases, alias)
+		}
+
+		lbs = append(lbs, &lbCopy)
+	}
+
+	return lbs
+}
+
+// hasOutputs checks whether the lb has any outputs, either for all sources or in one of its pools.
+func (lb *Loadbalancer) hasOutputs() bool {
+	if len(lb.Outputs) > 0 {
+		return true
+	}
+
+	for _, pool := range lb.Pools {
+		if len(pool.Outputs) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allOutputs returns the outputs of the lb and of all its pools, every output is only returned once.
+func (lb *Loadbalancer) allOutputs() []Endpoint {
+	outputs := make([]Endpoint, 0, len(lb.Outputs))
+	for _, output := range lb.Outputs {
+		outputs = EndpointsAppendUnique(outputs, output)
+	}
+
+	for _, pool := range lb.Pools {
+		for _, output := range pool.Outputs {
+			outputs = EndpointsAppendUnique(outputs, output)
+		}
+	}
+
+	return outputs
+}
+
+// poolLoadbalancer returns a copy of the lb with the outputs of the passed pool.
+func (lb *Loadbalancer) poolLoadbalancer(pool Pool) *Loadbalancer {
+	poolLB := *lb
+	poolLB.Outputs = pool.Outputs
+	poolLB.Weights = nil
+	poolLB.Pools = nil
+
+	return &poolLB
+}
+
+// Ports returns all ports of the input.
+func (lb *Loadbalancer) Ports() PortSet {
+	if len(lb.InputPorts) > 0 {
+		return lb.InputPorts
+	}
+
+	return PortSet{{First: lb.Input.Port, Last: lb.Input.Port}}
+}
+
+// OutputPorts returns the ports traffic gets sent to on the passed output, nil for lbs with a single input port.
+func (lb *Loadbalancer) OutputPorts(output Endpoint) PortSet {
+	return getOutputPorts(lb.InputPorts, output)
+}
+
+func getOutputPorts(inputPorts PortSet, output Endpoint) PortSet {
+	if len(inputPorts) == 0 {
+		return nil
+	}
+
+	if output.Port == 0 {
+		return inputPorts
+	}
+
+	return inputPorts.Shift(output.Port)
+}
+
+// OutputString returns the passed output in the notation of the `-out` parameter.
+func (lb *Loadbalancer) OutputString(output Endpoint) string {
+	if len(lb.InputPorts) == 0 || output.Port == 0 {
+		return output.String()
+	}
+
+	return fmt.Sprintf("%s:%d-%d", output.IP.String(), output.Port, lb.OutputPorts(output).Last())
 }
 
-// GetChainID gets the chain identificator for the specified state
-func (lb *Loadbalancer) GetChainID(state ChainState, contentHash uint32) ChainID {
-	return NewChainID(lb.Protocol, lb.Input.IP, lb.Input.Port, lb.LastUpdate, state, contentHash)
+// ID gets the hash identifying the chains of the loadbalancer in the instance with the passed tag
+func (lb *Loadbalancer) ID(instanceTag uint8) uint32 {
+	id := LoadbalancerIDForInput(instanceTag, lb.Protocol, lb.inputDestination(), lb.Ports(), lb.InputInterface)
+	if len(lb.Aliases) == 0 {
+		return id
+	}
+
+	ids := []uint32{id}
+	for i := range lb.Aliases {
+		ids = append(ids, lb.Aliases[i].ID(instanceTag))
+	}
+
+	return LoadbalancerIDForAliases(ids...)
+}
+
+// GetChainID gets the chain identificator for the specified instance and state
+func (lb *Loadbalancer) GetChainID(instanceTag uint8, state ChainState, contentHash uint32) ChainID {
+	return NewChainIDForLoadbalancerID(instanceTag, lb.ID(instanceTag), lb.Generation, state, contentHash)
+}
+
+// Weight returns the weight of the passed output.
+func (lb *Loadbalancer) Weight(output Endpoint) int {
+	weight, found := lb.Weights[output.String()]
+	if !found || weight < 1 {
+		return 1
+	}
+
+	return weight
+}
+
+// weightedOutputs returns the outputs with each output repeated according to its weight. The weights get scaled down
+// to at most maxOutputWeight and reduced by their greatest common divisor, to keep the chain small.
+func (lb *Loadbalancer) weightedOutputs() []Endpoint {
+	maxWeight := 1
+	for _, output := range lb.Outputs {
+		if lb.Weight(output) > maxWeight {
+			maxWeight = lb.Weight(output)
+		}
+	}
+
+	weights := make([]int, 0, len(lb.Outputs))
+	divisor := 0
+
+	for _, output := range lb.Outputs {
+		weight := lb.Weight(output)
+		if maxWeight > maxOutputWeight {
+			weight = (weight*maxOutputWeight + maxWeight/2) / maxWeight
+			if weight < 1 {
+				weight = 1
+			}
+		}
+
+		weights = append(weights, weight)
+		divisor = gcd(divisor, weight)
+	}
+
+	outputs := make([]Endpoint, 0, len(lb.Outputs))
+	for i, output := range lb.Outputs {
+		for n := 0; n < weights[i]/divisor; n++ {
+			outputs = append(outputs, output)
+		}
+	}
+
+	return outputs
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
 }
 
 // GetLoadbalancerKey retrieved a mapping key for a loadbalancer with the specified input
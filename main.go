@@ -3,11 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/NectGmbH/health"
@@ -54,122 +56,339 @@ func mergeHealthFeeds(cs ...chan LBHealthCheckStatus) chan LBHealthCheckStatus {
 	return out
 }
 
-func setupHealthChecks(prot Protocol, in Endpoint, outs []Endpoint, healthProvider health.HealthCheckProvider, tickRate int) (chan struct{}, chan LBHealthCheckStatus) {
-	stopChan := make(chan struct{}, 0)
-	stopChans := make([]chan struct{}, 0)
-	healthFeed := make(chan LBHealthCheckStatus)
-	lbKey := GetLoadbalancerKey(prot, in)
-
-	for _, endpoint := range outs {
-		h := health.NewHealthCheck(
-			endpoint.IP,
-			int(endpoint.Port),
-			healthProvider,
-			time.Duration(tickRate)*time.Second,
-			60*time.Second,
-			1*time.Second)
-
-		stopChanOuter := make(chan struct{}, 0)
-		stopChanInner := make(chan struct{}, 0)
-		notificationChan := h.Monitor(stopChanInner)
-
-		// Aggregate all health updates onto one channel
-		go (func() {
-			for {
+// startHealthCheck monitors the passed endpoint and sends its status updates to healthFeed till the returned channel
+// gets closed.
+func startHealthCheck(lbKey string, endpoint Endpoint, healthProvider health.HealthCheckProvider, tickRate int, healthFeed chan LBHealthCheckStatus) chan struct{} {
+	h := health.NewHealthCheck(
+		endpoint.IP,
+		int(endpoint.Port),
+		healthProvider,
+		time.Duration(tickRate)*time.Second,
+		60*time.Second,
+		1*time.Second)
+
+	stopChanOuter := make(chan struct{}, 0)
+	stopChanInner := make(chan struct{}, 0)
+	notificationChan := h.Monitor(stopChanInner)
+
+	// Aggregate all health updates onto one channel
+	go (func() {
+		for {
+			select {
+			case <-stopChanOuter:
+				stopChanInner <- struct{}{}
+				close(stopChanInner)
+				return
+			case status := <-notificationChan:
 				select {
+				case healthFeed <- LBHealthCheckStatus{HealthCheckStatus: status, LBKey: lbKey}:
 				case <-stopChanOuter:
 					stopChanInner <- struct{}{}
 					close(stopChanInner)
 					return
-				case status := <-notificationChan:
-					healthFeed <- LBHealthCheckStatus{
-						HealthCheckStatus: status,
-						LBKey:             lbKey,
-					}
 				}
 			}
-		})()
+		}
+	})()
 
-		stopChans = append(stopChans, stopChanOuter)
+	return stopChanOuter
+}
+
+// loadbalancerDefinition contains a parsed `-in`, `-out`, `-h` triple.
+type loadbalancerDefinition struct {
+	Loadbalancer   *Loadbalancer
+	HealthProvider health.HealthCheckProvider
+
+	// DNSOutputs contains the outputs which have to be resolved, they aren't part of the loadbalancers outputs
+	DNSOutputs []DNSOutput
+}
+
+func parseLoadbalancerFlags(inFlags sliceFlags, outFlags sliceFlags, healthFlags sliceFlags, options EndpointParseOptions) ([]loadbalancerDefinition, error) {
+	if len(inFlags) != len(outFlags) || len(inFlags) != len(healthFlags) {
+		return nil, fmt.Errorf("for every -in parameter you have to specify exactly ONE -h and ONE -out parameter")
 	}
 
-	go (func() {
-		<-stopChan
-		for _, s := range stopChans {
-			s <- struct{}{}
-			close(s)
+	if len(inFlags) == 0 {
+		return nil, fmt.Errorf("didn't specify any loadbalancers")
+	}
+
+	definitions := make([]loadbalancerDefinition, 0, len(inFlags))
+
+	for i := 0; i < len(inFlags); i++ {
+		definition, err := parseLoadbalancerDefinition(inFlags[i], outFlags[i], healthFlags[i], options)
+		if err != nil {
+			return nil, err
 		}
-	})()
 
-	return stopChan, healthFeed
+		definitions = append(definitions, definition)
+	}
+
+	if errs := validateLoadbalancerDefinitions(definitions); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return definitions, nil
+}
+
+func parseLoadbalancerDefinition(in string, out string, healthFlag string, options EndpointParseOptions) (loadbalancerDefinition, error) {
+	lb, err := TryParseLoadbalancerInput(in)
+	if err != nil {
+		return loadbalancerDefinition{}, fmt.Errorf("couldn't parse input endpoint from `%s`, see: %v", in, err)
+	}
+
+	poolOuts, defaultOut, err := splitPools(out)
+	if err != nil {
+		return loadbalancerDefinition{}, fmt.Errorf("couldn't parse pools from `%s`, see: %v", out, err)
+	}
+
+	staticOut, dnsOutputs, err := splitOutputs(defaultOut)
+	if err != nil {
+		return loadbalancerDefinition{}, fmt.Errorf("couldn't parse endpoints from `%s`, see: %v", out, err)
+	}
+
+	if len(dnsOutputs) > 0 && lb.InputPorts != nil {
+		return loadbalancerDefinition{}, fmt.Errorf("hostnames and SRV names aren't supported as outputs of lbs with multiple ports")
+	}
+
+	options.InputPorts = lb.InputPorts
+
+	outEndpoints := make([]Endpoint, 0)
+	if staticOut != "" || len(dnsOutputs) == 0 {
+		outEndpoints, err = TryParseEndpointsWithOptions(staticOut, options)
+		if err != nil {
+			return loadbalancerDefinition{}, fmt.Errorf("couldn't parse endpoints from `%s`, see: %v", out, err)
+		}
+	}
+
+	lb.Outputs = outEndpoints
+
+	for _, poolOut := range poolOuts {
+		pool, err := TryParsePool(poolOut, options)
+		if err != nil {
+			return loadbalancerDefinition{}, fmt.Errorf("couldn't parse pool `%s`, see: %v", poolOut, err)
+		}
+
+		lb.Pools = append(lb.Pools, pool)
+	}
+
+	if options.MaxEndpoints > 0 && len(lb.allOutputs()) > options.MaxEndpoints {
+		return loadbalancerDefinition{}, fmt.Errorf("`%s` expands to more than %d endpoints, split it up or raise the limit", out, options.MaxEndpoints)
+	}
+
+	healthProvider, err := getHealthCheckProvider(healthFlag)
+	if err != nil {
+		return loadbalancerDefinition{}, fmt.Errorf("couldn't setup health provider `%s`, see: %v", healthFlag, err)
+	}
+
+	return loadbalancerDefinition{
+		Loadbalancer:   lb,
+		HealthProvider: healthProvider,
+		DNSOutputs:     dnsOutputs,
+	}, nil
 }
 
 func main() {
+	// Commands are passed as first argument, e.g. `iptableslb plan -in ...`
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	var inFlags sliceFlags
 	var outFlags sliceFlags
 	var healthFlags sliceFlags
 	var hairpinningCIDR string
 	var metricsPort int
 	var tickRate int
+	var resyncInterval time.Duration
+	var syncDebounce time.Duration
+	var instance string
+	var mainChainName string
+	var forwardChainName string
+	var hairpinningChainName string
+	var outputChainName string
+	var inputChainName string
+	var localTraffic bool
+	var cleanupOnExit bool
+	var removeUnknownRules bool
+	var ruleComments bool
+	var rejectMark uint
+	var dryRun bool
+	var installJumps bool
+	var jumpPositionFlag string
+	var outputFormat string
+	var configPath string
+	var removeImported bool
+	var overwriteConfig bool
+	var maxOutputs int
+	var keepNetworkAndBroadcast bool
+	var resolvConf string
+	var dnsMinTTL time.Duration
 
 	flag.StringVar(&hairpinningCIDR, "hairpinning-cidr", "", "the nat internal CIDR. if empty, no hairpinning will be set up.")
 	flag.IntVar(&metricsPort, "p", 9080, "port to listen on for metrics endpoint")
-	flag.IntVar(&tickRate, "t", 1, "Tick rate for the controller in seconds.")
-	flag.Var(&inFlags, "in", "Input for the lb, e.g. \"tcp://192.168.0.1:80\"")
-	flag.Var(&outFlags, "out", "Outputs for the lb defined in the \"-in\" parameter, e.g. \"192.168.2.1:8080,192.168.2.2-255:8080\"")
-	flag.Var(&healthFlags, "h", "HealthCheck which should be used, available: http, tcp, none")
+	flag.IntVar(&tickRate, "t", 1, "Tick rate for the health checks in seconds.")
+	flag.DurationVar(&resyncInterval, "resync", DefaultResyncInterval, "Interval in which iptables gets reconciled even if no loadbalancer changed, e.g. to repair manual modifications.")
+	flag.DurationVar(&syncDebounce, "debounce", DefaultSyncDebounce, "Time to wait after a loadbalancer changed before syncing, so multiple changes get applied at once.")
+	flag.StringVar(&instance, "instance", "", "Name of this instance, namespaces all managed chains so multiple instances can run on the same host.")
+	flag.StringVar(&mainChainName, "prerouting-chain", "", "Name of the managed nat prerouting chain, defaults to \"iptableslb-prerouting\" or \"iptableslb-<instance>-prerouting\".")
+	flag.StringVar(&forwardChainName, "forward-chain", "", "Name of the managed filter forward chain, defaults to \"iptableslb-forward\" or \"iptableslb-<instance>-forward\".")
+	flag.StringVar(&hairpinningChainName, "hairpinning-chain", "", "Name of the managed nat hairpinning chain, defaults to \"iptableslb-hairpinning\" or \"iptableslb-<instance>-hairpinning\".")
+	flag.StringVar(&outputChainName, "output-chain", "", "Name of the managed nat output chain, defaults to \"iptableslb-output\" or \"iptableslb-<instance>-output\".")
+	flag.StringVar(&inputChainName, "input-chain", "", "Name of the managed filter input chain dropping rejected traffic to local addresses, defaults to \"iptableslb-input\" or \"iptableslb-<instance>-input\".")
+	flag.BoolVar(&localTraffic, "local-traffic", false, "Manage the nat output chain, so processes on this host can reach the loadbalancers as well.")
+	flag.BoolVar(&cleanupOnExit, "cleanup-on-exit", false, "Remove all managed chains and the jumps to them on shutdown (same as the \"cleanup\" command).")
+	flag.BoolVar(&removeUnknownRules, "remove-unknown-rules", false, "Remove rules from the managed chains which weren't created by iptableslb, they get reported in any case.")
+	flag.BoolVar(&ruleComments, "rule-comments", true, "Add a comment with the lb, backend, generation and instance to every rule created by iptableslb.")
+	flag.UintVar(&rejectMark, "reject-mark", DefaultRejectMark, "Packet mark bit set on traffic rejected by the source filters of the lbs (e.g. \"0x20000\"), it gets dropped in the managed forward and input chain.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only print the iptables changes needed for the configured loadbalancers and exit (same as the \"plan\" command). Exits with 0 if nothing has to change and with 2 if changes are pending.")
+	flag.BoolVar(&installJumps, "install-jumps", false, "Install the jumps from the built-in FORWARD, PREROUTING, OUTPUT, POSTROUTING and INPUT chains to the managed chains and re-add them if they disappear.")
+	flag.StringVar(&jumpPositionFlag, "jump-position", "append", "Position of the installed jumps in the built-in chains: \"append\", a 1-based position like \"1\", \"before:<comment>\" or \"after:<comment>\" to place them relative to the rule with the given comment.")
+	flag.StringVar(&configPath, "config", "", "Config file with one loadbalancer per line in the notation of the flags, e.g. \"tcp://192.168.0.1:80 192.168.2.1:8080,192.168.2.2:8080 http\". The import command writes it instead.")
+	flag.BoolVar(&overwriteConfig, "overwrite-config", false, "Make the import command replace an existing config file, by default it refuses to.")
+	flag.BoolVar(&removeImported, "remove-imported", false, "Make the import command remove the hand-written rules of all loadbalancers already managed by iptableslb instead of writing the config.")
+	flag.IntVar(&maxOutputs, "max-outputs", DefaultMaxEndpoints, "Maximum number of outputs a single \"-out\" parameter may expand to, protects against accidentally huge ranges or cidr blocks. 0 means unlimited.")
+	flag.BoolVar(&keepNetworkAndBroadcast, "keep-network-broadcast", false, "Keep the network and broadcast address of cidr blocks in \"-out\" parameters.")
+	flag.StringVar(&resolvConf, "resolv-conf", "/etc/resolv.conf", "resolv.conf containing the nameservers used to resolve hostnames and SRV names in \"-out\" parameters.")
+	flag.DurationVar(&dnsMinTTL, "dns-min-ttl", DefaultDNSMinTTL, "Minimum time resolved outputs are cached, regardless of the ttl of their records.")
+	flag.StringVar(&outputFormat, "o", "", "Output format of the status command (table or json, defaults to table) or the export command (iptables-restore or nft, defaults to iptables-restore).")
+	flag.Var(&inFlags, "in", "Input for the lb, e.g. \"tcp://192.168.0.1:80\", \"tcpudp://192.168.0.1:53\", \"tcp://*%eth1:443\", \"tcp://192.168.0.1:443,tcp://192.168.1.1:443\", \"udp://192.168.0.1:10000-10100\" or \"tcp://192.168.0.1:21,30000-30100\"")
+	flag.Var(&outFlags, "out", "Outputs for the lb defined in the \"-in\" parameter, e.g. \"192.168.2.1:8080,192.168.2.2-255:8080\", \"192.168.2.0/28:8080,!192.168.2.7\" or \"192.168.2.250-192.168.3.5:8080-8081\", pools for some sources like \"10.0.0.0/8=192.168.3.1:8080;192.168.2.1:8080\", hostnames and SRV names like \"api.internal:8080,_http._tcp.api.internal\" get resolved periodically")
+	flag.Var(&healthFlags, "h", "HealthCheck which should be used, available: http, tcp, sctp, none")
 	flag.Parse()
 
-	if len(inFlags) != len(outFlags) || len(inFlags) != len(healthFlags) {
-		glog.Fatalf("For every -in parameter you have to specify exactly ONE -h and ONE -out parameter")
-	}
+	parseOptions := EndpointParseOptions{MaxEndpoints: maxOutputs, KeepNetworkAndBroadcast: keepNetworkAndBroadcast}
 
-	if len(inFlags) == 0 {
-		glog.Fatalf("didn't specify any loadbalancers")
+	switch command {
+	case "":
+	case "plan", "cleanup", "status", "import", "export", "validate":
+	default:
+		glog.Fatalf("unknown command `%s`, available: plan, cleanup, status, import, export, validate", command)
 	}
 
-	metrics := &Metrics{}
-	err := metrics.Init()
+	jumpPosition, err := TryParseJumpPosition(jumpPositionFlag)
 	if err != nil {
-		glog.Fatalf("couldn't set up metrics endpoint, see: %v", err)
+		glog.Fatalf("invalid -jump-position, see: %v", err)
 	}
 
-	metrics.LBTotal.Add(float64(len(inFlags)))
+	if rejectMark == 0 || uint64(rejectMark) > math.MaxUint32 {
+		glog.Fatalf("invalid -reject-mark `0x%x`, expected a non-zero 32 bit mark", rejectMark)
+	}
 
-	ctrl, err := NewController(tickRate, metrics, hairpinningCIDR)
-	if err != nil {
-		glog.Fatalf("Controller couldn't start, see: %v", err)
+	ctrlConfig := ControllerConfig{
+		ResyncInterval:       resyncInterval,
+		SyncDebounce:         syncDebounce,
+		HairpinningCIDR:      hairpinningCIDR,
+		Instance:             instance,
+		MainChainName:        mainChainName,
+		ForwardChainName:     forwardChainName,
+		HairpinningChainName: hairpinningChainName,
+		OutputChainName:      outputChainName,
+		InputChainName:       inputChainName,
+		LocalTraffic:         localTraffic,
+		InstallJumps:         installJumps,
+		JumpPosition:         jumpPosition,
+		CleanupOnExit:        cleanupOnExit,
+		RemoveUnknownRules:   removeUnknownRules,
+		RuleComments:         ruleComments,
+		RejectMark:           uint32(rejectMark),
 	}
 
-	stopChs := make([]chan struct{}, 0)
-	statusChs := make([]chan LBHealthCheckStatus, 0)
-	loadbalancers := make(map[string]*Loadbalancer)
+	if command == "cleanup" {
+		os.Exit(cleanup(ctrlConfig, dryRun))
+	}
 
-	for i := 0; i < len(inFlags); i++ {
-		in := inFlags[i]
-		out := outFlags[i]
-		healthFlag := healthFlags[i]
+	if command == "status" {
+		os.Exit(status(ctrlConfig, outputFormat))
+	}
 
-		prot, inEndpoint, err := TryParseProtocolEndpoint(in)
+	if command == "import" {
+		os.Exit(importRules(ctrlConfig, configPath, overwriteConfig, removeImported, dryRun))
+	}
+
+	if configPath != "" {
+		err = readConfigFile(configPath, &inFlags, &outFlags, &healthFlags)
 		if err != nil {
-			glog.Fatalf("couldn't parse input endpoint from `%s`, see: %v", in, err)
+			glog.Fatalf("%v", err)
 		}
+	}
 
-		outEndpoints, err := TryParseEndpoints(out)
-		if err != nil {
-			glog.Fatalf("couldn't parse endpoints from `%s`, see: %v", out, err)
+	if command == "validate" {
+		os.Exit(validate(ctrlConfig, parseOptions, inFlags, outFlags, healthFlags))
+	}
+
+	definitions, err := parseLoadbalancerFlags(inFlags, outFlags, healthFlags, parseOptions)
+	if err != nil {
+		glog.Fatalf("%v", err)
+	}
+
+	var resolver *Resolver
+	for _, definition := range definitions {
+		if len(definition.DNSOutputs) == 0 {
+			continue
 		}
 
-		healthProvider, err := health.GetHealthCheckProvider(healthFlag)
+		resolver, err = NewResolverFromResolvConf(resolvConf)
 		if err != nil {
-			glog.Fatalf("couldn't setup health provider `%s`, see: %v", healthFlag, err)
+			glog.Fatalf("%v", err)
+		}
+
+		resolver.MinTTL = dnsMinTTL
+		break
+	}
+
+	if command == "plan" || command == "export" || dryRun {
+		loadbalancers := make([]*Loadbalancer, 0, len(definitions))
+		for _, definition := range definitions {
+			lb, err := resolveLoadbalancer(resolver, definition)
+			if err != nil {
+				glog.Fatalf("%v", err)
+			}
+
+			loadbalancers = append(loadbalancers, lb)
 		}
 
-		lb := NewLoadbalancer(prot, inEndpoint, outEndpoints...)
-		loadbalancers[lb.Key()] = lb
-		stopCh, statusCh := setupHealthChecks(prot, inEndpoint, outEndpoints, healthProvider, tickRate)
-		stopChs = append(stopChs, stopCh)
-		statusChs = append(statusChs, statusCh)
+		if command == "export" {
+			if outputFormat == "" {
+				outputFormat = ExportFormatIPTables
+			}
+
+			os.Exit(export(ctrlConfig, loadbalancers, outputFormat))
+		}
+
+		os.Exit(plan(ctrlConfig, loadbalancers))
+	}
+
+	metrics := &Metrics{}
+	err = metrics.Init()
+	if err != nil {
+		glog.Fatalf("couldn't set up metrics endpoint, see: %v", err)
+	}
+
+	metrics.LBTotal.Add(float64(len(definitions)))
+
+	ctrl, err := NewController(ctrlConfig, metrics)
+	if err != nil {
+		glog.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	stopCh := make(chan struct{}, 0)
+	statusChs := make([]chan LBHealthCheckStatus, 0)
+	backendSets := make(map[string]*backendSet)
+
+	for _, definition := range definitions {
+		set := newBackendSet(definition, tickRate)
+		backendSets[set.Key()] = set
+		statusChs = append(statusChs, set.healthFeed)
+
+		for _, output := range definition.DNSOutputs {
+			output := output
+			go resolver.Watch(output, stopCh, func(backends []Backend) {
+				set.SetResolved(output, backends)
+				ctrl.UpsertLoadbalancer(set.Loadbalancer())
+			})
+		}
 	}
 
 	go (func() {
@@ -181,24 +400,22 @@ func main() {
 
 	go (func() {
 		for status := range statusUpdated {
-			lb, found := loadbalancers[status.LBKey]
+			set, found := backendSets[status.LBKey]
 			if !found {
 				glog.Warningf("Got status update `%#v` for not configured loadbalancer `%s`", status, status.LBKey)
 				continue
 			}
 
 			if status.DidChange {
-				glog.Info(status.String())
-
 				endpoint := Endpoint{IP: status.IP, Port: uint16(status.Port)}
 
-				if status.Healthy {
-					lb.Outputs = EndpointsAppendUnique(lb.Outputs, endpoint)
-				} else {
-					lb.Outputs = EndpointsRemove(lb.Outputs, endpoint)
+				if !set.SetHealth(endpoint, status.Healthy) {
+					glog.V(5).Infof("ignoring status update for removed backend `%s` of lb `%s`", endpoint.String(), status.LBKey)
+					continue
 				}
 
-				ctrl.UpsertLoadbalancer(lb)
+				glog.Info(status.String())
+				ctrl.UpsertLoadbalancer(set.Loadbalancer())
 			} else {
 				glog.V(5).Info(status.String())
 			}
@@ -211,13 +428,14 @@ func main() {
 	ctrl.Run()
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-	for range signalCh {
-		glog.Infof("Received ^C, shutting down...")
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	for sig := range signalCh {
+		glog.Infof("Received %v, shutting down...", sig)
 		ctrl.Stop()
 
-		for _, stopCh := range stopChs {
-			close(stopCh)
+		close(stopCh)
+		for _, set := range backendSets {
+			set.Stop()
 		}
 
 		break
@@ -10,10 +10,14 @@ import (
 
 // Metrics contains all logic for prometheus metrics
 type Metrics struct {
-    ErrorsTotal        prometheus.Counter
-    LBTotal            prometheus.Counter
-    LBHealthy          prometheus.Gauge
-    LBHealthyEndpoints *prometheus.GaugeVec
+    ErrorsTotal            prometheus.Counter
+    LBTotal                prometheus.Counter
+    LBHealthy              prometheus.Gauge
+    LBHealthyEndpoints     *prometheus.GaugeVec
+    LBPoolHealthyEndpoints *prometheus.GaugeVec
+    UnknownRules           *prometheus.GaugeVec
+    DriftRepairsTotal      *prometheus.CounterVec
+    RejectedPacketsTotal   *prometheus.CounterVec
 }
 
 // Init initializes the metrics
@@ -71,6 +75,62 @@ func (m *Metrics) Init() error {
         return fmt.Errorf("couldn't register LBHealthyEndpoints gauge, see: %v", err)
     }
 
+    // -- LBPoolHealthyEndpoints -----------------------------------------------
+    m.LBPoolHealthyEndpoints = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Subsystem: "general",
+            Name:      "lb_pool_healthy_endpoints",
+            Help:      "Pools of loadbalancers with amount of healthy endpoints",
+        },
+        []string{"lb", "pool"})
+
+    err = prometheus.Register(m.LBPoolHealthyEndpoints)
+    if err != nil {
+        return fmt.Errorf("couldn't register LBPoolHealthyEndpoints gauge, see: %v", err)
+    }
+
+    // -- UnknownRules ---------------------------------------------------------
+    m.UnknownRules = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Subsystem: "general",
+            Name:      "unknown_rules",
+            Help:      "Amount of rules in managed chains which weren't created by iptableslb",
+        },
+        []string{"table", "chain"})
+
+    err = prometheus.Register(m.UnknownRules)
+    if err != nil {
+        return fmt.Errorf("couldn't register UnknownRules gauge, see: %v", err)
+    }
+
+    // -- DriftRepairsTotal ----------------------------------------------------
+    m.DriftRepairsTotal = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Subsystem: "general",
+            Name:      "drift_repairs_total",
+            Help:      "Total number of unknown rules removed and rules moved back into order in managed chains",
+        },
+        []string{"table", "chain"})
+
+    err = prometheus.Register(m.DriftRepairsTotal)
+    if err != nil {
+        return fmt.Errorf("couldn't register DriftRepairsTotal counter, see: %v", err)
+    }
+
+    // -- RejectedPacketsTotal -------------------------------------------------
+    m.RejectedPacketsTotal = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Subsystem: "general",
+            Name:      "lb_rejected_packets_total",
+            Help:      "Total number of packets rejected by the source filters of loadbalancers",
+        },
+        []string{"lb"})
+
+    err = prometheus.Register(m.RejectedPacketsTotal)
+    if err != nil {
+        return fmt.Errorf("couldn't register RejectedPacketsTotal counter, see: %v", err)
+    }
+
     // -------------------------------------------------------------------------
 
     http.Handle("/metrics", promhttp.Handler())
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -19,6 +20,12 @@ const (
 
 	// ProtocolUDP represents the UDP network protocol
 	ProtocolUDP Protocol = 0x02
+
+	// ProtocolSCTP represents the SCTP network protocol
+	ProtocolSCTP Protocol = 0x03
+
+	// ProtocolTCPUDP isn't a real protocol but marks inputs of lbs which balance TCP as well as UDP, see Protocols.
+	ProtocolTCPUDP Protocol = 0x80
 )
 
 // String returns the string representation of the current network protocl.
@@ -28,11 +35,65 @@ func (p Protocol) String() string {
 		return "tcp"
 	case ProtocolUDP:
 		return "udp"
+	case ProtocolSCTP:
+		return "sctp"
+	case ProtocolTCPUDP:
+		return "tcpudp"
 	default:
 		return "unknown"
 	}
 }
 
+// Protocols returns the network protocols the current protocol stands for.
+func (p Protocol) Protocols() []Protocol {
+	if p == ProtocolTCPUDP {
+		return []Protocol{ProtocolTCP, ProtocolUDP}
+	}
+
+	return []Protocol{p}
+}
+
+// Overlaps checks whether the current and the passed protocol stand for a common network protocol.
+func (p Protocol) Overlaps(other Protocol) bool {
+	for _, a := range p.Protocols() {
+		for _, b := range other.Protocols() {
+			if a == b {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TryParseProtocol tries to parse the passed protocol name, e.g. "tcp"
+func TryParseProtocol(str string) (Protocol, error) {
+	switch str {
+	case "tcp":
+		return ProtocolTCP, nil
+	case "udp":
+		return ProtocolUDP, nil
+	case "sctp":
+		return ProtocolSCTP, nil
+	default:
+		return ProtocolUNK, fmt.Errorf("unknown protocol, expected \"tcp\", \"udp\" or \"sctp\" but got `%s`", str)
+	}
+}
+
+// tryParseInputProtocol works like TryParseProtocol but accepts "tcpudp" for inputs of both protocols as well.
+func tryParseInputProtocol(str string) (Protocol, error) {
+	if str == "tcpudp" {
+		return ProtocolTCPUDP, nil
+	}
+
+	prot, err := TryParseProtocol(str)
+	if err != nil {
+		return ProtocolUNK, fmt.Errorf("unknown protocol, expected \"tcp\", \"udp\", \"sctp\" or \"tcpudp\" but got `%s`", str)
+	}
+
+	return prot, nil
+}
+
 // Endpoint represents an IP:Port tuple
 type Endpoint struct {
 	IP   net.IP
@@ -40,6 +101,11 @@ type Endpoint struct {
 }
 
 func (e Endpoint) String() string {
+	// Outputs of loadbalancers with multiple ports keep the destination port, they don't have one on their own
+	if e.Port == 0 {
+		return e.IP.String()
+	}
+
 	return fmt.Sprintf("%s:%d", e.IP.String(), e.Port)
 }
 
@@ -66,6 +132,33 @@ func EndpointsAppendUnique(endpoints []Endpoint, endpoint Endpoint) []Endpoint {
 	return append(endpoints, endpoint)
 }
 
+// EndpointsEqual checks whether both slices contain the same endpoints the same number of times, regardless of their
+// order.
+func EndpointsEqual(a []Endpoint, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, e := range a {
+		if endpointsCount(a, e) != endpointsCount(b, e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func endpointsCount(endpoints []Endpoint, endpoint Endpoint) int {
+	count := 0
+	for _, e := range endpoints {
+		if e.Equals(endpoint) {
+			count++
+		}
+	}
+
+	return count
+}
+
 func EndpointsRemove(endpoints []Endpoint, endpoint Endpoint) []Endpoint {
 	newEndpoints := make([]Endpoint, 0)
 
@@ -86,21 +179,16 @@ func NewEndpoint(ip net.IP, port uint16) Endpoint {
 	}
 }
 
-// TryParseProtocolEndpoint tries to parse a protocol-endpoint tuple like "tcp://ip:port"
+// TryParseProtocolEndpoint tries to parse a protocol-endpoint tuple like "tcp://ip:port" or "sctp://ip:port"
 func TryParseProtocolEndpoint(str string) (Protocol, Endpoint, error) {
 	splitted := strings.Split(str, "//")
 	if len(splitted) != 2 {
 		return ProtocolUNK, Endpoint{}, fmt.Errorf("expected string in format schema://ip:port but got `%s`", str)
 	}
 
-	prot := ProtocolUNK
-
-	if splitted[0] == "tcp:" {
-		prot = ProtocolTCP
-	} else if splitted[0] == "udp:" {
-		prot = ProtocolUDP
-	} else {
-		return ProtocolUNK, Endpoint{}, fmt.Errorf("unknown protocol, expected \"tcp\" or \"udp\" but got `%s`", splitted[0])
+	prot, err := tryParseInputProtocol(strings.TrimSuffix(splitted[0], ":"))
+	if err != nil {
+		return ProtocolUNK, Endpoint{}, err
 	}
 
 	endpoint, err := TryParseEndpoint(splitted[1])
@@ -119,89 +207,477 @@ func TryParseEndpoint(str string) (Endpoint, error) {
 	}
 
 	ip := net.ParseIP(splitted[0]).To4()
-	port, err := strconv.Atoi(splitted[1])
+	if ip == nil {
+		return Endpoint{}, fmt.Errorf("couldn't parse `%s` as ipv4", splitted[0])
+	}
+
+	port, err := parsePort(splitted[1])
 	if err != nil {
 		return Endpoint{}, fmt.Errorf("couldnt parse port, see: %v", err)
 	}
 
-	return NewEndpoint(ip, uint16(port)), nil
+	return NewEndpoint(ip, port), nil
+}
+
+// parsePort parses a port in the range 1-65535.
+func parsePort(str string) (uint16, error) {
+	port, err := strconv.ParseUint(str, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port `%s`, expected a number between 1 and 65535", str)
+	}
+
+	if port == 0 {
+		return 0, fmt.Errorf("invalid port `%s`, expected a number between 1 and 65535", str)
+	}
+
+	return uint16(port), nil
+}
+
+// TryParseInput tries to parse the input of a loadbalancer like "tcp://ip:port", which may contain multiple ports like
+// "udp://ip:10000-10100" or "tcp://ip:21,30000-30100". The port set is only returned for inputs with multiple ports,
+// the port of the endpoint is the first one then.
+func TryParseInput(str string) (Protocol, Endpoint, PortSet, error) {
+	splitted := strings.Split(str, "//")
+	if len(splitted) != 2 {
+		return ProtocolUNK, Endpoint{}, nil, fmt.Errorf("expected string in format schema://ip:port but got `%s`", str)
+	}
+
+	ipPortParts := strings.Split(splitted[1], ":")
+	if len(ipPortParts) != 2 || (!strings.Contains(ipPortParts[1], ",") && !strings.Contains(ipPortParts[1], "-")) {
+		prot, endpoint, err := TryParseProtocolEndpoint(str)
+		return prot, endpoint, nil, err
+	}
+
+	prot, err := tryParseInputProtocol(strings.TrimSuffix(splitted[0], ":"))
+	if err != nil {
+		return ProtocolUNK, Endpoint{}, nil, err
+	}
+
+	ip := net.ParseIP(ipPortParts[0]).To4()
+	if ip == nil {
+		return ProtocolUNK, Endpoint{}, nil, fmt.Errorf("couldn't parse `%s` as ipv4", ipPortParts[0])
+	}
+
+	ports, err := TryParsePortSet(ipPortParts[1])
+	if err != nil {
+		return ProtocolUNK, Endpoint{}, nil, fmt.Errorf("couldn't parse ports of `%s`, see: %v", str, err)
+	}
+
+	if ports.Count() == 1 {
+		return prot, NewEndpoint(ip, ports.First()), nil, nil
+	}
+
+	return prot, NewEndpoint(ip, ports.First()), ports, nil
+}
+
+// PortRange represents all ports between First and Last (both inclusive).
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// PortSet is a sorted list of non overlapping port ranges, e.g. the ports of an input.
+type PortSet []PortRange
+
+// TryParsePortSet tries to parse a comma separated list of ports and port ranges, e.g. "21,30000-30100".
+func TryParsePortSet(str string) (PortSet, error) {
+	ports := make(PortSet, 0)
+
+	for _, part := range strings.Split(str, ",") {
+		first, last, err := parsePortRange(part)
+		if err != nil {
+			return nil, err
+		}
+
+		ports = append(ports, PortRange{First: first, Last: last})
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].First < ports[j].First
+	})
+
+	for i := 1; i < len(ports); i++ {
+		if ports[i].First <= ports[i-1].Last {
+			return nil, fmt.Errorf("ports `%s` and `%s` overlap", ports[i-1].String(), ports[i].String())
+		}
+	}
+
+	if len(ports) > 1 && ports.multiportSlots() > maxMultiportSlots {
+		return nil, fmt.Errorf("ports `%s` need %d multiport slots but iptables only supports %d, ranges take 2 slots", ports.String(), ports.multiportSlots(), maxMultiportSlots)
+	}
+
+	return ports, nil
+}
+
+// maxMultiportSlots is the maximum number of ports `-m multiport` accepts, ranges count as two.
+const maxMultiportSlots = 15
+
+// multiportSlots returns the number of ports the set takes in a `-m multiport` match.
+func (s PortSet) multiportSlots() int {
+	slots := 0
+	for _, r := range s {
+		if r.First == r.Last {
+			slots++
+		} else {
+			slots += 2
+		}
+	}
+
+	return slots
+}
+
+func (s PortSet) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// iptablesString formats the ports like the port matches of iptables expect them, e.g. "21,30000:30100".
+func (s PortSet) iptablesString() string {
+	return strings.Replace(s.String(), "-", ":", -1)
+}
+
+// First returns the lowest port of the set.
+func (s PortSet) First() uint16 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	return s[0].First
+}
+
+// Last returns the highest port of the set.
+func (s PortSet) Last() uint16 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	return s[len(s)-1].Last
+}
+
+// Count returns the number of ports in the set.
+func (s PortSet) Count() int {
+	count := 0
+	for _, r := range s {
+		count += int(r.Last) - int(r.First) + 1
+	}
+
+	return count
+}
+
+// Contains checks whether the passed port is part of the set.
+func (s PortSet) Contains(port uint16) bool {
+	for _, r := range s {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Overlaps checks whether both sets have at least one port in common.
+func (s PortSet) Overlaps(other PortSet) bool {
+	for _, a := range s {
+		for _, b := range other {
+			if a.First <= b.Last && b.First <= a.Last {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Shift moves all ports, so the first port of the set becomes the passed one.
+func (s PortSet) Shift(first uint16) PortSet {
+	shifted := make(PortSet, 0, len(s))
+	for _, r := range s {
+		shifted = append(shifted, PortRange{First: r.First - s.First() + first, Last: r.Last - s.First() + first})
+	}
+
+	return shifted
+}
+
+// EndpointParseOptions configures how endpoint lists get expanded.
+type EndpointParseOptions struct {
+	// MaxEndpoints limits the number of endpoints a list may expand to, 0 means unlimited
+	MaxEndpoints int
+
+	// KeepNetworkAndBroadcast keeps the network and broadcast address of CIDR blocks, which get skipped by default
+	KeepNetworkAndBroadcast bool
+
+	// InputPorts contains the ports of a loadbalancer with multiple input ports the outputs belong to. Its outputs
+	// either don't have a port, which keeps the destination port, or a range as big as the input ports they get
+	// mapped onto. The port of these outputs is the first one of their range.
+	InputPorts PortSet
+}
+
+// DefaultMaxEndpoints is the number of endpoints a list may expand to by default.
+const DefaultMaxEndpoints = 1024
+
+// ipRange represents all ipv4 addresses between First and Last (both inclusive).
+type ipRange struct {
+	First uint32
+	Last  uint32
 }
 
-// TryParseEndpoints tries to parse a range of endpoints, e.g. "192.168.0.1:50,192.168.0.5-255:50"
+func (r ipRange) contains(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+
+	n := ipToUint32(ip4)
+
+	return n >= r.First && n <= r.Last
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIP(n uint32) net.IP {
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+}
+
+// endpointRange contains all combinations of the ips and ports in both ranges. As exclusion it excludes all endpoints
+// in the ip range, optionally only the ones with a port in the port range.
+type endpointRange struct {
+	IPs       ipRange
+	FirstPort uint16
+	LastPort  uint16
+}
+
+func (e endpointRange) excludes(endpoint Endpoint) bool {
+	if !e.IPs.contains(endpoint.IP) {
+		return false
+	}
+
+	return e.FirstPort == 0 || (endpoint.Port >= e.FirstPort && endpoint.Port <= e.LastPort)
+}
+
+// excludesAll checks whether the exclusion excludes the passed ip with all ports of the passed range.
+func (e endpointRange) excludesAll(ip uint32, firstPort uint16, lastPort uint16) bool {
+	if ip < e.IPs.First || ip > e.IPs.Last {
+		return false
+	}
+
+	return e.FirstPort == 0 || (firstPort >= e.FirstPort && lastPort <= e.LastPort)
+}
+
+// TryParseEndpoints tries to parse a range of endpoints, e.g. "192.168.0.1:50,192.168.0.5-255:50", see
+// TryParseEndpointsWithOptions for all supported notations.
 func TryParseEndpoints(ipStr string) ([]Endpoint, error) {
-	// 192.168.0.1:50
-	// 192.168.0.1-255:50
-	// 192.168.0.1:50,192.168.0.5-255:50
-	endpoints := make([]Endpoint, 0)
+	return TryParseEndpointsWithOptions(ipStr, EndpointParseOptions{MaxEndpoints: DefaultMaxEndpoints})
+}
+
+// TryParseEndpointsWithOptions tries to parse a comma separated list of endpoints, every one consisting of ips and
+// ports which get expanded into all their combinations:
+//
+//	192.168.0.1:50                single endpoint
+//	192.168.0.5-255:50            range in the last octet
+//	192.168.0.250-192.168.1.10:50 range across octets
+//	192.168.0.0/28:50             cidr block, without network and broadcast address by default
+//	192.168.0.1:8080-8082         port range
+//	!192.168.0.7 or !192.168.0.7:50 excludes ips (optionally with ports), also as range or cidr block
+func TryParseEndpointsWithOptions(ipStr string, options EndpointParseOptions) ([]Endpoint, error) {
+	ranges := make([]endpointRange, 0)
+	exclusions := make([]endpointRange, 0)
 
 	parts := strings.Split(ipStr, ",")
 
 	for _, p := range parts {
-		ipPortParts := strings.Split(p, ":")
+		exclude := strings.HasPrefix(p, "!")
+		part := strings.TrimPrefix(p, "!")
+
+		ipPortParts := strings.Split(part, ":")
+		if (exclude || len(options.InputPorts) > 0) && len(ipPortParts) == 1 {
+			ipPortParts = append(ipPortParts, "")
+		}
+
 		if len(ipPortParts) != 2 {
 			return nil, fmt.Errorf("expected ip:port or ip-max:port but got `%s`", p)
 		}
 
-		ipPart := ipPortParts[0]
-		portPart := ipPortParts[1]
-		port, err := strconv.Atoi(portPart)
+		ips, err := parseIPRange(ipPortParts[0], p, options)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't parse port `%s` in `%s`, see: %v", portPart, p, err)
+			return nil, err
+		}
+
+		firstPort, lastPort := uint16(0), uint16(0)
+		if ipPortParts[1] != "" || (!exclude && len(options.InputPorts) == 0) {
+			firstPort, lastPort, err = parsePortRange(ipPortParts[1])
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse port `%s` in `%s`, see: %v", ipPortParts[1], p, err)
+			}
 		}
 
-		rangeParts := strings.Split(ipPart, "-")
+		if len(options.InputPorts) > 0 && !exclude && firstPort != 0 {
+			span := options.InputPorts.Last() - options.InputPorts.First()
+			if lastPort-firstPort != span {
+				return nil, fmt.Errorf("outputs of loadbalancers with multiple ports either keep the port or map the ports onto a range of %d ports, but got `%s`", span+1, p)
+			}
 
-		if len(rangeParts) > 2 {
-			return nil, fmt.Errorf("expected ip or ip range but got `%s`", p)
+			lastPort = firstPort
 		}
 
-		ip := net.ParseIP(rangeParts[0])
-		if ip == nil {
-			return nil, fmt.Errorf("couldn't parse `%s` as ip", p)
+		if exclude {
+			exclusions = append(exclusions, endpointRange{IPs: ips, FirstPort: firstPort, LastPort: lastPort})
+			continue
 		}
 
-		ip = ip.To4()
+		ranges = append(ranges, endpointRange{IPs: ips, FirstPort: firstPort, LastPort: lastPort})
+	}
 
-		if ip == nil {
-			return nil, fmt.Errorf("couldn't convert ip `%s` to ipv4", rangeParts[0])
-		}
+	// The limit applies to the endpoints left after the exclusions, which get skipped without expanding them
+	endpoints := make([]Endpoint, 0)
+	for _, r := range ranges {
+	ips:
+		for n := uint64(r.IPs.First); n <= uint64(r.IPs.Last); n++ {
+			for _, exclusion := range exclusions {
+				if exclusion.excludesAll(uint32(n), r.FirstPort, r.LastPort) {
+					n = uint64(exclusion.IPs.Last)
+					continue ips
+				}
+			}
 
-		endpoints = append(endpoints, Endpoint{IP: ip, Port: uint16(port)})
+			for port := uint32(r.FirstPort); port <= uint32(r.LastPort); port++ {
+				endpoint := Endpoint{IP: uint32ToIP(uint32(n)), Port: uint16(port)}
 
-		isRange := len(rangeParts) == 2
-		if !isRange {
-			continue
+				excluded := false
+				for _, exclusion := range exclusions {
+					excluded = excluded || exclusion.excludes(endpoint)
+				}
+
+				if excluded {
+					continue
+				}
+
+				if options.MaxEndpoints > 0 && len(endpoints) == options.MaxEndpoints {
+					return nil, fmt.Errorf("`%s` expands to more than %d endpoints, split it up or raise the limit", ipStr, options.MaxEndpoints)
+				}
+
+				endpoints = append(endpoints, endpoint)
+			}
 		}
+	}
 
-		min := int(ip[3])
+	return endpoints, nil
+}
 
-		max, err := strconv.Atoi(rangeParts[1])
-		if err != nil {
-			return nil, fmt.Errorf("couldn't parse max part of ip range `%s`, see: %v", p, err)
+// parseIPRange parses a single ip, a range like "10.0.0.1-5" or "10.0.0.250-10.0.1.5" or a cidr block.
+func parseIPRange(ipPart string, p string, options EndpointParseOptions) (ipRange, error) {
+	if strings.Contains(ipPart, "/") {
+		ip, ipNet, err := net.ParseCIDR(ipPart)
+		if err != nil || ip.To4() == nil {
+			return ipRange{}, fmt.Errorf("couldn't parse `%s` as ipv4 cidr", p)
 		}
 
-		if min > max {
-			return nil, fmt.Errorf("lower address specified in range `%s` is bigger than upper", p)
+		ones, bits := ipNet.Mask.Size()
+		first := ipToUint32(ipNet.IP.To4())
+		last := first | uint32(1<<uint(bits-ones)-1)
+
+		if !options.KeepNetworkAndBroadcast && bits-ones > 1 {
+			first++
+			last--
 		}
 
-		if min == max {
-			continue
+		return ipRange{First: first, Last: last}, nil
+	}
+
+	rangeParts := strings.Split(ipPart, "-")
+
+	if len(rangeParts) > 2 {
+		return ipRange{}, fmt.Errorf("expected ip or ip range but got `%s`", p)
+	}
+
+	ip := net.ParseIP(rangeParts[0])
+	if ip == nil {
+		return ipRange{}, fmt.Errorf("couldn't parse `%s` as ip", p)
+	}
+
+	ip = ip.To4()
+
+	if ip == nil {
+		return ipRange{}, fmt.Errorf("couldn't convert ip `%s` to ipv4", rangeParts[0])
+	}
+
+	first := ipToUint32(ip)
+
+	if len(rangeParts) == 1 {
+		return ipRange{First: first, Last: first}, nil
+	}
+
+	// Full address as upper bound, e.g. 10.0.0.250-10.0.1.10
+	if strings.Contains(rangeParts[1], ".") {
+		lastIP := net.ParseIP(rangeParts[1]).To4()
+		if lastIP == nil {
+			return ipRange{}, fmt.Errorf("couldn't parse upper address of range `%s` as ipv4", p)
 		}
 
-		if max > 255 {
-			return nil, fmt.Errorf(
-				"invalid maximum ip for range `%s` given", p)
+		last := ipToUint32(lastIP)
+		if first > last {
+			return ipRange{}, fmt.Errorf("lower address specified in range `%s` is bigger than upper", p)
 		}
 
-		for i := min + 1; i <= max; i++ {
-			endpoint := Endpoint{
-				IP:   net.IPv4(ip[0], ip[1], ip[2], byte(i)),
-				Port: uint16(port),
-			}
+		return ipRange{First: first, Last: last}, nil
+	}
 
-			endpoints = append(endpoints, endpoint)
-		}
+	min := int(ip[3])
+
+	max, err := strconv.Atoi(rangeParts[1])
+	if err != nil {
+		return ipRange{}, fmt.Errorf("couldn't parse max part of ip range `%s`, see: %v", p, err)
 	}
 
-	return endpoints, nil
+	if min > max {
+		return ipRange{}, fmt.Errorf("lower address specified in range `%s` is bigger than upper", p)
+	}
+
+	if max > 255 {
+		return ipRange{}, fmt.Errorf(
+			"invalid maximum ip for range `%s` given", p)
+	}
+
+	return ipRange{First: first, Last: first - uint32(min) + uint32(max)}, nil
+}
+
+// parsePortRange parses a single port or a range like "8080-8090".
+func parsePortRange(str string) (uint16, uint16, error) {
+	rangeParts := strings.Split(str, "-")
+	if len(rangeParts) > 2 {
+		return 0, 0, fmt.Errorf("expected port or port range but got `%s`", str)
+	}
+
+	first, err := parsePort(rangeParts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(rangeParts) == 1 {
+		return first, first, nil
+	}
+
+	last, err := parsePort(rangeParts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if first > last {
+		return 0, 0, fmt.Errorf("lower port specified in range `%s` is bigger than upper", str)
+	}
+
+	return first, last, nil
 }
@@ -77,3 +77,245 @@ func TestParseIPsRangeIncorrectMaxTooBig(t *testing.T) {
 		err,
 		"invalid maximum ip for range `192.168.0.5-300:80` given")
 }
+
+func TestParseIPsCIDR(t *testing.T) {
+	endpoints, err := TryParseEndpoints("10.0.0.0/30:80")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, endpoints, []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 80},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 80},
+	})
+
+	endpoints, err = TryParseEndpointsWithOptions("10.0.0.0/30:80", EndpointParseOptions{KeepNetworkAndBroadcast: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(endpoints), 4)
+
+	endpoints, err = TryParseEndpoints("10.0.0.5/32:80,10.0.0.8/31:80")
+	assert.NilError(t, err)
+	assert.Equal(t, len(endpoints), 3)
+
+	_, err = TryParseEndpoints("10.0.0.0/33:80")
+	assert.Error(t, err, "couldn't parse `10.0.0.0/33:80` as ipv4 cidr")
+}
+
+func TestParseIPsFullRange(t *testing.T) {
+	endpoints, err := TryParseEndpoints("10.0.0.254-10.0.1.1:80")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, endpoints, []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 254), Port: 80},
+		{IP: net.IPv4(10, 0, 0, 255), Port: 80},
+		{IP: net.IPv4(10, 0, 1, 0), Port: 80},
+		{IP: net.IPv4(10, 0, 1, 1), Port: 80},
+	})
+
+	_, err = TryParseEndpoints("10.0.1.1-10.0.0.1:80")
+	assert.Error(t, err, "lower address specified in range `10.0.1.1-10.0.0.1:80` is bigger than upper")
+}
+
+func TestParseIPsPortRange(t *testing.T) {
+	endpoints, err := TryParseEndpoints("10.0.0.1-2:8080-8081")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, endpoints, []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 8080},
+		{IP: net.IPv4(10, 0, 0, 1), Port: 8081},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 8080},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 8081},
+	})
+
+	_, err = TryParseEndpoints("10.0.0.1:8081-8080")
+	assert.Assert(t, err != nil)
+}
+
+func TestParseIPsExclusions(t *testing.T) {
+	endpoints, err := TryParseEndpoints("10.0.0.0/29:80,10.0.0.1:81,!10.0.0.1:80,!10.0.0.4-5,!10.0.0.6/32")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, endpoints, []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 2), Port: 80},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 80},
+		{IP: net.IPv4(10, 0, 0, 1), Port: 81},
+	})
+}
+
+func TestParseIPsSizeLimit(t *testing.T) {
+	_, err := TryParseEndpoints("10.0.0.0/8:80")
+	assert.Error(t, err, "`10.0.0.0/8:80` expands to more than 1024 endpoints, split it up or raise the limit")
+
+	_, err = TryParseEndpoints("10.0.0.1:1-1000,10.0.0.2:1-100")
+	assert.Assert(t, err != nil)
+
+	endpoints, err := TryParseEndpointsWithOptions("10.0.0.0/20:80", EndpointParseOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(endpoints), 4094)
+
+	// only the endpoints left after the exclusions count, excluded ones don't get expanded at all
+	endpoints, err = TryParseEndpoints("10.0.0.0/21:80,!10.0.0.0/22")
+	assert.NilError(t, err)
+	assert.Equal(t, len(endpoints), 1024)
+
+	endpoints, err = TryParseEndpoints("0.0.0.0/1:80,!0.0.0.0/1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(endpoints), 0)
+}
+
+func TestParseInputWithMultiplePorts(t *testing.T) {
+	prot, input, ports, err := TryParseInput("udp://10.0.0.1:10000-10100")
+	assert.NilError(t, err)
+	assert.Equal(t, prot, ProtocolUDP)
+	assert.Equal(t, input.String(), "10.0.0.1:10000")
+	assert.DeepEqual(t, ports, PortSet{{First: 10000, Last: 10100}})
+	assert.Equal(t, ports.Count(), 101)
+
+	_, _, ports, err = TryParseInput("tcp://10.0.0.1:30000-30100,21")
+	assert.NilError(t, err)
+	assert.Equal(t, ports.String(), "21,30000-30100")
+
+	_, input, ports, err = TryParseInput("tcp://10.0.0.1:80")
+	assert.NilError(t, err)
+	assert.Equal(t, input.Port, uint16(80))
+	assert.Assert(t, ports == nil)
+
+	_, _, _, err = TryParseInput("tcp://10.0.0.1:80-90,85")
+	assert.Error(t, err, "couldn't parse ports of `tcp://10.0.0.1:80-90,85`, see: ports `80-90` and `85` overlap")
+}
+
+func TestParsePortSetRespectsMultiportLimit(t *testing.T) {
+	ports, err := TryParsePortSet("1,3,5,7,9,11,13,15,17,19,21,23,25,27,29")
+	assert.NilError(t, err)
+	assert.Equal(t, ports.multiportSlots(), 15)
+
+	_, err = TryParsePortSet("1,3,5,7,9,11,13,15,17,19,21,23,25,27,29,31")
+	assert.ErrorContains(t, err, "need 16 multiport slots but iptables only supports 15")
+
+	// ranges take two slots
+	_, err = TryParsePortSet("1,3,5,7,9,11,13,15,17,19,21,23,25,27,100-200")
+	assert.ErrorContains(t, err, "need 16 multiport slots")
+
+	_, _, _, err = TryParseInput("udp://10.0.0.1:1,3,5,7,9,11,13,15,17,19,21,23,25,27,29,31,33,35,37,39,41")
+	assert.ErrorContains(t, err, "multiport slots")
+
+	// a single range doesn't need multiport
+	_, err = TryParsePortSet("1000-2000")
+	assert.NilError(t, err)
+}
+
+func TestParseWildcardAndInterfaceInputs(t *testing.T) {
+	lb, err := TryParseLoadbalancerInput("tcp://*:443")
+	assert.NilError(t, err)
+	assert.Assert(t, lb.InputAnyLocal)
+	assert.Equal(t, lb.Input.Port, uint16(443))
+	assert.Equal(t, lb.Key(), "tcp://*:443")
+
+	lb, err = TryParseLoadbalancerInput("udp://10.0.0.0/24%eth1:10000-10100")
+	assert.NilError(t, err)
+	assert.Equal(t, lb.InputNet.String(), "10.0.0.0/24")
+	assert.Equal(t, lb.InputInterface, "eth1")
+	assert.Equal(t, lb.InputPorts.String(), "10000-10100")
+	assert.Equal(t, lb.Key(), "udp://10.0.0.0/24%eth1:10000-10100")
+
+	// a cidr of a single ip is a plain input
+	lb, err = TryParseLoadbalancerInput("tcp://10.0.0.1/32:80")
+	assert.NilError(t, err)
+	assert.Assert(t, lb.InputNet == nil)
+	assert.Equal(t, lb.Key(), "tcp://10.0.0.1:80")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1%:80")
+	assert.ErrorContains(t, err, "invalid interface")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1%averyverylonginterface:80")
+	assert.ErrorContains(t, err, "invalid interface")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.0/33:80")
+	assert.ErrorContains(t, err, "ipv4 cidr")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1")
+	assert.ErrorContains(t, err, "expected string in format")
+}
+
+func TestParseInputWithAliases(t *testing.T) {
+	lb, err := TryParseLoadbalancerInput("tcp://10.0.0.1:21,30000-30100,tcp://10.1.0.1%eth1:21,30000-30100")
+	assert.NilError(t, err)
+	assert.Equal(t, lb.Input.String(), "10.0.0.1:21")
+	assert.Equal(t, len(lb.Aliases), 1)
+	assert.Equal(t, lb.Aliases[0].InputInterface, "eth1")
+	assert.Equal(t, lb.Key(), "tcp://10.0.0.1:21,30000-30100,tcp://10.1.0.1%eth1:21,30000-30100")
+	assert.Equal(t, len(lb.inputs()), 2)
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443,udp://10.1.0.1:443")
+	assert.ErrorContains(t, err, "doesn't have the same protocol and ports")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443,tcp://10.1.0.1:80")
+	assert.ErrorContains(t, err, "doesn't have the same protocol and ports")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443,tcp://10.1.0.1")
+	assert.ErrorContains(t, err, "couldn't parse alias")
+}
+
+func TestParseTCPUDPInput(t *testing.T) {
+	prot, input, _, err := TryParseInput("tcpudp://10.0.0.1:53")
+	assert.NilError(t, err)
+	assert.Equal(t, prot, ProtocolTCPUDP)
+	assert.Equal(t, input.String(), "10.0.0.1:53")
+	assert.DeepEqual(t, prot.Protocols(), []Protocol{ProtocolTCP, ProtocolUDP})
+	assert.Assert(t, prot.Overlaps(ProtocolUDP))
+	assert.Assert(t, !ProtocolTCP.Overlaps(ProtocolUDP))
+
+	prot, _, ports, err := TryParseInput("tcpudp://10.0.0.1:5060-5061")
+	assert.NilError(t, err)
+	assert.Equal(t, prot, ProtocolTCPUDP)
+	assert.Equal(t, ports.String(), "5060-5061")
+
+	prot, _, _, err = TryParseInput("sctp://10.0.0.1:3868")
+	assert.NilError(t, err)
+	assert.Equal(t, prot, ProtocolSCTP)
+	assert.Assert(t, !prot.Overlaps(ProtocolTCPUDP))
+
+	// only inputs may cover both protocols
+	_, err = TryParseProtocol("tcpudp")
+	assert.Assert(t, err != nil)
+}
+
+func TestParseOutputsOfMultiplePorts(t *testing.T) {
+	options := EndpointParseOptions{InputPorts: PortSet{{First: 10000, Last: 10100}}}
+
+	endpoints, err := TryParseEndpointsWithOptions("10.0.0.1-2,10.0.1.1:20000-20100", options)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, endpoints, []Endpoint{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 0},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 0},
+		{IP: net.IPv4(10, 0, 1, 1), Port: 20000},
+	})
+
+	_, err = TryParseEndpointsWithOptions("10.0.1.1:20000", options)
+	assert.Error(t, err, "outputs of loadbalancers with multiple ports either keep the port or map the ports onto a range of 101 ports, but got `10.0.1.1:20000`")
+
+	lb := NewLoadbalancer(ProtocolUDP, NewEndpoint(net.IPv4(10, 50, 0, 1), 10000), endpoints...)
+	lb.InputPorts = options.InputPorts
+	assert.Equal(t, lb.Key(), "udp://10.50.0.1:10000-10100")
+	assert.Equal(t, lb.OutputString(endpoints[0]), "10.0.0.1")
+	assert.Equal(t, lb.OutputString(endpoints[2]), "10.0.1.1:20000-20100")
+	assert.DeepEqual(t, lb.OutputPorts(endpoints[2]), PortSet{{First: 20000, Last: 20100}})
+}
+
+func TestParseInputWithSourceFilters(t *testing.T) {
+	lb, err := TryParseLoadbalancerInput("tcp://10.0.0.1:443,tcp://10.1.0.1:443?allow=10.0.0.0/8,192.168.1.1&deny=10.1.0.0/16")
+	assert.NilError(t, err)
+	assert.Equal(t, len(lb.Aliases), 1)
+	assert.Equal(t, formatIPNets(lb.AllowSources), "10.0.0.0/8,192.168.1.1")
+	assert.Equal(t, formatIPNets(lb.DenySources), "10.1.0.0/16")
+	assert.Equal(t, lb.Key(), "tcp://10.0.0.1:443,tcp://10.1.0.1:443")
+	assert.Equal(t, lb.InputString(), "tcp://10.0.0.1:443,tcp://10.1.0.1:443?allow=10.0.0.0/8,192.168.1.1&deny=10.1.0.0/16")
+
+	lb, err = TryParseLoadbalancerInput("udp://10.0.0.1:53?deny=172.16.0.0/12")
+	assert.NilError(t, err)
+	assert.Equal(t, len(lb.AllowSources), 0)
+	assert.Equal(t, lb.InputString(), "udp://10.0.0.1:53?deny=172.16.0.0/12")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443?allow=10.0.0.0/33")
+	assert.ErrorContains(t, err, "couldn't parse source")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443?permit=10.0.0.0/8")
+	assert.ErrorContains(t, err, "unknown source filter")
+
+	_, err = TryParseLoadbalancerInput("tcp://10.0.0.1:443?allow=")
+	assert.ErrorContains(t, err, "expected source filter")
+}
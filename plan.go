@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/golang/glog"
+)
+
+const (
+	// PlanExitUpToDate is the exit code of the plan command in case iptables already matches the configuration.
+	PlanExitUpToDate = 0
+
+	// PlanExitFailed is the exit code of the plan command in case the plan couldn't be calculated.
+	PlanExitFailed = 1
+
+	// PlanExitChangesPending is the exit code of the plan command in case iptables has to be changed.
+	PlanExitChangesPending = 2
+)
+
+// Plan runs a single sync of the passed loadbalancers on a simulation of the current iptables state and returns
+// all changes the controller would do. All outputs of the loadbalancers are considered healthy.
+func Plan(ipt IPTables, config ControllerConfig, loadbalancers []*Loadbalancer) ([]string, error) {
+	dryRunIPT := NewDryRunIPTables(ipt)
+
+	ctrl, err := NewControllerWithIPTables(dryRunIPT, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't use upsert since it'd reset the generations of the passed loadbalancers
+	for _, lb := range loadbalancers {
+		for _, lb := range lb.PerProtocol() {
+			if lb.hasOutputs() {
+				ctrl.loadbalancers[lb.Key()] = *lb
+			}
+		}
+	}
+
+	ctrl.sync()
+
+	if ctrl.syncErrors > 0 {
+		return nil, fmt.Errorf("%d errors happened while syncing, see logs for details", ctrl.syncErrors)
+	}
+
+	return dryRunIPT.Changes(), nil
+}
+
+func plan(config ControllerConfig, loadbalancers []*Loadbalancer) int {
+	ipt, err := iptables.New()
+	if err != nil {
+		glog.Errorf("couldn't init iptables, see: %v", err)
+		return PlanExitFailed
+	}
+
+	changes, err := Plan(ipt, config, loadbalancers)
+	if err != nil {
+		glog.Errorf("couldn't plan changes, see: %v", err)
+		return PlanExitFailed
+	}
+
+	return printChanges(changes)
+}
+
+// printChanges prints the passed changes and returns the matching exit code.
+func printChanges(changes []string) int {
+	if len(changes) == 0 {
+		fmt.Println("No changes, iptables is up to date.")
+		return PlanExitUpToDate
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	fmt.Printf("\n%d changes pending.\n", len(changes))
+
+	return PlanExitChangesPending
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanOnEmptyTables(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	lb := NewLoadbalancer(ProtocolTCP, input, output1, output2)
+	lb.Generation = uint32(12345)
+
+	base := NewDryRunIPTables(nil)
+
+	changes, err := Plan(base, ControllerConfig{}, []*Loadbalancer{lb})
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	expected := `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N LB$-IADgJGy/AAAwOQAAAAAkBtYl
+iptables -t nat -A LB$-IADgJGy/AAAwOQAAAAAkBtYl -p tcp -d 10.50.1.1 --dport 1234 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:1002
+iptables -t nat -A LB$-IADgJGy/AAAwOQAAAAAkBtYl -p tcp -d 10.50.1.1 --dport 1234 -j DNAT --to-destination 10.100.0.1:1001
+iptables -t nat -E LB$-IADgJGy/AAAwOQAAAAAkBtYl LB$-IQDgJGy/AAAwOSEs9E+RHoyQ
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.1 --sport 1001 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.1 --dport 1001 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.2 --sport 1002 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.2 --dport 1002 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 1234 -j LB$-IQDgJGy/AAAwOSEs9E+RHoyQ`
+
+	actual := strings.Join(changes, "\n")
+	if strings.TrimSpace(expected) != actual {
+		t.Fatalf("expected `%s` got `%s`", expected, actual)
+	}
+
+	chains, err := base.ListChains(NATTable)
+	if err != nil {
+		t.Fatalf("couldn't list chains, see: %v", err)
+	}
+
+	if len(chains) != 0 || len(base.Changes()) != 0 {
+		t.Fatalf("plan modified the base tables, got chains %v and changes %v", chains, base.Changes())
+	}
+}
+
+func TestPlanUpToDate(t *testing.T) {
+	input, _ := TryParseEndpoint("10.50.1.1:1234")
+	output1, _ := TryParseEndpoint("10.100.0.1:1001")
+	output2, _ := TryParseEndpoint("10.100.0.2:1002")
+
+	lb := NewLoadbalancer(ProtocolTCP, input, output1, output2)
+	lb.Generation = uint32(12345)
+
+	base := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(base, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"}, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	ctrl.loadbalancers[lb.Key()] = *lb
+	ctrl.sync()
+
+	changes, err := Plan(base, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"}, []*Loadbalancer{lb})
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes but got `%s`", strings.Join(changes, "\n"))
+	}
+
+	lb = NewLoadbalancer(ProtocolTCP, input, output1)
+	lb.Generation = uint32(45678)
+
+	changes, err = Plan(base, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"}, []*Loadbalancer{lb})
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	if len(changes) == 0 {
+		t.Fatalf("expected changes after removing an output but got none")
+	}
+}
+
+// assertPlan checks the changes planned for the lbs of the passed definitions (input and outputs each) on empty tables.
+// Once they got applied, the chains have to get adopted without any further change. It returns the tables with the
+// changes applied and the lbs.
+func assertPlan(t *testing.T, config ControllerConfig, expected string, definitions ...[2]string) (*DryRunIPTables, []*Loadbalancer) {
+	t.Helper()
+
+	lbs := make([]*Loadbalancer, 0, len(definitions))
+	for _, definition := range definitions {
+		parsed, err := parseLoadbalancerDefinition(definition[0], definition[1], "none", EndpointParseOptions{})
+		if err != nil {
+			t.Fatalf("couldn't parse lb, see: %v", err)
+		}
+
+		parsed.Loadbalancer.Generation = uint32(12345)
+		lbs = append(lbs, parsed.Loadbalancer)
+	}
+
+	base := NewDryRunIPTables(nil)
+
+	changes, err := Plan(base, config, lbs)
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	actual := strings.Join(changes, "\n")
+	if strings.TrimSpace(expected) != actual {
+		t.Fatalf("expected `%s` got `%s`", expected, actual)
+	}
+
+	ctrl, err := NewControllerWithIPTables(base, config, nil)
+	if err != nil {
+		t.Fatalf("Controller couldn't start, see: %v", err)
+	}
+
+	for _, lb := range lbs {
+		ctrl.loadbalancers[lb.Key()] = *lb
+	}
+
+	ctrl.sync()
+
+	for _, lb := range lbs {
+		lb.Generation = 0
+	}
+
+	changes, err = Plan(base, config, lbs)
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes but got `%s`", strings.Join(changes, "\n"))
+	}
+
+	return base, lbs
+}
+
+func TestPlan(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		config      ControllerConfig
+		definitions [][2]string
+		expected    string
+	}{
+		{
+			name:        "multiple ports",
+			config:      ControllerConfig{HairpinningCIDR: "42.42.42.0/24", RemoveUnknownRules: true},
+			definitions: [][2]string{{"udp://10.50.1.1:10000-10100", "10.100.0.1,10.100.0.2:20000-20100"}},
+			expected: `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N iptableslb-hairpinning
+iptables -t nat -N LB$-IADWFQesAAAwOQAAAAD4WSxR
+iptables -t nat -A LB$-IADWFQesAAAwOQAAAAD4WSxR -p udp -d 10.50.1.1 --dport 10000:10100 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:20000-20100/10000
+iptables -t nat -A LB$-IADWFQesAAAwOQAAAAD4WSxR -p udp -d 10.50.1.1 --dport 10000:10100 -j DNAT --to-destination 10.100.0.1
+iptables -t nat -E LB$-IADWFQesAAAwOQAAAAD4WSxR LB$-IQDWFQesAAAwOZIiulNO2wsp
+iptables -t filter -A iptableslb-forward -p udp -s 10.100.0.1 --sport 10000:10100 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p udp -d 10.100.0.1 --dport 10000:10100 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p udp -s 10.100.0.2 --sport 20000:20100 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p udp -d 10.100.0.2 --dport 20000:20100 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p udp -d 10.50.1.1 --dport 10000:10100 -j LB$-IQDWFQesAAAwOZIiulNO2wsp
+iptables -t nat -A iptableslb-hairpinning -p udp -s 42.42.42.0/24 -d 10.100.0.1 --dport 10000:10100 -j MASQUERADE
+iptables -t nat -A iptableslb-hairpinning -p udp -s 42.42.42.0/24 -d 10.100.0.2 --dport 20000:20100 -j MASQUERADE`,
+		},
+		{
+			name:        "sctp",
+			config:      ControllerConfig{HairpinningCIDR: "42.42.42.0/24", RemoveUnknownRules: true},
+			definitions: [][2]string{{"sctp://10.50.1.1:3868", "10.100.0.1-2:3868"}},
+			expected: `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N iptableslb-hairpinning
+iptables -t nat -N LB$-IADA/0H6AAAwOQAAAADUaaxS
+iptables -t nat -A LB$-IADA/0H6AAAwOQAAAADUaaxS -p sctp -d 10.50.1.1 --dport 3868 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:3868
+iptables -t nat -A LB$-IADA/0H6AAAwOQAAAADUaaxS -p sctp -d 10.50.1.1 --dport 3868 -j DNAT --to-destination 10.100.0.1:3868
+iptables -t nat -E LB$-IADA/0H6AAAwOQAAAADUaaxS LB$-IQDA/0H6AAAwOY8cpCCPoIzC
+iptables -t filter -A iptableslb-forward -p sctp -s 10.100.0.1 --sport 3868 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p sctp -d 10.100.0.1 --dport 3868 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p sctp -s 10.100.0.2 --sport 3868 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p sctp -d 10.100.0.2 --dport 3868 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p sctp -d 10.50.1.1 --dport 3868 -j LB$-IQDA/0H6AAAwOY8cpCCPoIzC
+iptables -t nat -A iptableslb-hairpinning -p sctp -s 42.42.42.0/24 -d 10.100.0.1 --dport 3868 -j MASQUERADE
+iptables -t nat -A iptableslb-hairpinning -p sctp -s 42.42.42.0/24 -d 10.100.0.2 --dport 3868 -j MASQUERADE`,
+		},
+		{
+			name:        "wildcard and interface inputs",
+			config:      ControllerConfig{RemoveUnknownRules: true},
+			definitions: [][2]string{{"tcp://*:443", "10.100.0.1-2:8080"}, {"tcp://10.50.0.0/24%eth1:80", "10.100.0.1-2:8080"}},
+			expected: `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N LB$-IAAuuuihAAAwOQAAAAAPQ6Vo
+iptables -t nat -A LB$-IAAuuuihAAAwOQAAAAAPQ6Vo -p tcp --dport 443 -m addrtype --dst-type LOCAL -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:8080
+iptables -t nat -A LB$-IAAuuuihAAAwOQAAAAAPQ6Vo -p tcp --dport 443 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.100.0.1:8080
+iptables -t nat -E LB$-IAAuuuihAAAwOQAAAAAPQ6Vo LB$-IQAuuuihAAAwOYz248oeKsQC
+iptables -t nat -N LB$-IAAgySWlAAAwOQAAAAAQWMXx
+iptables -t nat -A LB$-IAAgySWlAAAwOQAAAAAQWMXx -p tcp -d 10.50.0.0/24 -i eth1 --dport 80 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:8080
+iptables -t nat -A LB$-IAAgySWlAAAwOQAAAAAQWMXx -p tcp -d 10.50.0.0/24 -i eth1 --dport 80 -j DNAT --to-destination 10.100.0.1:8080
+iptables -t nat -E LB$-IAAgySWlAAAwOQAAAAAQWMXx LB$-IQAgySWlAAAwOWwG7iY1gF8m
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.1 --sport 8080 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.1 --dport 8080 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.2 --sport 8080 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.2 --dport 8080 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p tcp --dport 443 -m addrtype --dst-type LOCAL -j LB$-IQAuuuihAAAwOYz248oeKsQC
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.50.0.0/24 -i eth1 --dport 80 -j LB$-IQAgySWlAAAwOWwG7iY1gF8m`,
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			assertPlan(t, c.config, c.expected, c.definitions...)
+		})
+	}
+}
+
+func TestPlanAliases(t *testing.T) {
+	base, _ := assertPlan(t, ControllerConfig{RemoveUnknownRules: true}, `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N LB$-IADerDiFAAAwOQAAAAD3+2Xg
+iptables -t nat -A LB$-IADerDiFAAAwOQAAAAD3+2Xg -p tcp --dport 443 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.0.2:8443
+iptables -t nat -A LB$-IADerDiFAAAwOQAAAAD3+2Xg -p tcp --dport 443 -j DNAT --to-destination 10.100.0.1:8443
+iptables -t nat -E LB$-IADerDiFAAAwOQAAAAD3+2Xg LB$-IQDerDiFAAAwOf9a4VBgdMPo
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.1 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.1 --dport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.2 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.2 --dport 8443 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 443 -j LB$-IQDerDiFAAAwOf9a4VBgdMPo
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.60.1.1 -i eth1 --dport 443 -j LB$-IQDerDiFAAAwOf9a4VBgdMPo`, [2]string{"tcp://10.50.1.1:443,tcp://10.60.1.1%eth1:443", "10.100.0.1-2:8443"})
+
+	// dropping an alias replaces the chain and removes all rules jumping into the old one
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:443", "10.100.0.1-2:8443", "none", EndpointParseOptions{})
+	if err != nil {
+		t.Fatalf("couldn't parse lb, see: %v", err)
+	}
+
+	changes, err := Plan(base, ControllerConfig{}, []*Loadbalancer{definition.Loadbalancer})
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	actual := strings.Join(changes, "\n")
+	for _, change := range []string{
+		"iptables -t nat -D iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 443 -j LB$-IQDerDiFAAAwOf9a4VBgdMPo",
+		"iptables -t nat -D iptableslb-prerouting -p tcp -d 10.60.1.1 -i eth1 --dport 443 -j LB$-IQDerDiFAAAwOf9a4VBgdMPo",
+		"iptables -t nat -X LB$-IQDerDiFAAAwOf9a4VBgdMPo",
+	} {
+		if !strings.Contains(actual, change) {
+			t.Fatalf("expected `%s` in `%s`", change, actual)
+		}
+	}
+}
+
+func TestPlanSourceFilters(t *testing.T) {
+	config := ControllerConfig{RemoveUnknownRules: true}
+	base, _ := assertPlan(t, config, `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t filter -N iptableslb-input
+iptables -t nat -N LB$-IABkRCOmAAAwOQAAAAC5RNSb
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -j MARK --set-xmark 0x20000/0x20000
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -s 10.0.0.0/8 -j MARK --set-xmark 0x0/0x20000
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -s 192.168.0.0/16 -j MARK --set-xmark 0x0/0x20000
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -s 10.1.0.0/16 -j MARK --set-xmark 0x20000/0x20000
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -m mark --mark 0x20000/0x20000 -j RETURN
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -d 10.50.1.1 --dport 443 -j DNAT --to-destination 10.100.0.1:8443
+iptables -t nat -E LB$-IABkRCOmAAAwOQAAAAC5RNSb LB$-IQBkRCOmAAAwOYoMkimt2pVR
+iptables -t filter -I iptableslb-forward 1 -m mark --mark 0x20000/0x20000 -j DROP
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.1 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.1 --dport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-input -m mark --mark 0x20000/0x20000 -j DROP
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 443 -j LB$-IQBkRCOmAAAwOYoMkimt2pVR`, [2]string{"tcp://10.50.1.1:443?allow=10.0.0.0/8,192.168.0.0/16&deny=10.1.0.0/16", "10.100.0.1:8443"})
+
+	// without source filters the chain gets replaced and nothing gets dropped anymore
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:443", "10.100.0.1:8443", "none", EndpointParseOptions{})
+	if err != nil {
+		t.Fatalf("couldn't parse lb, see: %v", err)
+	}
+
+	changes, err := Plan(base, config, []*Loadbalancer{definition.Loadbalancer})
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	actual := strings.Join(changes, "\n")
+	for _, change := range []string{
+		"iptables -t nat -D iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 443 -j LB$-IQBkRCOmAAAwOYoMkimt2pVR",
+		"iptables -t nat -X LB$-IQBkRCOmAAAwOYoMkimt2pVR",
+		"iptables -t filter -D iptableslb-forward -m mark --mark 0x20000/0x20000 -j DROP",
+		"iptables -t filter -D iptableslb-input -m mark --mark 0x20000/0x20000 -j DROP",
+	} {
+		if !strings.Contains(actual, change) {
+			t.Fatalf("expected `%s` in `%s`", change, actual)
+		}
+	}
+}
+
+func TestPlanPools(t *testing.T) {
+	config := ControllerConfig{RemoveUnknownRules: true}
+	base, lbs := assertPlan(t, config, `
+iptables -t filter -N iptableslb-forward
+iptables -t nat -N iptableslb-prerouting
+iptables -t nat -N LB$-IABkRCOmAAAwOQAAAAC5RNSb
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -s 10.0.0.0/8 -d 10.50.1.1 --dport 443 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.1.2:8443
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -s 10.0.0.0/8 -d 10.50.1.1 --dport 443 -j DNAT --to-destination 10.100.1.1:8443
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -s 172.16.0.0/12 -d 10.50.1.1 --dport 443 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.100.1.2:8443
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -s 172.16.0.0/12 -d 10.50.1.1 --dport 443 -j DNAT --to-destination 10.100.1.1:8443
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -s 192.0.2.0/24 -d 10.50.1.1 --dport 443 -j DNAT --to-destination 10.100.2.1:8443
+iptables -t nat -A LB$-IABkRCOmAAAwOQAAAAC5RNSb -p tcp -d 10.50.1.1 --dport 443 -j DNAT --to-destination 10.100.0.1:8443
+iptables -t nat -E LB$-IABkRCOmAAAwOQAAAAC5RNSb LB$-IQBkRCOmAAAwORi0EFBozmzI
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.0.1 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.0.1 --dport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.1.1 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.1.1 --dport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.1.2 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.1.2 --dport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -s 10.100.2.1 --sport 8443 -j ACCEPT
+iptables -t filter -A iptableslb-forward -p tcp -d 10.100.2.1 --dport 8443 -j ACCEPT
+iptables -t nat -A iptableslb-prerouting -p tcp -d 10.50.1.1 --dport 443 -j LB$-IQBkRCOmAAAwORi0EFBozmzI`, [2]string{"tcp://10.50.1.1:443", "10.0.0.0/8,172.16.0.0/12=10.100.1.1-2:8443;192.0.2.0/24=10.100.2.1:8443;10.100.0.1:8443"})
+
+	// a pool without healthy outputs loses its cascade, so its sources get the remaining outputs
+	lbs[0].Pools[1].Outputs = nil
+	changes, err := Plan(base, config, lbs)
+	if err != nil {
+		t.Fatalf("couldn't plan, see: %v", err)
+	}
+
+	actual := strings.Join(changes, "\n")
+	if strings.Contains(actual, "-s 192.0.2.0/24") {
+		t.Fatalf("expected no cascade for the pool without outputs in `%s`", actual)
+	}
+
+	for _, change := range []string{
+		"iptables -t nat -X LB$-IQBkRCOmAAAwORi0EFBozmzI",
+		"iptables -t filter -D iptableslb-forward -p tcp -d 10.100.2.1 --dport 8443 -j ACCEPT",
+	} {
+		if !strings.Contains(actual, change) {
+			t.Fatalf("expected `%s` in `%s`", change, actual)
+		}
+	}
+}
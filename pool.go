@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Pool contains outputs of a loadbalancer which only get the traffic of some sources.
+type Pool struct {
+	Sources []*net.IPNet
+	Outputs []Endpoint
+}
+
+// String returns the pool in the notation of the `-out` parameter, e.g. "10.0.0.0/8=192.168.1.1:80,192.168.1.2:80".
+func (p Pool) String(lb *Loadbalancer) string {
+	outputs := make([]string, 0, len(p.Outputs))
+	for _, output := range p.Outputs {
+		outputs = append(outputs, lb.OutputString(output))
+	}
+
+	return formatIPNets(p.Sources) + "=" + strings.Join(outputs, ",")
+}
+
+// splitPools splits outputs like "10.0.0.0/8=192.168.1.1:80;192.168.2.1:80" into the pools routed by source and the
+// outputs of all remaining traffic, which have to come last.
+func splitPools(str string) ([]string, string, error) {
+	parts := strings.Split(str, ";")
+	pools := parts[:len(parts)-1]
+
+	for _, pool := range pools {
+		if !strings.Contains(pool, "=") {
+			return nil, "", fmt.Errorf("expected pool in format <sources>=<outputs> but got `%s`, only the last outputs may go without sources", pool)
+		}
+	}
+
+	if strings.Contains(parts[len(parts)-1], "=") {
+		return nil, "", fmt.Errorf("the outputs for all remaining sources are missing after `%s`", parts[len(parts)-1])
+	}
+
+	return pools, parts[len(parts)-1], nil
+}
+
+// TryParsePool parses a pool in the format "<sources>=<outputs>", e.g. "10.0.0.0/8,172.16.0.0/12=192.168.1.1-2:80".
+func TryParsePool(str string, options EndpointParseOptions) (Pool, error) {
+	kv := strings.SplitN(str, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return Pool{}, fmt.Errorf("expected pool in format <sources>=<outputs> but got `%s`", str)
+	}
+
+	pool := Pool{Sources: make([]*net.IPNet, 0)}
+
+	for _, source := range strings.Split(kv[0], ",") {
+		ipNet, err := parseIPNet(source)
+		if err != nil || ipNet.IP.To4() == nil {
+			return Pool{}, fmt.Errorf("couldn't parse source `%s` as ipv4 cidr", source)
+		}
+
+		pool.Sources = append(pool.Sources, ipNet)
+	}
+
+	_, dnsOutputs, err := splitOutputs(kv[1])
+	if err != nil {
+		return Pool{}, err
+	}
+
+	if len(dnsOutputs) > 0 {
+		return Pool{}, fmt.Errorf("hostnames and SRV names aren't supported as outputs of pools")
+	}
+
+	pool.Outputs, err = TryParseEndpointsWithOptions(kv[1], options)
+	if err != nil {
+		return Pool{}, fmt.Errorf("couldn't parse outputs of pool `%s`, see: %v", str, err)
+	}
+
+	return pool, nil
+}
+
+// ipNetContains checks whether all addresses of b are within a.
+func ipNetContains(a *net.IPNet, b *net.IPNet) bool {
+	onesA, _ := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+
+	return onesA <= onesB && a.Contains(b.IP)
+}
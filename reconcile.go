@@ -0,0 +1,755 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// ChangeType represents the kind of a change planned by the controller.
+type ChangeType byte
+
+const (
+	// ChangeCreateChain creates an empty chain
+	ChangeCreateChain ChangeType = iota
+
+	// ChangeDeleteChain flushes and deletes a chain
+	ChangeDeleteChain
+
+	// ChangeCreateLoadbalancerChain creates, fills and activates a new chain for a loadbalancer
+	ChangeCreateLoadbalancerChain
+
+	// ChangeAppendRule appends a rule to a chain
+	ChangeAppendRule
+
+	// ChangeDeleteRule deletes a rule from a chain
+	ChangeDeleteRule
+
+	// ChangeInsertRule inserts a rule at a position into a chain
+	ChangeInsertRule
+
+	// ChangeMoveRule moves a rule from one position to another one in a chain
+	ChangeMoveRule
+)
+
+// Change represents a single modification of iptables planned by the controller.
+type Change struct {
+	Type         ChangeType
+	Table        string
+	Chain        string
+	Rule         Rule
+	Loadbalancer Loadbalancer
+	Reason       string
+
+	// Position is the 1-based position a rule gets inserted at or moved to. If set for ChangeDeleteRule, the rule
+	// at this position gets deleted.
+	Position int
+
+	// OldPosition is the 1-based position a rule gets moved from, only used by ChangeMoveRule.
+	OldPosition int
+
+	// Drift marks changes repairing manual modifications of managed chains.
+	Drift bool
+}
+
+func (c Change) String() string {
+	str := ""
+
+	switch c.Type {
+	case ChangeCreateChain:
+		str = fmt.Sprintf("create chain `%s` in table `%s`", c.Chain, c.Table)
+	case ChangeDeleteChain:
+		str = fmt.Sprintf("delete chain `%s` in table `%s`", c.Chain, c.Table)
+	case ChangeCreateLoadbalancerChain:
+		str = fmt.Sprintf("create chain for lb `%s`", c.Loadbalancer.Key())
+	case ChangeAppendRule:
+		str = fmt.Sprintf("append rule `%s` to chain `%s` in table `%s`", c.Rule.String(), c.Chain, c.Table)
+	case ChangeDeleteRule:
+		if c.Position > 0 {
+			str = fmt.Sprintf("delete rule `%s` at position %d from chain `%s` in table `%s`", c.Rule.String(), c.Position, c.Chain, c.Table)
+			break
+		}
+
+		str = fmt.Sprintf("delete rule `%s` from chain `%s` in table `%s`", c.Rule.String(), c.Chain, c.Table)
+	case ChangeInsertRule:
+		str = fmt.Sprintf("insert rule `%s` at position %d into chain `%s` in table `%s`", c.Rule.String(), c.Position, c.Chain, c.Table)
+	case ChangeMoveRule:
+		str = fmt.Sprintf("move rule `%s` from position %d to %d in chain `%s` in table `%s`", c.Rule.String(), c.OldPosition, c.Position, c.Chain, c.Table)
+	default:
+		str = "unknown change"
+	}
+
+	if c.Reason != "" {
+		str += " (" + c.Reason + ")"
+	}
+
+	return str
+}
+
+// actualState contains the parts of iptables relevant for the controller as read at one point in time.
+type actualState struct {
+	natChains    []string
+	filterChains []string
+	chainIDs     []ChainID
+
+	// rules contains the rules of all existing managed chains by table and chain
+	rules map[string]map[string][]Rule
+
+	// contentHashes contains the hashes of all ChainID chains, calculated from their rules as listed by iptables
+	contentHashes map[string]uint32
+}
+
+func (s *actualState) hasChain(table string, chain string) bool {
+	_, found := s.rules[table][chain]
+	return found
+}
+
+// chainIDsForLoadbalancer returns all chains of the loadbalancer with the passed id and state.
+func (s *actualState) chainIDsForLoadbalancer(lbID uint32, state ChainState) []ChainID {
+	chainIDs := make([]ChainID, 0)
+
+	for _, chainID := range s.chainIDs {
+		if chainID.LoadbalancerID == lbID && chainID.State == state {
+			chainIDs = append(chainIDs, chainID)
+		}
+	}
+
+	return chainIDs
+}
+
+// desiredState contains all rules the controller wants to have in its chains.
+type desiredState struct {
+	forwardRules     []Rule
+	hairpinningRules []Rule
+	inputRules       []Rule
+}
+
+// readActualState reads all managed chains from iptables.
+func (c *Controller) readActualState() (*actualState, error) {
+	s := &actualState{
+		rules: map[string]map[string][]Rule{
+			NATTable:    make(map[string][]Rule),
+			FilterTable: make(map[string][]Rule),
+		},
+		contentHashes: make(map[string]uint32),
+	}
+
+	var err error
+
+	s.natChains, err = c.ipt.ListChains(NATTable)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list all chains in nat table, see: %v", err)
+	}
+
+	s.filterChains, err = c.ipt.ListChains(FilterTable)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list all chains in filter table, see: %v", err)
+	}
+
+	for _, chains := range [][]string{s.natChains, s.filterChains} {
+		err = c.checkInstanceTag(chains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.chainIDs = c.findChainIDs(s.natChains)
+
+	managedChains := map[string][]string{
+		NATTable:    {c.mainChainName, c.outputChainName, c.hairpinningChainName},
+		FilterTable: {c.forwardChainName, c.inputChainName},
+	}
+
+	for _, chainID := range s.chainIDs {
+		managedChains[NATTable] = append(managedChains[NATTable], chainID.String())
+	}
+
+	for _, jump := range c.getBuiltinJumps() {
+		managedChains[jump.Table] = append(managedChains[jump.Table], jump.Chain)
+	}
+
+	existingChains := map[string][]string{
+		NATTable:    s.natChains,
+		FilterTable: s.filterChains,
+	}
+
+	for table, chains := range managedChains {
+		for _, chain := range chains {
+			if !stringsContain(existingChains[table], chain) {
+				continue
+			}
+
+			rawRules, err := c.ipt.List(table, chain)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't retrieve rules in chain `%s` of table `%s`, see: %v", chain, table, err)
+			}
+
+			if _, err := TryParseChainID(chain); err == nil {
+				s.contentHashes[chain] = c.calculateHashForRules(rawRules)
+			}
+
+			rules := make([]Rule, 0, len(rawRules))
+			for _, rawRule := range rawRules {
+				if !strings.HasPrefix(rawRule, "-A ") {
+					// e.g. -N or -P rule
+					continue
+				}
+
+				rule, err := TryParseRule(rawRule)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse rule `%s` in chain `%s` of table `%s`, see: %v", rawRule, chain, table, err)
+				}
+
+				rules = append(rules, rule)
+			}
+
+			s.rules[table][chain] = rules
+		}
+	}
+
+	return s, nil
+}
+
+// desiredState calculates all rules wanted for the configured loadbalancers.
+func (c *Controller) desiredState() *desiredState {
+	s := &desiredState{
+		forwardRules:     make([]Rule, 0),
+		hairpinningRules: make([]Rule, 0),
+		inputRules:       make([]Rule, 0),
+	}
+
+	// Rejected traffic has to be dropped before any of it might get accepted, the one to local addresses never passes
+	// the forward chain
+	if c.hasSourceFilters() {
+		s.forwardRules = append(s.forwardRules, c.getRejectRule())
+		s.inputRules = append(s.inputRules, c.getRejectRule())
+	}
+
+	for _, lbKey := range c.sortedLoadbalancerKeys() {
+		lb := c.loadbalancers[lbKey]
+
+		for _, output := range lb.allOutputs() {
+			ports := lb.OutputPorts(output)
+
+			s.forwardRules = appendUniqueRule(s.forwardRules, c.getSrcForwardRuleForEndpointAndProt(output, ports, lb.Protocol))
+			s.forwardRules = appendUniqueRule(s.forwardRules, c.getDstForwardRuleForEndpointAndProt(output, ports, lb.Protocol))
+
+			if c.hairpinningCIDR == "" {
+				continue
+			}
+
+			rule, err := c.getHairpinningRuleForEndpoint(output, ports, lb.Protocol)
+			if err != nil {
+				glog.Errorf("couldn't create hairpinning rule for output `%s` of lb `%s`, see: %v", output.String(), lbKey, err)
+				c.countError()
+				continue
+			}
+
+			s.hairpinningRules = appendUniqueRule(s.hairpinningRules, rule)
+		}
+	}
+
+	return s
+}
+
+// planChains plans the creation of all missing chains and the deletion of chains stuck in creation.
+func (c *Controller) planChains(actual *actualState, desired *desiredState) []Change {
+	changes := make([]Change, 0)
+
+	for _, chainID := range actual.chainIDs {
+		if chainID.State == ChainCreating {
+			changes = append(changes, Change{
+				Type:   ChangeDeleteChain,
+				Table:  NATTable,
+				Chain:  chainID.String(),
+				Reason: "chain stuck in creation",
+			})
+		}
+	}
+
+	if !actual.hasChain(FilterTable, c.forwardChainName) {
+		changes = append(changes, Change{Type: ChangeCreateChain, Table: FilterTable, Chain: c.forwardChainName})
+	}
+
+	if !actual.hasChain(NATTable, c.mainChainName) {
+		changes = append(changes, Change{Type: ChangeCreateChain, Table: NATTable, Chain: c.mainChainName})
+	}
+
+	if c.localTraffic && !actual.hasChain(NATTable, c.outputChainName) {
+		changes = append(changes, Change{Type: ChangeCreateChain, Table: NATTable, Chain: c.outputChainName})
+	}
+
+	if c.hairpinningCIDR != "" && !actual.hasChain(NATTable, c.hairpinningChainName) {
+		changes = append(changes, Change{Type: ChangeCreateChain, Table: NATTable, Chain: c.hairpinningChainName})
+	}
+
+	if c.hasSourceFilters() && !actual.hasChain(FilterTable, c.inputChainName) {
+		changes = append(changes, Change{Type: ChangeCreateChain, Table: FilterTable, Chain: c.inputChainName})
+	}
+
+	for _, lbKey := range c.sortedLoadbalancerKeys() {
+		lb := c.loadbalancers[lbKey]
+		lbID := lb.ID(c.instanceTag)
+		current := false
+
+		for _, chainID := range actual.chainIDsForLoadbalancer(lbID, ChainCreated) {
+			if lb.Generation == 0 || chainID.Generation != lb.Generation {
+				continue
+			}
+
+			if actual.contentHashes[chainID.String()] != chainID.ContentHash {
+				glog.Warningf("chain `%s` for lb `%s` got manipulated, content hash isn't matching anymore, marking lb as updated so it gets recreated.", chainID.String(), lbKey)
+				lb.MarkUpdated()
+				c.loadbalancers[lbKey] = lb
+				continue
+			}
+
+			current = true
+		}
+
+		if current {
+			continue
+		}
+
+		// e.g. after a restart or if the outputs changed back, the chain might still be there
+		if adoptable, found := c.findAdoptableChain(actual, lb); found {
+			glog.Infof("adopting chain `%s` for lb `%s` since it already contains the wanted rules", adoptable.String(), lbKey)
+			lb.Generation = adoptable.Generation
+			c.loadbalancers[lbKey] = lb
+			continue
+		}
+
+		lb.Generation = c.getNewGeneration(lb, actual.chainIDsForLoadbalancer(lbID, ChainCreating), actual.chainIDsForLoadbalancer(lbID, ChainCreated))
+		c.loadbalancers[lbKey] = lb
+
+		changes = append(changes, Change{Type: ChangeCreateLoadbalancerChain, Table: NATTable, Loadbalancer: lb})
+	}
+
+	return changes
+}
+
+// planAdditions plans all rules missing in the forward, input, main, output and hairpinning chain as well as missing
+// jumps into them.
+func (c *Controller) planAdditions(actual *actualState, desired *desiredState) []Change {
+	changes := c.planJumps(actual)
+
+	rejectRule := c.getRejectRule()
+	for _, rule := range desired.forwardRules {
+		if RulesContain(actual.rules[FilterTable][c.forwardChainName], rule) {
+			continue
+		}
+
+		if rule.Equals(rejectRule) {
+			changes = append(changes, Change{Type: ChangeInsertRule, Table: FilterTable, Chain: c.forwardChainName, Rule: rule, Position: 1})
+			continue
+		}
+
+		changes = append(changes, Change{Type: ChangeAppendRule, Table: FilterTable, Chain: c.forwardChainName, Rule: rule})
+	}
+
+	for _, rule := range desired.inputRules {
+		if !RulesContain(actual.rules[FilterTable][c.inputChainName], rule) {
+			changes = append(changes, Change{Type: ChangeAppendRule, Table: FilterTable, Chain: c.inputChainName, Rule: rule})
+		}
+	}
+
+	for _, lbKey := range c.sortedLoadbalancerKeys() {
+		lb := c.loadbalancers[lbKey]
+		createdChains := actual.chainIDsForLoadbalancer(lb.ID(c.instanceTag), ChainCreated)
+		if len(createdChains) == 0 {
+			glog.V(4).Infof("skipping mainChain entry for lb `%s` since no chains have been created for it yet", lbKey)
+			continue
+		}
+
+		latest := c.getActiveChainID(lb, createdChains)
+
+		for _, rule := range c.getMainChainRulesToChain(lb, latest) {
+			for _, dispatchChain := range c.getDispatchChains() {
+				if !RulesContain(actual.rules[NATTable][dispatchChain], rule) {
+					changes = append(changes, Change{
+						Type:   ChangeAppendRule,
+						Table:  NATTable,
+						Chain:  dispatchChain,
+						Rule:   rule,
+						Reason: fmt.Sprintf("activating chain of lb `%s`", lbKey),
+					})
+				}
+			}
+		}
+	}
+
+	for _, rule := range desired.hairpinningRules {
+		if !RulesContain(actual.rules[NATTable][c.hairpinningChainName], rule) {
+			changes = append(changes, Change{Type: ChangeAppendRule, Table: NATTable, Chain: c.hairpinningChainName, Rule: rule})
+		}
+	}
+
+	return changes
+}
+
+// planDeletions plans the deletion of all obsolete main and output chain entries, chains, forward, input and
+// hairpinning rules.
+func (c *Controller) planDeletions(actual *actualState, desired *desiredState) []Change {
+	changes := make([]Change, 0)
+	referencedChains := make(map[string]struct{})
+
+	for _, dispatchChain := range c.getDispatchChains() {
+		changes = append(changes, c.planDispatchDeletions(actual, dispatchChain, referencedChains)...)
+	}
+
+	// Remove all chains which ain't referenced in mainchain anymore
+	for _, chainID := range actual.chainIDs {
+		if chainID.State != ChainCreated {
+			continue
+		}
+
+		if _, referenced := referencedChains[chainID.String()]; referenced {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Type:   ChangeDeleteChain,
+			Table:  NATTable,
+			Chain:  chainID.String(),
+			Reason: "unreferenced chain",
+		})
+	}
+
+	changes = append(changes, c.planForwardDeletions(actual, referencedChains)...)
+
+	for _, rule := range actual.rules[FilterTable][c.inputChainName] {
+		if c.inputRuleStatus(rule) == ruleKnown && !RulesContain(desired.inputRules, rule) {
+			changes = append(changes, Change{Type: ChangeDeleteRule, Table: FilterTable, Chain: c.inputChainName, Rule: rule})
+		}
+	}
+
+	if c.hairpinningCIDR == "" {
+		glog.V(5).Infof("skipping deletion of obsolete hairpinning chain entries since no cidr is configured")
+		return changes
+	}
+
+	for _, rule := range actual.rules[NATTable][c.hairpinningChainName] {
+		if c.hairpinningRuleStatus(rule) == ruleKnown && !RulesContain(desired.hairpinningRules, rule) {
+			changes = append(changes, Change{Type: ChangeDeleteRule, Table: NATTable, Chain: c.hairpinningChainName, Rule: rule})
+		}
+	}
+
+	return changes
+}
+
+// planDispatchDeletions plans the deletion of all entries in the passed dispatch chain except the latest one of every
+// configured loadbalancer. In case the lb isn't in config at all, all of them get removed. The chains still referenced
+// get added to referencedChains.
+func (c *Controller) planDispatchDeletions(actual *actualState, dispatchChain string, referencedChains map[string]struct{}) []Change {
+	changes := make([]Change, 0)
+	lbIDs := make([]uint32, 0)
+	lbToReferencedChains := make(map[uint32][]ChainID)
+	dispatchChainRules := make(map[string][]Rule)
+	lbKeysByID := make(map[uint32]string)
+
+	for lbKey, lb := range c.loadbalancers {
+		lbKeysByID[lb.ID(c.instanceTag)] = lbKey
+	}
+
+	for _, rule := range actual.rules[NATTable][dispatchChain] {
+		status := c.dispatchRuleStatus(rule)
+		chainID, _ := rule.JumpChainID()
+
+		if status == ruleOutdated {
+			// the chain stays until the drift detection replaced the rule
+			referencedChains[chainID.String()] = struct{}{}
+			continue
+		}
+
+		if status != ruleKnown {
+			glog.V(4).Infof("skipping unknown rule `%s` in chain `%s`, it's handled by the drift detection", rule.String(), dispatchChain)
+			continue
+		}
+
+		if _, found := lbToReferencedChains[chainID.LoadbalancerID]; !found {
+			lbIDs = append(lbIDs, chainID.LoadbalancerID)
+		}
+
+		if _, found := dispatchChainRules[chainID.String()]; !found {
+			lbToReferencedChains[chainID.LoadbalancerID] = append(lbToReferencedChains[chainID.LoadbalancerID], chainID)
+		}
+
+		dispatchChainRules[chainID.String()] = append(dispatchChainRules[chainID.String()], rule)
+	}
+
+	for _, lbID := range lbIDs {
+		chains := lbToReferencedChains[lbID]
+		lbKey, configured := lbKeysByID[lbID]
+		lb := c.loadbalancers[lbKey]
+
+		latest := c.getActiveChainID(lb, chains)
+
+		for _, chain := range chains {
+			if configured && chain.String() == latest.String() {
+				referencedChains[chain.String()] = struct{}{}
+				continue
+			}
+
+			reason := fmt.Sprintf("outdated chain of lb `%s`", lbKey)
+			if !configured {
+				reason = "deleted lb"
+			}
+
+			for _, rule := range dispatchChainRules[chain.String()] {
+				changes = append(changes, Change{
+					Type:   ChangeDeleteRule,
+					Table:  NATTable,
+					Chain:  dispatchChain,
+					Rule:   rule,
+					Reason: reason,
+				})
+			}
+		}
+	}
+
+	return changes
+}
+
+// planForwardDeletions plans the deletion of everything in the forward chain not referenced by any remaining nat
+// chain (so in case we couldnt create new outputs, the old ones (not in config anymore) can still accept traffic)
+func (c *Controller) planForwardDeletions(actual *actualState, remainingChains map[string]struct{}) []Change {
+	changes := make([]Change, 0)
+	referencedEndpoints := make(map[string]struct{})
+
+	for chain := range remainingChains {
+		for _, rule := range actual.rules[NATTable][chain] {
+			// The source filters at the top of the chain don't reference any output
+			if rule.Jump == "MARK" || (rule.Jump == "RETURN" && rule.Mark != nil) {
+				continue
+			}
+
+			if rule.ToDestination == nil {
+				glog.Errorf("WILL NOT DELETE ANY OBSOLETE FORWARD CHAIN ENTRIES, see: couldn't find endpoint in rule `%s` of chain `%s`", rule.String(), chain)
+				c.countError()
+				return changes
+			}
+
+			ports := getOutputPorts(rule.DestinationPorts, *rule.ToDestination)
+			referencedEndpoints[forwardKey(*rule.ToDestination, ports)] = struct{}{}
+		}
+	}
+
+	rejectRule := c.getRejectRule()
+	for _, rule := range actual.rules[FilterTable][c.forwardChainName] {
+		if c.forwardRuleStatus(rule) != ruleKnown {
+			glog.V(4).Infof("skipping unknown or outdated rule `%s` in forward chain, it's handled by the drift detection", rule.String())
+			continue
+		}
+
+		if rule.Equals(rejectRule) {
+			if !c.hasSourceFilters() {
+				changes = append(changes, Change{Type: ChangeDeleteRule, Table: FilterTable, Chain: c.forwardChainName, Rule: rule})
+			}
+
+			continue
+		}
+
+		dest, _ := rule.ForwardEndpoint()
+		ports := rule.DestinationPorts
+		if rule.Source != nil {
+			ports = rule.SourcePorts
+		}
+
+		if _, isReferenced := referencedEndpoints[forwardKey(dest, ports)]; !isReferenced {
+			changes = append(changes, Change{Type: ChangeDeleteRule, Table: FilterTable, Chain: c.forwardChainName, Rule: rule})
+		}
+	}
+
+	return changes
+}
+
+// forwardKey identifies the endpoint together with all ports traffic gets forwarded to, outputs of lbs with multiple
+// ports pass them, see Loadbalancer.OutputPorts.
+func forwardKey(endpoint Endpoint, ports PortSet) string {
+	if ports == nil {
+		return endpoint.String()
+	}
+
+	return endpoint.IP.String() + ":" + ports.String()
+}
+
+// getNewGeneration returns the generation for a new chain of the passed lb, which is its current generation if it's
+// newer than the generations of all existing chains, otherwise the one following the newest existing chain.
+func (c *Controller) getNewGeneration(lb Loadbalancer, existingChains ...[]ChainID) uint32 {
+	generation := lb.Generation
+	if generation == 0 {
+		generation = 1
+	}
+
+	for _, chainIDs := range existingChains {
+		for _, chainID := range chainIDs {
+			if !GenerationNewer(generation, chainID.Generation) {
+				generation = NextGeneration(chainID.Generation)
+			}
+		}
+	}
+
+	return generation
+}
+
+// findAdoptableChain returns the newest created chain of the passed lb which is intact and contains exactly the rules
+// wanted for the lb. The order of the outputs doesn't matter, since every output gets the same share of traffic.
+func (c *Controller) findAdoptableChain(actual *actualState, lb Loadbalancer) (ChainID, bool) {
+	adoptable := make([]ChainID, 0)
+
+	for _, chainID := range actual.chainIDsForLoadbalancer(lb.ID(c.instanceTag), ChainCreated) {
+		if actual.contentHashes[chainID.String()] != chainID.ContentHash {
+			continue
+		}
+
+		weighted := lb.weightedOutputs()
+
+		rules := actual.rules[NATTable][chainID.String()]
+
+		// Bring the outputs into the order they got in the chain, the cascades of the pools above match their sources
+		outputs := make([]Endpoint, 0, len(rules))
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].ToDestination == nil || rules[i].Source != nil {
+				break
+			}
+
+			outputs = append(outputs, *rules[i].ToDestination)
+		}
+
+		if !EndpointsEqual(outputs, weighted) {
+			continue
+		}
+
+		// The outputs of the chain already contain the repetitions for the weights
+		ordered := lb
+		ordered.Outputs = outputs
+		ordered.Weights = nil
+		ordered.Generation = chainID.Generation
+
+		if rulesEqual(rules, c.getLoadbalancerChainRules(&ordered)) {
+			adoptable = append(adoptable, chainID)
+		}
+	}
+
+	if len(adoptable) == 0 {
+		return ChainID{}, false
+	}
+
+	return c.getLatestChainID(adoptable), true
+}
+
+// applyChange executes the passed change against iptables.
+func (c *Controller) applyChange(change Change) error {
+	switch change.Type {
+	case ChangeCreateChain:
+		return c.ipt.NewChain(change.Table, change.Chain)
+	case ChangeDeleteChain:
+		return c.deleteChain(change.Table, change.Chain)
+	case ChangeCreateLoadbalancerChain:
+		chainID, err := c.createChainForLB(&change.Loadbalancer)
+		if err != nil {
+			return err
+		}
+
+		glog.Infof("created chain `%s` for lb `%s`", chainID.String(), change.Loadbalancer.Key())
+		return nil
+	case ChangeAppendRule:
+		return c.ipt.Append(change.Table, change.Chain, change.Rule.Args()...)
+	case ChangeDeleteRule:
+		if change.Position > 0 {
+			return c.deleteRuleAt(change.Table, change.Chain, change.Position, change.Rule)
+		}
+
+		return c.ipt.Delete(change.Table, change.Chain, change.Rule.Args()...)
+	case ChangeInsertRule:
+		return c.ipt.Insert(change.Table, change.Chain, change.Position, change.Rule.Args()...)
+	case ChangeMoveRule:
+		// Insert the rule at its new place before removing the old one, so it's never missing
+		err := c.ipt.Insert(change.Table, change.Chain, change.Position, change.Rule.Args()...)
+		if err != nil {
+			return err
+		}
+
+		oldPosition := change.OldPosition
+		if change.Position <= oldPosition {
+			oldPosition++
+		}
+
+		return c.deleteRuleAt(change.Table, change.Chain, oldPosition, change.Rule)
+	default:
+		return fmt.Errorf("unknown change type %d", change.Type)
+	}
+}
+
+// deleteRuleAt deletes the rule at the passed 1-based position of the chain, but only if it's still the passed rule.
+// The chain might have changed since the position got planned, e.g. by another tool.
+func (c *Controller) deleteRuleAt(table string, chain string, position int, rule Rule) error {
+	rawRules, err := c.ipt.List(table, chain)
+	if err != nil {
+		return fmt.Errorf("couldn't list chain `%s` of table `%s`, see: %v", chain, table, err)
+	}
+
+	rules := make([]string, 0, len(rawRules))
+	for _, rawRule := range rawRules {
+		if strings.HasPrefix(rawRule, "-A ") {
+			rules = append(rules, rawRule)
+		}
+	}
+
+	if position > len(rules) {
+		return fmt.Errorf("chain `%s` of table `%s` got only %d rules, expected `%s` at position %d", chain, table, len(rules), rule.String(), position)
+	}
+
+	actual, err := TryParseRule(rules[position-1])
+	if err != nil || !actual.Equals(rule) {
+		return fmt.Errorf("rule at position %d of chain `%s` in table `%s` is `%s` instead of `%s`", position, chain, table, rules[position-1], rule.String())
+	}
+
+	return c.ipt.Delete(table, chain, strconv.Itoa(position))
+}
+
+func (c *Controller) sortedLoadbalancerKeys() []string {
+	keys := make([]string, 0, len(c.loadbalancers))
+	for key := range c.loadbalancers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func rulesEqual(a []Rule, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func appendUniqueRule(rules []Rule, rule Rule) []Rule {
+	if RulesContain(rules, rule) {
+		return rules
+	}
+
+	return append(rules, rule)
+}
+
+func stringsContain(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
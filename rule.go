@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule represents a single iptables rule in a structured way, so rules generated by the controller and rules read
+// from iptables can be compared without caring about argument order or formatting.
+type Rule struct {
+	Protocol        Protocol
+	Source          *net.IPNet
+	Destination     *net.IPNet
+	SourcePort      uint16
+	DestinationPort uint16
+
+	// InInterface matches the interface packets arrive on (`-i`).
+	InInterface string
+
+	// DestinationLocal matches packets to any local address (`-m addrtype --dst-type LOCAL`).
+	DestinationLocal bool
+
+	// SourcePorts and DestinationPorts match port ranges (`--dport a:b`) or multiple ports (`-m multiport`), they're
+	// only set if more than a single port gets matched.
+	SourcePorts      PortSet
+	DestinationPorts PortSet
+
+	// Nth is the n of the `-m statistic --mode nth --every n --packet 0` match, 0 means no statistic match.
+	Nth int
+
+	// Mark matches the packet mark (`-m mark --mark`).
+	Mark *Mark
+
+	Comment string
+
+	Jump          string
+	ToDestination *Endpoint
+
+	// ToPorts is the port range of the DNAT target, the destination port gets shifted by its distance to ToBasePort.
+	// The port of ToDestination is the first one of the range then.
+	ToPorts    PortRange
+	ToBasePort uint16
+
+	// SetMark is the mark set by the MARK target (`--set-xmark`).
+	SetMark *Mark
+
+	// Unknown contains all arguments which couldn't be parsed, rules containing some never equal generated ones.
+	Unknown []string
+
+	// spec contains the arguments as read from iptables, if any.
+	spec []string
+}
+
+// TryParseRule tries to parse a rule as listed by `iptables -S`, e.g. "-A chain -d 10.0.0.1/32 -j ACCEPT". Rules
+// without the "-A chain" prefix are accepted as well. Arguments which can't be interpreted end up in Unknown.
+func TryParseRule(str string) (Rule, error) {
+	args, err := splitRuleSpec(str)
+	if err != nil {
+		return Rule{}, fmt.Errorf("couldn't split rule `%s`, see: %v", str, err)
+	}
+
+	if len(args) >= 2 && args[0] == "-A" {
+		args = args[2:]
+	}
+
+	r := Rule{spec: args}
+	protocol := ""
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// negated matches are kept as they are
+		if arg == "!" && i+1 < len(args) {
+			r.Unknown = append(r.Unknown, arg)
+			continue
+		}
+
+		if len(r.Unknown) > 0 && r.Unknown[len(r.Unknown)-1] == "!" {
+			r.Unknown = append(r.Unknown, arg)
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				r.Unknown = append(r.Unknown, args[i])
+			}
+
+			continue
+		}
+
+		// collect all values of the current option
+		values := make([]string, 0)
+		for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			values = append(values, args[i])
+		}
+
+		value := ""
+		if len(values) == 1 {
+			value = values[0]
+		}
+
+		switch {
+		case arg == "-p" && value != "":
+			p, err := TryParseProtocol(value)
+			if err != nil {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+			r.Protocol = p
+			protocol = value
+
+		case arg == "-m" && (value == protocol || value == "statistic" || value == "comment" || value == "multiport" || value == "addrtype" || value == "mark"):
+			// implicit matches, the options following them get parsed on their own
+
+		case (arg == "-s" || arg == "-d") && value != "":
+			ipNet, err := parseIPNet(value)
+			if err != nil {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+			if arg == "-s" {
+				r.Source = ipNet
+			} else {
+				r.Destination = ipNet
+			}
+
+		case arg == "-i" && value != "":
+			r.InInterface = value
+
+		case arg == "--dst-type" && value == "LOCAL":
+			r.DestinationLocal = true
+
+		case (arg == "--sport" || arg == "--dport" || arg == "--sports" || arg == "--dports") && value != "":
+			ports, err := parseIPTablesPorts(value)
+			if err != nil || (len(ports) > 1 && !strings.HasSuffix(arg, "s")) {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+			if strings.HasPrefix(arg, "--s") {
+				r.setSourcePorts(ports)
+			} else {
+				r.setDestinationPorts(ports)
+			}
+
+		case arg == "--mode" && value == "nth":
+		case arg == "--packet" && value == "0":
+
+		case arg == "--every" && value != "":
+			every, err := strconv.Atoi(value)
+			if err != nil {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+			r.Nth = every
+
+		case (arg == "--mark" || arg == "--set-xmark") && value != "":
+			mark, err := parseMark(value)
+			if err != nil {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+			if arg == "--mark" {
+				r.Mark = &mark
+			} else {
+				r.SetMark = &mark
+			}
+
+		case arg == "--comment" && value != "":
+			r.Comment = value
+
+		case arg == "-j" && value != "":
+			r.Jump = value
+
+		case arg == "--to-destination" && value != "":
+			err := r.setDNATTarget(value)
+			if err != nil {
+				r.Unknown = append(r.Unknown, arg, value)
+				continue
+			}
+
+		default:
+			r.Unknown = append(r.Unknown, arg)
+			r.Unknown = append(r.Unknown, values...)
+		}
+	}
+
+	return r, nil
+}
+
+// Args returns the arguments which can be passed to iptables to append or delete the rule. Rules read from iptables
+// return the arguments exactly as read.
+func (r Rule) Args() []string {
+	if r.spec != nil {
+		return r.spec
+	}
+
+	return r.canonicalArgs()
+}
+
+func (r Rule) canonicalArgs() []string {
+	args := make([]string, 0)
+
+	if r.Protocol != ProtocolUNK {
+		args = append(args, "-p", r.Protocol.String())
+	}
+
+	if r.Source != nil {
+		args = append(args, "-s", formatIPNet(r.Source))
+	}
+
+	if r.Destination != nil {
+		args = append(args, "-d", formatIPNet(r.Destination))
+	}
+
+	if r.InInterface != "" {
+		args = append(args, "-i", r.InInterface)
+	}
+
+	if r.SourcePort != 0 {
+		args = append(args, "--sport", strconv.Itoa(int(r.SourcePort)))
+	}
+
+	if r.DestinationPort != 0 {
+		args = append(args, "--dport", strconv.Itoa(int(r.DestinationPort)))
+	}
+
+	if len(r.SourcePorts) == 1 {
+		args = append(args, "--sport", r.SourcePorts.iptablesString())
+	} else if len(r.SourcePorts) > 1 {
+		args = append(args, "-m", "multiport", "--sports", r.SourcePorts.iptablesString())
+	}
+
+	if len(r.DestinationPorts) == 1 {
+		args = append(args, "--dport", r.DestinationPorts.iptablesString())
+	} else if len(r.DestinationPorts) > 1 {
+		args = append(args, "-m", "multiport", "--dports", r.DestinationPorts.iptablesString())
+	}
+
+	if r.DestinationLocal {
+		args = append(args, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+
+	if r.Nth != 0 {
+		args = append(args, "-m", "statistic", "--mode", "nth", "--every", strconv.Itoa(r.Nth), "--packet", "0")
+	}
+
+	if r.Mark != nil {
+		args = append(args, "-m", "mark", "--mark", r.Mark.String())
+	}
+
+	args = append(args, r.Unknown...)
+
+	if r.Comment != "" {
+		args = append(args, "-m", "comment", "--comment", r.Comment)
+	}
+
+	if r.Jump != "" {
+		args = append(args, "-j", r.Jump)
+	}
+
+	if r.ToDestination != nil {
+		args = append(args, "--to-destination", r.dnatTarget())
+	}
+
+	if r.SetMark != nil {
+		args = append(args, "--set-xmark", r.SetMark.xmarkString())
+	}
+
+	return args
+}
+
+// setSourcePorts matches the passed ports as source ports.
+func (r *Rule) setSourcePorts(ports PortSet) {
+	r.SourcePort, r.SourcePorts = 0, nil
+	if ports.Count() == 1 {
+		r.SourcePort = ports.First()
+	} else if len(ports) > 0 {
+		r.SourcePorts = ports
+	}
+}
+
+// setDestinationPorts matches the passed ports as destination ports.
+func (r *Rule) setDestinationPorts(ports PortSet) {
+	r.DestinationPort, r.DestinationPorts = 0, nil
+	if ports.Count() == 1 {
+		r.DestinationPort = ports.First()
+	} else if len(ports) > 0 {
+		r.DestinationPorts = ports
+	}
+}
+
+// GetDestinationPorts returns all destination ports matched by the rule, nil if it doesn't match any.
+func (r Rule) GetDestinationPorts() PortSet {
+	if r.DestinationPort != 0 {
+		return PortSet{{First: r.DestinationPort, Last: r.DestinationPort}}
+	}
+
+	return r.DestinationPorts
+}
+
+// setDNATTarget parses a DNAT target like "ip", "ip:port" or "ip:first-last/base".
+func (r *Rule) setDNATTarget(str string) error {
+	ipPortParts := strings.SplitN(str, ":", 2)
+
+	ip := net.ParseIP(ipPortParts[0]).To4()
+	if ip == nil {
+		return fmt.Errorf("couldn't parse `%s` as ipv4", ipPortParts[0])
+	}
+
+	if len(ipPortParts) == 1 {
+		r.ToDestination = &Endpoint{IP: ip}
+		return nil
+	}
+
+	portParts := strings.Split(ipPortParts[1], "/")
+	first, last, err := parsePortRange(portParts[0])
+	if err != nil {
+		return err
+	}
+
+	base := uint16(0)
+	if len(portParts) == 2 {
+		base, err = parsePort(portParts[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(portParts) > 2 || (first == last && base != 0) {
+		return fmt.Errorf("invalid DNAT target `%s`", str)
+	}
+
+	r.ToDestination = &Endpoint{IP: ip, Port: first}
+	if first != last {
+		r.ToPorts = PortRange{First: first, Last: last}
+		r.ToBasePort = base
+	}
+
+	return nil
+}
+
+func (r Rule) dnatTarget() string {
+	if r.ToPorts.First == r.ToPorts.Last {
+		return r.ToDestination.String()
+	}
+
+	target := r.ToDestination.IP.String() + ":" + r.ToPorts.String()
+	if r.ToBasePort != 0 {
+		target += "/" + strconv.Itoa(int(r.ToBasePort))
+	}
+
+	return target
+}
+
+// Mark is a packet mark together with the bits of it which are relevant.
+type Mark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// parseMark parses a mark as printed by iptables, e.g. "0x10000/0x10000" or "0x1" which matches all bits.
+func parseMark(str string) (Mark, error) {
+	parts := strings.Split(str, "/")
+	if len(parts) > 2 {
+		return Mark{}, fmt.Errorf("invalid mark `%s`", str)
+	}
+
+	value, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return Mark{}, fmt.Errorf("invalid mark `%s`, see: %v", str, err)
+	}
+
+	mark := Mark{Value: uint32(value), Mask: ^uint32(0)}
+	if len(parts) == 2 {
+		mask, err := strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return Mark{}, fmt.Errorf("invalid mask of mark `%s`, see: %v", str, err)
+		}
+
+		mark.Mask = uint32(mask)
+	}
+
+	return mark, nil
+}
+
+// String returns the mark like iptables prints mark matches, the mask gets omitted if all bits are relevant.
+func (m Mark) String() string {
+	if m.Mask == ^uint32(0) {
+		return fmt.Sprintf("0x%x", m.Value)
+	}
+
+	return m.xmarkString()
+}
+
+// xmarkString returns the mark like iptables prints the MARK target, which always contains the mask.
+func (m Mark) xmarkString() string {
+	return fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+}
+
+// parseIPTablesPorts parses ports as printed by iptables, e.g. "80", "10000:10100" or "21,30000:30100".
+func parseIPTablesPorts(str string) (PortSet, error) {
+	return TryParsePortSet(strings.Replace(str, ":", "-", -1))
+}
+
+// String returns the canonical representation of the rule.
+func (r Rule) String() string {
+	return formatRuleSpec(r.canonicalArgs())
+}
+
+// Equals checks whether both rules match the same packets and do the same with them.
+func (r Rule) Equals(other Rule) bool {
+	return r.String() == other.String()
+}
+
+// withoutComment returns a copy of the rule without its comment.
+func (r Rule) withoutComment() Rule {
+	r.Comment = ""
+	r.spec = nil
+
+	return r
+}
+
+// JumpChainID parses the jump target of the rule as ChainID.
+func (r Rule) JumpChainID() (ChainID, error) {
+	if r.Jump == "" {
+		return ChainID{}, fmt.Errorf("rule `%s` doesn't have a jump target", r.String())
+	}
+
+	return TryParseChainID(r.Jump)
+}
+
+// ForwardEndpoint returns the endpoint a forward rule accepts traffic for, which is either the source or the
+// destination of the rule. Rules matching multiple ports return an endpoint without port.
+func (r Rule) ForwardEndpoint() (Endpoint, error) {
+	if r.Source != nil && r.Destination != nil {
+		return Endpoint{}, fmt.Errorf("broken rule `%s` got source and dest ip", r.String())
+	} else if r.SourcePort != 0 && r.DestinationPort != 0 {
+		return Endpoint{}, fmt.Errorf("broken rule `%s` got source and dest port", r.String())
+	} else if r.Source != nil && (r.SourcePort != 0 || len(r.SourcePorts) > 0) {
+		return NewEndpoint(r.Source.IP, r.SourcePort), nil
+	} else if r.Destination != nil && (r.DestinationPort != 0 || len(r.DestinationPorts) > 0) {
+		return NewEndpoint(r.Destination.IP, r.DestinationPort), nil
+	}
+
+	return Endpoint{}, fmt.Errorf("unknown rule `%s` doesnt have source ip + source port or dest ip + dest port", r.String())
+}
+
+// RulesContain checks whether the passed rules contain an equal rule.
+func RulesContain(rules []Rule, rule Rule) bool {
+	for _, r := range rules {
+		if r.Equals(rule) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseIPNet(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		str += "/32"
+	}
+
+	_, ipNet, err := net.ParseCIDR(str)
+	if err != nil {
+		return nil, err
+	}
+
+	return ipNet, nil
+}
+
+func hostIPNet(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
+
+func formatIPNet(ipNet *net.IPNet) string {
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
+	}
+
+	return ipNet.String()
+}
+
+// splitRuleSpec splits a rule into its arguments, respecting double quoted arguments like iptables prints them.
+func splitRuleSpec(str string) ([]string, error) {
+	args := make([]string, 0)
+	current := strings.Builder{}
+	inArg := false
+	quoted := false
+
+	for i := 0; i < len(str); i++ {
+		ch := str[i]
+
+		switch {
+		case ch == '\\' && quoted && i+1 < len(str):
+			i++
+			current.WriteByte(str[i])
+		case ch == '"':
+			quoted = !quoted
+			inArg = true
+		case ch == ' ' && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(ch)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// formatRuleSpec joins the passed arguments, quoting them where necessary like iptables does.
+func formatRuleSpec(args []string) string {
+	quoted := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \"") {
+			arg = "\"" + strings.ReplaceAll(arg, "\"", "\\\"") + "\""
+		}
+
+		quoted = append(quoted, arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
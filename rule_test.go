@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseRuleListedByIPTables(t *testing.T) {
+	rule, err := TryParseRule("-A LB$-CgEKMgEBBNIAADA5AfMq03E= -d 10.50.1.1/32 -p tcp -m tcp --dport 1234 -m statistic --mode nth --every 3 --packet 0 -j DNAT --to-destination 10.100.0.3:1003")
+	assert.NilError(t, err)
+
+	output := NewEndpoint(net.IPv4(10, 100, 0, 3).To4(), 1003)
+	expected := Rule{
+		Protocol:        ProtocolTCP,
+		Destination:     hostIPNet(net.IPv4(10, 50, 1, 1)),
+		DestinationPort: 1234,
+		Nth:             3,
+		Jump:            "DNAT",
+		ToDestination:   &output,
+	}
+
+	assert.Assert(t, rule.Equals(expected), "expected `%s` got `%s`", expected.String(), rule.String())
+	assert.Equal(t, rule.String(), "-p tcp -d 10.50.1.1 --dport 1234 -m statistic --mode nth --every 3 --packet 0 -j DNAT --to-destination 10.100.0.3:1003")
+}
+
+func TestParseRuleKeepsArgsAsListed(t *testing.T) {
+	rule, err := TryParseRule("-A iptableslb-forward -s 10.100.0.1/32 -p tcp -m tcp --sport 1001 -j ACCEPT")
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, rule.Args(), []string{"-s", "10.100.0.1/32", "-p", "tcp", "-m", "tcp", "--sport", "1001", "-j", "ACCEPT"})
+
+	endpoint, err := rule.ForwardEndpoint()
+	assert.NilError(t, err)
+	assert.Equal(t, endpoint.String(), "10.100.0.1:1001")
+}
+
+func TestRuleDoesntMatchPortPrefix(t *testing.T) {
+	rule80, err := TryParseRule("-A iptableslb-prerouting -d 10.50.1.1/32 -p tcp -m tcp --dport 80 -j ACCEPT")
+	assert.NilError(t, err)
+
+	rule8080, err := TryParseRule("-A iptableslb-prerouting -d 10.50.1.1/32 -p tcp -m tcp --dport 8080 -j ACCEPT")
+	assert.NilError(t, err)
+
+	assert.Assert(t, !rule80.Equals(rule8080))
+	assert.Assert(t, !RulesContain([]Rule{rule8080}, rule80))
+}
+
+func TestRuleComparesComments(t *testing.T) {
+	rule, err := TryParseRule("-A iptableslb-forward -s 10.100.0.1/32 -p tcp -m tcp --sport 1001 -m comment --comment \"added by hand\" -j ACCEPT")
+	assert.NilError(t, err)
+
+	generated := Rule{
+		Protocol:   ProtocolTCP,
+		Source:     hostIPNet(net.IPv4(10, 100, 0, 1)),
+		SourcePort: 1001,
+		Jump:       "ACCEPT",
+	}
+
+	assert.Assert(t, !rule.Equals(generated))
+	assert.Equal(t, rule.Comment, "added by hand")
+
+	generated.Comment = "added by hand"
+	assert.Assert(t, rule.Equals(generated))
+}
+
+func TestParseRuleNegatedMatch(t *testing.T) {
+	rule, err := TryParseRule("-A iptableslb-forward ! -s 10.100.0.1/32 -p tcp -j ACCEPT")
+	assert.NilError(t, err)
+
+	assert.Assert(t, rule.Source == nil)
+	assert.DeepEqual(t, rule.Unknown, []string{"!", "-s", "10.100.0.1/32"})
+}
+
+func TestParseRuleWithPortRanges(t *testing.T) {
+	rule, err := TryParseRule("-A x -d 10.50.1.1/32 -p udp -m udp --dport 10000:10100 -j DNAT --to-destination 10.100.0.1:20000-20100/10000")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rule.Unknown), 0)
+	assert.DeepEqual(t, rule.DestinationPorts, PortSet{{First: 10000, Last: 10100}})
+	assert.Equal(t, rule.ToDestination.String(), "10.100.0.1:20000")
+	assert.Equal(t, rule.ToPorts, PortRange{First: 20000, Last: 20100})
+	assert.Equal(t, rule.ToBasePort, uint16(10000))
+	assert.Equal(t, rule.String(), "-p udp -d 10.50.1.1 --dport 10000:10100 -j DNAT --to-destination 10.100.0.1:20000-20100/10000")
+
+	rule, err = TryParseRule("-A x -d 10.50.1.1/32 -p tcp -m multiport --dports 21,30000:30100 -j DNAT --to-destination 10.100.0.1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rule.Unknown), 0)
+	assert.DeepEqual(t, rule.GetDestinationPorts(), PortSet{{First: 21, Last: 21}, {First: 30000, Last: 30100}})
+	assert.Equal(t, rule.ToDestination.Port, uint16(0))
+	assert.Equal(t, rule.String(), "-p tcp -d 10.50.1.1 -m multiport --dports 21,30000:30100 -j DNAT --to-destination 10.100.0.1")
+
+	// a single port is the same as --dport
+	rule, err = TryParseRule("-A x -p tcp -m multiport --sports 80 -j ACCEPT")
+	assert.NilError(t, err)
+	assert.Equal(t, rule.SourcePort, uint16(80))
+	assert.Equal(t, rule.String(), "-p tcp --sport 80 -j ACCEPT")
+
+	rule, err = TryParseRule("-A x -p tcp --dport 80,443 -j ACCEPT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rule.Unknown, []string{"--dport", "80,443"})
+}
+
+func TestParseSCTPRule(t *testing.T) {
+	rule, err := TryParseRule("-A x -d 10.50.1.1/32 -p sctp -m sctp --dport 3868 -j DNAT --to-destination 10.100.0.1:3868")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rule.Unknown), 0)
+	assert.Equal(t, rule.Protocol, ProtocolSCTP)
+	assert.Equal(t, rule.DestinationPort, uint16(3868))
+	assert.Equal(t, rule.String(), "-p sctp -d 10.50.1.1 --dport 3868 -j DNAT --to-destination 10.100.0.1:3868")
+}
+
+func TestParseRuleWithInterfaceAndAddrtype(t *testing.T) {
+	rule, err := TryParseRule("-A x -i eth1 -p tcp -m addrtype --dst-type LOCAL -m tcp --dport 443 -j ACCEPT")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rule.Unknown), 0)
+	assert.Equal(t, rule.InInterface, "eth1")
+	assert.Assert(t, rule.DestinationLocal)
+	assert.Equal(t, rule.String(), "-p tcp -i eth1 --dport 443 -m addrtype --dst-type LOCAL -j ACCEPT")
+
+	rule, err = TryParseRule("-A x -p tcp -m addrtype --dst-type UNICAST -j ACCEPT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rule.Unknown, []string{"--dst-type", "UNICAST"})
+}
+
+func TestParseMarkRules(t *testing.T) {
+	rule, err := TryParseRule("-A x -s 10.0.0.0/8 -m comment --comment iptableslb -j MARK --set-xmark 0x0/0x20000")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rule.Unknown), 0)
+	assert.Equal(t, *rule.SetMark, Mark{Value: 0, Mask: 0x20000})
+	assert.Equal(t, rule.String(), "-s 10.0.0.0/8 -m comment --comment iptableslb -j MARK --set-xmark 0x0/0x20000")
+
+	rule, err = TryParseRule("-A x -m mark --mark 0x20000/0x20000 -j DROP")
+	assert.NilError(t, err)
+	assert.Equal(t, *rule.Mark, Mark{Value: 0x20000, Mask: 0x20000})
+	assert.Equal(t, rule.String(), "-m mark --mark 0x20000/0x20000 -j DROP")
+
+	rule, err = TryParseRule("-A x -m mark --mark 0x1 -j ACCEPT")
+	assert.NilError(t, err)
+	assert.Equal(t, rule.String(), "-m mark --mark 0x1 -j ACCEPT")
+
+	rule, err = TryParseRule("-A x -m mark --mark 0x1/0x1/0x1 -j ACCEPT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, rule.Unknown, []string{"--mark", "0x1/0x1/0x1"})
+}
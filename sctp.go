@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NectGmbH/health"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSCTPHealthCheckProvider holds a sctp health monitoring provider.
+var DefaultSCTPHealthCheckProvider = &SCTPHealthCheckProvider{}
+
+// SCTPHealthCheckProvider represents a HealthCheckProvider which monitors a sctp endpoint by establishing an
+// association (INIT, INIT-ACK, COOKIE-ECHO, COOKIE-ACK) and shutting it down right away.
+type SCTPHealthCheckProvider struct {
+}
+
+// CheckHealth validates whether the current endpoint is up
+func (c *SCTPHealthCheckProvider) CheckHealth(h *health.HealthCheck) (string, bool) {
+	err := dialSCTP(h.IP.To4(), h.Port, h.MaxResponseTime)
+	if err != nil {
+		return err.Error(), false
+	}
+
+	return "success", true
+}
+
+// dialSCTP establishes a sctp association with the passed endpoint and closes it again. The standard library doesn't
+// support sctp, so the socket is handled directly.
+func dialSCTP(ip []byte, port int, timeout time.Duration) error {
+	if ip == nil {
+		return fmt.Errorf("only ipv4 endpoints are supported")
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return fmt.Errorf("couldn't create sctp socket, see: %v", err)
+	}
+
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrInet4{Port: port}
+	copy(addr.Addr[:], ip)
+
+	err = unix.Connect(fd, addr)
+	if err != nil && err != unix.EINPROGRESS {
+		return fmt.Errorf("couldn't connect, see: %v", err)
+	}
+
+	if err == unix.EINPROGRESS {
+		deadline := time.Now().Add(timeout)
+
+		for {
+			// A negative poll timeout waits forever
+			pollTimeout := -1
+			if timeout > 0 {
+				remaining := time.Until(deadline)
+				if remaining <= 0 {
+					return fmt.Errorf("couldn't connect, see: timeout after %v", timeout)
+				}
+
+				pollTimeout = int((remaining + time.Millisecond - 1) / time.Millisecond)
+			}
+
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+			n, err := unix.Poll(fds, pollTimeout)
+			if err == unix.EINTR {
+				continue
+			}
+
+			if err != nil {
+				return fmt.Errorf("couldn't wait for association, see: %v", err)
+			}
+
+			if n > 0 {
+				break
+			}
+		}
+
+		soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return fmt.Errorf("couldn't get socket error, see: %v", err)
+		}
+
+		if soErr != 0 {
+			return fmt.Errorf("couldn't connect, see: %v", unix.Errno(soErr))
+		}
+	}
+
+	return nil
+}
+
+// getHealthCheckProvider returns the health check provider with the passed name, besides the ones of the health
+// package "sctp" is supported.
+func getHealthCheckProvider(name string) (health.HealthCheckProvider, error) {
+	if strings.ToLower(strings.TrimSpace(name)) == "sctp" {
+		return DefaultSCTPHealthCheckProvider, nil
+	}
+
+	provider, err := health.GetHealthCheckProvider(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown health check protocol `%s` use either \"none\", \"tcp\", \"http\" or \"sctp\"", name)
+	}
+
+	return provider, nil
+}
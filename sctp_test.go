@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NectGmbH/health"
+	"golang.org/x/sys/unix"
+	"gotest.tools/assert"
+)
+
+func TestGetHealthCheckProvider(t *testing.T) {
+	provider, err := getHealthCheckProvider("sctp")
+	assert.NilError(t, err)
+	assert.Equal(t, provider, health.HealthCheckProvider(DefaultSCTPHealthCheckProvider))
+
+	provider, err = getHealthCheckProvider("tcp")
+	assert.NilError(t, err)
+	assert.Equal(t, provider, health.HealthCheckProvider(health.DefaultTCPHealthCheckProvider))
+
+	_, err = getHealthCheckProvider("icmp")
+	assert.ErrorContains(t, err, "\"sctp\"")
+}
+
+func TestSCTPHealthCheck(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Skipf("sctp isn't supported on this host, see: %v", err)
+	}
+
+	addr := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}
+	assert.NilError(t, unix.Bind(fd, addr))
+	assert.NilError(t, unix.Listen(fd, 1))
+
+	sa, err := unix.Getsockname(fd)
+	assert.NilError(t, err)
+	port := sa.(*unix.SockaddrInet4).Port
+
+	h := &health.HealthCheck{IP: net.IPv4(127, 0, 0, 1), Port: port, MaxResponseTime: time.Second}
+	msg, healthy := DefaultSCTPHealthCheckProvider.CheckHealth(h)
+	assert.Assert(t, healthy, msg)
+
+	unix.Close(fd)
+
+	_, healthy = DefaultSCTPHealthCheckProvider.CheckHealth(h)
+	assert.Assert(t, !healthy)
+}
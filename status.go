@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/golang/glog"
+)
+
+// counterLister is implemented by iptables implementations which can list rules including their counters.
+type counterLister interface {
+	ListWithCounters(table, chain string) ([]string, error)
+}
+
+// LoadbalancerStatus describes a loadbalancer chain as found in iptables.
+type LoadbalancerStatus struct {
+	Protocol   string          `json:"protocol"`
+	VIP        string          `json:"vip"`
+	Chain      string          `json:"chain"`
+	Active     bool            `json:"active"`
+	State      string          `json:"state"`
+	Version    uint8           `json:"version"`
+	Generation uint32          `json:"generation"`
+	HashValid  bool            `json:"hashValid"`
+	Rejected   uint64          `json:"rejected"`
+	Backends   []BackendStatus `json:"backends"`
+}
+
+// BackendStatus describes a single DNAT target of a loadbalancer chain.
+type BackendStatus struct {
+	Endpoint    string `json:"endpoint"`
+	Pool        string `json:"pool,omitempty"`
+	Packets     uint64 `json:"packets"`
+	Bytes       uint64 `json:"bytes"`
+	Forward     bool   `json:"forward"`
+	Hairpinning bool   `json:"hairpinning"`
+}
+
+// Status reads all loadbalancer chains of the configured instance from iptables.
+func Status(ipt IPTables, config ControllerConfig) ([]LoadbalancerStatus, error) {
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, err := ctrl.readActualState()
+	if err != nil {
+		return nil, err
+	}
+
+	// Chains shared by aliases only contain the vips in the rules jumping into them
+	activeChains := make(map[string]struct{})
+	dispatchVIPs := make(map[string][]string)
+	for _, dispatchChain := range []string{ctrl.mainChainName, ctrl.outputChainName} {
+		for _, rule := range actual.rules[NATTable][dispatchChain] {
+			activeChains[rule.Jump] = struct{}{}
+
+			if input, ok := loadbalancerForInputRule(rule); ok {
+				vip := input.inputHost() + ":" + input.Ports().String()
+				if !stringsContain(dispatchVIPs[rule.Jump], vip) {
+					dispatchVIPs[rule.Jump] = append(dispatchVIPs[rule.Jump], vip)
+				}
+			}
+		}
+	}
+
+	statuses := make([]LoadbalancerStatus, 0, len(actual.chainIDs))
+
+	for _, chainID := range actual.chainIDs {
+		chain := chainID.String()
+		_, active := activeChains[chain]
+
+		status := LoadbalancerStatus{
+			Chain:      chain,
+			Active:     active,
+			State:      chainID.State.String(),
+			Version:    chainID.Version,
+			Generation: chainID.Generation,
+			HashValid:  actual.contentHashes[chain] == chainID.ContentHash,
+			Backends:   make([]BackendStatus, 0),
+		}
+
+		if chainID.Version == ChainIDVersion1 {
+			status.Protocol = chainID.Protocol.String()
+			status.VIP = NewEndpoint(chainID.IP, chainID.Port).String()
+		}
+
+		counters, err := ctrl.listCounters(NATTable, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		// The source filters return the rejected packets before the cascade
+		rules := actual.rules[NATTable][chain]
+		for i, rule := range rules {
+			if rule.Jump == "RETURN" && rule.Mark != nil && i < len(counters) {
+				status.Rejected = counters[i][0]
+			}
+		}
+
+		// The cascade is built bottom up, so the rules get reversed to list the backends in their configured order
+		for i := len(rules) - 1; i >= 0; i-- {
+			rule := rules[i]
+			if rule.ToDestination == nil {
+				continue
+			}
+
+			if input, ok := loadbalancerForInputRule(rule); ok && status.VIP == "" {
+				status.Protocol = rule.Protocol.String()
+				status.VIP = input.inputHost() + ":" + input.Ports().String()
+			}
+
+			// Outputs of lbs with multiple ports accept traffic on all of them
+			ports := getOutputPorts(rule.DestinationPorts, *rule.ToDestination)
+
+			forwardRules := actual.rules[FilterTable][ctrl.forwardChainName]
+			backend := BackendStatus{
+				Endpoint: rule.ToDestination.String(),
+				Pool:     poolOfRule(rule),
+				Forward: RulesContain(forwardRules, ctrl.getSrcForwardRuleForEndpointAndProt(*rule.ToDestination, ports, rule.Protocol)) &&
+					RulesContain(forwardRules, ctrl.getDstForwardRuleForEndpointAndProt(*rule.ToDestination, ports, rule.Protocol)),
+			}
+
+			if i < len(counters) {
+				backend.Packets = counters[i][0]
+				backend.Bytes = counters[i][1]
+			}
+
+			if hairpinningRule, err := ctrl.getHairpinningRuleForEndpoint(*rule.ToDestination, ports, rule.Protocol); err == nil {
+				backend.Hairpinning = RulesContain(actual.rules[NATTable][ctrl.hairpinningChainName], hairpinningRule)
+			}
+
+			// Weighted backends have multiple rules, their counters get summed up
+			merged := false
+			for j := range status.Backends {
+				if status.Backends[j].Endpoint == backend.Endpoint && status.Backends[j].Pool == backend.Pool {
+					status.Backends[j].Packets += backend.Packets
+					status.Backends[j].Bytes += backend.Bytes
+					merged = true
+				}
+			}
+
+			if !merged {
+				status.Backends = append(status.Backends, backend)
+			}
+
+			if status.Protocol == "" {
+				status.Protocol = rule.Protocol.String()
+			}
+		}
+
+		if status.VIP == "" {
+			status.VIP = strings.Join(dispatchVIPs[chain], ",")
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].VIP != statuses[j].VIP {
+			return statuses[i].VIP < statuses[j].VIP
+		}
+
+		return statuses[i].Protocol < statuses[j].Protocol
+	})
+
+	return statuses, nil
+}
+
+// poolOfRule returns the source of the pool the DNAT rule belongs to, an empty string for rules of all sources. The
+// rules of pools with multiple sources can't be told apart, so they're listed per source.
+func poolOfRule(rule Rule) string {
+	if rule.Source == nil {
+		return ""
+	}
+
+	return formatIPNet(rule.Source)
+}
+
+// listCounters returns the packet and byte counters of all rules in the chain, in case the iptables implementation
+// can't list them, nil gets returned.
+func (c *Controller) listCounters(table string, chain string) ([][2]uint64, error) {
+	lister, ok := c.ipt.(counterLister)
+	if !ok {
+		return nil, nil
+	}
+
+	rawRules, err := lister.ListWithCounters(table, chain)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve counters of chain `%s` in table `%s`, see: %v", chain, table, err)
+	}
+
+	counters := make([][2]uint64, 0, len(rawRules))
+	for _, rawRule := range rawRules {
+		if !strings.HasPrefix(rawRule, "-A ") {
+			continue
+		}
+
+		packets, bytes, err := parseRuleCounters(rawRule)
+		if err != nil {
+			return nil, err
+		}
+
+		counters = append(counters, [2]uint64{packets, bytes})
+	}
+
+	return counters, nil
+}
+
+// parseRuleCounters parses the `-c <packets> <bytes>` part of a rule as listed by `iptables -S -v`.
+func parseRuleCounters(rawRule string) (uint64, uint64, error) {
+	args, err := splitRuleSpec(rawRule)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't split rule `%s`, see: %v", rawRule, err)
+	}
+
+	for i := 0; i+2 < len(args); i++ {
+		if args[i] != "-c" {
+			continue
+		}
+
+		packets, err := strconv.ParseUint(args[i+1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid packet counter in rule `%s`, see: %v", rawRule, err)
+		}
+
+		bytes, err := strconv.ParseUint(args[i+2], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid byte counter in rule `%s`, see: %v", rawRule, err)
+		}
+
+		return packets, bytes, nil
+	}
+
+	return 0, 0, fmt.Errorf("rule `%s` doesn't contain counters", rawRule)
+}
+
+// printStatus writes the passed statuses either as table or, if format is "json", as json.
+func printStatus(w io.Writer, statuses []LoadbalancerStatus, format string) error {
+	if format == "" {
+		format = "table"
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	if format != "table" {
+		return fmt.Errorf("unknown output format `%s`, available: table, json", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROTOCOL\tVIP\tCHAIN\tACTIVE\tSTATE\tGENERATION\tHASH\tBACKEND\tPACKETS\tBYTES\tFORWARD\tHAIRPINNING")
+
+	for _, status := range statuses {
+		hash := "valid"
+		if !status.HashValid {
+			hash = "INVALID"
+		}
+
+		prefix := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%d\t%s", status.Protocol, status.VIP, status.Chain, yesNo(status.Active), status.State, status.Generation, hash)
+
+		if len(status.Backends) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\n", prefix)
+			continue
+		}
+
+		for i, backend := range status.Backends {
+			if i > 0 {
+				prefix = "\t\t\t\t\t\t"
+			}
+
+			endpoint := backend.Endpoint
+			if backend.Pool != "" {
+				endpoint += " (from " + backend.Pool + ")"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", prefix, endpoint, backend.Packets, backend.Bytes, yesNo(backend.Forward), yesNo(backend.Hairpinning))
+		}
+	}
+
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+func status(config ControllerConfig, format string) int {
+	ipt, err := iptables.New()
+	if err != nil {
+		glog.Errorf("couldn't init iptables, see: %v", err)
+		return PlanExitFailed
+	}
+
+	statuses, err := Status(ipt, config)
+	if err != nil {
+		glog.Errorf("couldn't read status, see: %v", err)
+		return PlanExitFailed
+	}
+
+	err = printStatus(os.Stdout, statuses, format)
+	if err != nil {
+		glog.Errorf("couldn't print status, see: %v", err)
+		return PlanExitFailed
+	}
+
+	return PlanExitUpToDate
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// countingIPTables adds fake counters to the rules listed by the wrapped dry run.
+type countingIPTables struct {
+	*DryRunIPTables
+}
+
+func (c countingIPTables) ListWithCounters(table, chain string) ([]string, error) {
+	rules, err := c.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if strings.HasPrefix(rule, "-A ") {
+			rules[i] = rule + " -c " + strings.Repeat("1", i) + " 100"
+		}
+	}
+
+	return rules, nil
+}
+
+func TestParseRuleCounters(t *testing.T) {
+	packets, bytes, err := parseRuleCounters("-A LB -p tcp -d 10.0.0.1/32 -c 42 1337 -j DNAT --to-destination 10.1.0.1:80")
+	assert.NilError(t, err)
+	assert.Equal(t, packets, uint64(42))
+	assert.Equal(t, bytes, uint64(1337))
+
+	_, _, err = parseRuleCounters("-A LB -j ACCEPT")
+	assert.Assert(t, err != nil)
+}
+
+func TestStatus(t *testing.T) {
+	ipt, ctrl := setupDriftTest(t, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"})
+
+	// an outdated lb chain which isn't referenced anymore
+	lb := ctrl.loadbalancers["tcp://10.50.1.1:1234"]
+	lb.Generation = NextGeneration(lb.Generation)
+	_, err := ctrl.createChainForLB(&lb)
+	assert.NilError(t, err)
+
+	// remove the hairpinning of one backend
+	hairpinning, _ := ipt.List(NATTable, ctrl.hairpinningChainName)
+	assert.NilError(t, ipt.Delete(NATTable, ctrl.hairpinningChainName, listedRuleArgs(hairpinning[1])...))
+
+	statuses, err := Status(countingIPTables{ipt}, ControllerConfig{HairpinningCIDR: "42.42.42.0/24"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 3)
+
+	active := 0
+	for _, status := range statuses {
+		assert.Equal(t, status.Protocol, "tcp")
+		assert.Equal(t, status.State, "created")
+		assert.Assert(t, status.HashValid)
+		assert.Equal(t, len(status.Backends), 1)
+		assert.Equal(t, status.Backends[0].Packets, uint64(1))
+		assert.Equal(t, status.Backends[0].Bytes, uint64(100))
+		assert.Assert(t, status.Backends[0].Forward)
+
+		if status.Active {
+			active++
+		}
+	}
+
+	assert.Equal(t, active, 2)
+	assert.Equal(t, statuses[0].VIP, "10.50.1.1:1234")
+	assert.Equal(t, statuses[0].Backends[0].Hairpinning, false)
+	assert.Equal(t, statuses[2].VIP, "10.50.2.1:1234")
+	assert.Equal(t, statuses[2].Backends[0].Hairpinning, true)
+
+	table := &bytes.Buffer{}
+	assert.NilError(t, printStatus(table, statuses, "table"))
+	assert.Equal(t, strings.Count(table.String(), "\n"), 4)
+
+	out := &bytes.Buffer{}
+	assert.NilError(t, printStatus(out, statuses, "json"))
+
+	parsed := make([]LoadbalancerStatus, 0)
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.DeepEqual(t, parsed, statuses)
+
+	assert.Assert(t, printStatus(out, statuses, "yaml") != nil)
+}
+
+func TestStatusOfAliases(t *testing.T) {
+	definition, err := parseLoadbalancerDefinition("tcp://10.50.1.1:443,tcp://10.60.1.1:443", "10.100.0.1:8443", "none", EndpointParseOptions{})
+	assert.NilError(t, err)
+
+	ipt := NewDryRunIPTables(nil)
+	ctrl, err := NewControllerWithIPTables(ipt, ControllerConfig{}, nil)
+	assert.NilError(t, err)
+
+	ctrl.UpsertLoadbalancer(definition.Loadbalancer)
+	ctrl.sync()
+	assert.Equal(t, ctrl.syncErrors, 0)
+
+	statuses, err := Status(countingIPTables{ipt}, ControllerConfig{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 1)
+	assert.Equal(t, statuses[0].Protocol, "tcp")
+	assert.Equal(t, statuses[0].VIP, "10.50.1.1:443,10.60.1.1:443")
+	assert.Equal(t, len(statuses[0].Backends), 1)
+}
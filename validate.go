@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/golang/glog"
+)
+
+// foreignDNATRule is a DNAT rule in the nat table which isn't managed by any instance.
+type foreignDNATRule struct {
+	Chain string
+	Rule  Rule
+
+	// Match contains the matches of the rule combined with the ones of the rule jumping into its chain, if any
+	Match Rule
+}
+
+// matchesInput checks whether the rule may match traffic for the input of the passed lb. Rules with matches which
+// can't be interpreted (e.g. a negated interface) are considered to match.
+func (r foreignDNATRule) matchesInput(lb *Loadbalancer) bool {
+	if r.Match.Protocol != ProtocolUNK && !r.Match.Protocol.Overlaps(lb.Protocol) {
+		return false
+	}
+
+	if r.Match.InInterface != "" && lb.InputInterface != "" && r.Match.InInterface != lb.InputInterface {
+		return false
+	}
+
+	destination := lb.inputDestination()
+	if r.Match.Destination != nil && destination != nil && !r.Match.Destination.Contains(destination.IP) && !destination.Contains(r.Match.Destination.IP) {
+		return false
+	}
+
+	ports := r.Match.GetDestinationPorts()
+
+	return ports == nil || ports.Overlaps(lb.Ports())
+}
+
+// getForeignDNATRules returns all DNAT rules in the nat table outside the managed chains of all instances. DNAT
+// rules in custom chains get combined with the matches of the rules jumping into the chain.
+func (c *Controller) getForeignDNATRules() ([]foreignDNATRule, error) {
+	rules, scannedChains, err := c.listForeignNATRules()
+	if err != nil {
+		return nil, err
+	}
+
+	jumpsInto := make(map[string][]Rule)
+	for _, chain := range scannedChains {
+		for _, rule := range rules[chain] {
+			if _, found := rules[rule.Jump]; found {
+				jumpsInto[rule.Jump] = append(jumpsInto[rule.Jump], rule)
+			}
+		}
+	}
+
+	foreign := make([]foreignDNATRule, 0)
+
+	for _, chain := range scannedChains {
+		for _, rule := range rules[chain] {
+			if rule.Jump != "DNAT" {
+				continue
+			}
+
+			jumps := jumpsInto[chain]
+			if len(jumps) == 0 {
+				foreign = append(foreign, foreignDNATRule{Chain: chain, Rule: rule, Match: rule})
+				continue
+			}
+
+			for _, jump := range jumps {
+				match := rule
+				if match.Protocol == ProtocolUNK {
+					match.Protocol = jump.Protocol
+				}
+
+				if match.Destination == nil {
+					match.Destination = jump.Destination
+				}
+
+				if match.InInterface == "" {
+					match.InInterface = jump.InInterface
+				}
+
+				if match.DestinationPort == 0 && match.DestinationPorts == nil {
+					match.DestinationPort = jump.DestinationPort
+					match.DestinationPorts = jump.DestinationPorts
+				}
+
+				foreign = append(foreign, foreignDNATRule{Chain: chain, Rule: rule, Match: match})
+			}
+		}
+	}
+
+	return foreign, nil
+}
+
+// Validate checks the passed loadbalancer flags and controller config and returns all problems found. In case ipt is
+// passed, the inputs get checked against the DNAT rules not managed by iptableslb as well. The outputs get parsed with
+// the passed options.
+func Validate(ipt IPTables, config ControllerConfig, options EndpointParseOptions, inFlags sliceFlags, outFlags sliceFlags, healthFlags sliceFlags) []error {
+	errs := make([]error, 0)
+
+	configErr := config.validate()
+	if configErr != nil {
+		errs = append(errs, configErr)
+	}
+
+	if len(inFlags) != len(outFlags) || len(inFlags) != len(healthFlags) {
+		return append(errs, fmt.Errorf("for every -in parameter you have to specify exactly ONE -h and ONE -out parameter"))
+	}
+
+	if len(inFlags) == 0 {
+		return append(errs, fmt.Errorf("didn't specify any loadbalancers"))
+	}
+
+	definitions := make([]loadbalancerDefinition, 0, len(inFlags))
+
+	for i := range inFlags {
+		definition, err := parseLoadbalancerDefinition(inFlags[i], outFlags[i], healthFlags[i], options)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid lb `%s`, see: %v", inFlags[i], err))
+			continue
+		}
+
+		definitions = append(definitions, definition)
+	}
+
+	errs = append(errs, validateLoadbalancerDefinitions(definitions)...)
+
+	if ipt == nil || configErr != nil {
+		return errs
+	}
+
+	ctrl, err := NewControllerWithIPTables(ipt, config, nil)
+	if err != nil {
+		return append(errs, err)
+	}
+
+	foreign, err := ctrl.getForeignDNATRules()
+	if err != nil {
+		return append(errs, err)
+	}
+
+	for _, definition := range definitions {
+		lb := definition.Loadbalancer
+
+		for _, rule := range foreign {
+			for _, input := range lb.inputs() {
+				if rule.matchesInput(input) {
+					errs = append(errs, fmt.Errorf("input of lb `%s` overlaps with DNAT rule `%s` in chain `%s`", lb.Key(), rule.Rule.String(), rule.Chain))
+					break
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateLoadbalancerDefinitions checks for duplicate loadbalancers, loadbalancers (or aliases) with overlapping input
+// ports and duplicate backends within a loadbalancer.
+func validateLoadbalancerDefinitions(definitions []loadbalancerDefinition) []error {
+	errs := make([]error, 0)
+	seen := make(map[string]struct{})
+
+	for i, definition := range definitions {
+		lb := definition.Loadbalancer
+
+		if _, duplicate := seen[lb.Key()]; duplicate {
+			errs = append(errs, fmt.Errorf("lb `%s` is defined multiple times", lb.Key()))
+		}
+
+		seen[lb.Key()] = struct{}{}
+
+		inputs := lb.inputs()
+		for j := range inputs {
+			for _, other := range inputs[:j] {
+				if inputsOverlap(inputs[j], other) {
+					errs = append(errs, fmt.Errorf("alias `%s` of lb `%s` overlaps with `%s`", inputs[j].Key(), lb.Key(), other.Key()))
+				}
+			}
+		}
+
+		for _, other := range definitions[:i] {
+			o := other.Loadbalancer
+			if o.Key() != lb.Key() && o.InputOverlaps(lb) {
+				errs = append(errs, fmt.Errorf("ports of lb `%s` overlap with lb `%s`", lb.Key(), o.Key()))
+			}
+		}
+
+		errs = append(errs, validateOutputs(lb, lb.Outputs)...)
+
+		for j, pool := range lb.Pools {
+			errs = append(errs, validateOutputs(lb, pool.Outputs)...)
+
+			for _, source := range pool.Sources {
+				for _, other := range lb.Pools[:j] {
+					for _, otherSource := range other.Sources {
+						if ipNetContains(otherSource, source) {
+							errs = append(errs, fmt.Errorf("source `%s` of lb `%s` is already routed by the pool of `%s`", formatIPNet(source), lb.Key(), formatIPNet(otherSource)))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateOutputs checks that every output is only defined once.
+func validateOutputs(lb *Loadbalancer, outputs []Endpoint) []error {
+	errs := make([]error, 0)
+	unique := make([]Endpoint, 0, len(outputs))
+
+	for _, output := range outputs {
+		if EndpointsContain(unique, output) {
+			errs = append(errs, fmt.Errorf("backend `%s` is defined multiple times for lb `%s`", output.String(), lb.Key()))
+			continue
+		}
+
+		unique = append(unique, output)
+	}
+
+	return errs
+}
+
+func validate(config ControllerConfig, options EndpointParseOptions, inFlags sliceFlags, outFlags sliceFlags, healthFlags sliceFlags) int {
+	var ipt IPTables
+	ipt, err := iptables.New()
+	if err != nil {
+		glog.Warningf("couldn't init iptables, skipping the check for overlapping DNAT rules, see: %v", err)
+		ipt = nil
+	}
+
+	errs := Validate(ipt, config, options, inFlags, outFlags, healthFlags)
+	if len(errs) == 0 {
+		fmt.Println("Configuration is valid.")
+		return PlanExitUpToDate
+	}
+
+	for _, err := range errs {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Printf("\n%d problems found.\n", len(errs))
+
+	return PlanExitFailed
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func errorStrings(errs []error) string {
+	strs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		strs = append(strs, err.Error())
+	}
+
+	return strings.Join(strs, "\n")
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{HairpinningCIDR: "10.0.0.0/24"}, EndpointParseOptions{},
+		sliceFlags{"tcp://10.50.1.1:80", "udp://10.50.1.1:80"},
+		sliceFlags{"10.100.0.1-5:80", "10.100.0.1:80"},
+		sliceFlags{"tcp", "none"})
+
+	assert.Equal(t, len(errs), 0, errorStrings(errs))
+}
+
+func TestValidateFindsAllProblems(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{HairpinningCIDR: "10.0.0.0/33"}, EndpointParseOptions{},
+		sliceFlags{"tcp://10.50.1.1:80", "tcp://10.50.1.1:80", "tcp://10.50.2.1:80", "tcp://10.50.3.1:70000"},
+		sliceFlags{"10.100.0.1:80", "10.100.0.2:80", "10.100.0.1-3:80,10.100.0.2:80", "10.100.0.1:80"},
+		sliceFlags{"tcp", "tcp", "tcp", "tcp"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 4, str)
+	assert.Assert(t, strings.Contains(str, "invalid hairpinning cidr `10.0.0.0/33`"), str)
+	assert.Assert(t, strings.Contains(str, "lb `tcp://10.50.1.1:80` is defined multiple times"), str)
+	assert.Assert(t, strings.Contains(str, "backend `10.100.0.2:80` is defined multiple times for lb `tcp://10.50.2.1:80`"), str)
+	assert.Assert(t, strings.Contains(str, "invalid port `70000`"), str)
+}
+
+func TestValidateFindsOverlappingDNATRules(t *testing.T) {
+	ipt := NewDryRunIPTables(nil)
+	assert.NilError(t, ipt.NewChain(NATTable, "PREROUTING"))
+	assert.NilError(t, ipt.NewChain(NATTable, "web"))
+	assert.NilError(t, ipt.Append(NATTable, "PREROUTING", "-p", "tcp", "-d", "10.50.1.0/24", "--dport", "80", "-j", "web"))
+	assert.NilError(t, ipt.Append(NATTable, "web", "-j", "DNAT", "--to-destination", "10.100.0.1:80"))
+	assert.NilError(t, ipt.Append(NATTable, "PREROUTING", "-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "10.100.0.1:53"))
+	assert.NilError(t, ipt.Append(NATTable, "PREROUTING", "-p", "tcp", "-d", "10.50.2.1", "--dport", "443", "-j", "DNAT", "--to-destination", "10.100.0.1:443"))
+
+	// the chains managed by iptableslb don't count
+	_, ctrl := setupDriftTest(t, ControllerConfig{})
+	for _, lb := range ctrl.loadbalancers {
+		assert.NilError(t, ipt.NewChain(NATTable, lb.GetChainID(0, ChainCreated, 0).String()))
+		assert.NilError(t, ipt.Append(NATTable, lb.GetChainID(0, ChainCreated, 0).String(), "-j", "DNAT", "--to-destination", "10.100.0.1:80"))
+	}
+
+	errs := Validate(ipt, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"tcp://10.50.1.1:80", "udp://10.50.3.1:53", "tcp://10.50.2.1:80", "tcp://10.50.2.2:443"},
+		sliceFlags{"10.100.0.1:80", "10.100.0.1:53", "10.100.0.1:80", "10.100.0.1:443"},
+		sliceFlags{"tcp", "none", "tcp", "tcp"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 2, str)
+	assert.Assert(t, strings.Contains(str, "lb `tcp://10.50.1.1:80` overlaps with DNAT rule `-j DNAT --to-destination 10.100.0.1:80` in chain `web`"), str)
+	assert.Assert(t, strings.Contains(str, "lb `udp://10.50.3.1:53` overlaps"), str)
+}
+
+func TestParseEndpointRejectsInvalidPorts(t *testing.T) {
+	for _, str := range []string{"10.0.0.1:70000", "10.0.0.1:0", "10.0.0.1:-1"} {
+		_, err := TryParseEndpoint(str)
+		assert.Assert(t, err != nil, "expected error for `%s`", str)
+
+		_, err = TryParseEndpoints(str)
+		assert.Assert(t, err != nil, "expected error for `%s`", str)
+	}
+}
+
+func TestValidateFindsOverlappingPorts(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"udp://10.50.1.1:10000-10100", "udp://10.50.1.1:10100", "tcp://10.50.1.1:10100", "udp://10.50.1.1:10101,10200"},
+		sliceFlags{"10.100.0.1", "10.100.0.1:53", "10.100.0.1:53", "10.100.0.1:20000-20099"},
+		sliceFlags{"none", "none", "none", "none"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 1, str)
+	assert.Assert(t, strings.Contains(str, "ports of lb `udp://10.50.1.1:10100` overlap with lb `udp://10.50.1.1:10000-10100`"), str)
+}
+
+func TestValidateFindsOverlappingProtocols(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"tcpudp://10.50.1.1:53", "udp://10.50.1.1:53", "tcp://10.50.1.1:54"},
+		sliceFlags{"10.100.0.1:53", "10.100.0.1:53", "10.100.0.1:54"},
+		sliceFlags{"none", "none", "none"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 1, str)
+	assert.Assert(t, strings.Contains(str, "ports of lb `udp://10.50.1.1:53` overlap with lb `tcpudp://10.50.1.1:53`"), str)
+}
+
+func TestValidateFindsOverlappingWildcardInputs(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"tcp://*:443", "tcp://10.50.1.1:443", "tcp://10.50.0.0/16%eth1:80", "tcp://10.50.2.1%eth2:80", "tcp://10.50.3.1%eth1:80"},
+		sliceFlags{"10.100.0.1:443", "10.100.0.1:443", "10.100.0.1:80", "10.100.0.1:80", "10.100.0.1:80"},
+		sliceFlags{"none", "none", "none", "none", "none"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 2, str)
+	assert.Assert(t, strings.Contains(str, "ports of lb `tcp://10.50.1.1:443` overlap with lb `tcp://*:443`"), str)
+	assert.Assert(t, strings.Contains(str, "ports of lb `tcp://10.50.3.1%eth1:80` overlap with lb `tcp://10.50.0.0/16%eth1:80`"), str)
+}
+
+func TestValidateFindsOverlappingAliases(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"tcp://10.50.1.1:443,tcp://10.60.1.1:443", "tcp://10.60.1.1:443", "tcp://10.70.1.1:443,tcp://10.70.1.1:443"},
+		sliceFlags{"10.100.0.1:443", "10.100.0.1:443", "10.100.0.1:443"},
+		sliceFlags{"none", "none", "none"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 2, str)
+	assert.Assert(t, strings.Contains(str, "ports of lb `tcp://10.60.1.1:443` overlap with lb `tcp://10.50.1.1:443,tcp://10.60.1.1:443`"), str)
+	assert.Assert(t, strings.Contains(str, "alias `tcp://10.70.1.1:443` of lb `tcp://10.70.1.1:443,tcp://10.70.1.1:443` overlaps with `tcp://10.70.1.1:443`"), str)
+}
+
+func TestValidateFindsShadowedPools(t *testing.T) {
+	errs := Validate(nil, ControllerConfig{}, EndpointParseOptions{},
+		sliceFlags{"tcp://10.50.1.1:443", "tcp://10.60.1.1:443"},
+		sliceFlags{"10.0.0.0/8=10.100.0.1:443;10.1.0.0/16=10.100.0.2:443;10.100.0.3:443", "10.1.0.0/16=10.100.0.1:443,10.100.0.1:443;10.0.0.0/8=10.100.0.2:443;10.100.0.3:443"},
+		sliceFlags{"none", "none"})
+
+	str := errorStrings(errs)
+	assert.Equal(t, len(errs), 2, str)
+	assert.Assert(t, strings.Contains(str, "source `10.1.0.0/16` of lb `tcp://10.50.1.1:443` is already routed by the pool of `10.0.0.0/8`"), str)
+	assert.Assert(t, strings.Contains(str, "backend `10.100.0.1:443` is defined multiple times for lb `tcp://10.60.1.1:443`"), str)
+}